@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+// Protects Config.ACL, which may be edited from the admin panel at any time
+var aclMutex sync.RWMutex
+
+type TierACL map[string]map[string]string
+
+type ACLAPIOutput struct {
+	Error   string             `json:"error,omitempty"`
+	Tiers   map[string]TierACL `json:"tiers"`
+	Pages   []string           `json:"pages"`
+	Options []string           `json:"options"`
+}
+
+func tierExists(tierTitle string) bool {
+	aclMutex.RLock()
+	defer aclMutex.RUnlock()
+	_, found := Config.ACL[tierTitle]
+	return found
+}
+
+func listTiers() []string {
+	aclMutex.RLock()
+	var tiers []string
+	for tierName := range Config.ACL {
+		tiers = append(tiers, tierName)
+	}
+	aclMutex.RUnlock()
+
+	sort.Strings(tiers)
+	return tiers
+}
+
+// Return a copy of the ACL, safe to be read without holding the lock
+func copyACL() map[string]TierACL {
+	aclMutex.RLock()
+	defer aclMutex.RUnlock()
+
+	out := map[string]TierACL{}
+	for tierName, tier := range Config.ACL {
+		out[tierName] = TierACL{}
+		for page, options := range tier {
+			out[tierName][page] = map[string]string{}
+			for key, val := range options {
+				out[tierName][page][key] = val
+			}
+		}
+	}
+	return out
+}
+
+// Make sure that every page and option of a tier is one that can be signed
+func validateTier(tier TierACL) error {
+	for page, options := range tier {
+		if !slices.Contains(OrderNav, page) {
+			return fmt.Errorf("unknown page %s", page)
+		}
+		for key := range options {
+			if !slices.Contains(OptionalFields, key) {
+				return fmt.Errorf("unknown option %s for page %s", key, page)
+			}
+		}
+	}
+	return nil
+}
+
+// Add or replace a tier, the change is applied to any signature issued afterwards
+func setTier(tierTitle string, tier TierACL) error {
+	if tierTitle == "" {
+		return errors.New("missing tier name")
+	}
+	err := validateTier(tier)
+	if err != nil {
+		return err
+	}
+
+	aclMutex.Lock()
+	if Config.ACL == nil {
+		Config.ACL = map[string]map[string]map[string]string{}
+	}
+	old, existed := Config.ACL[tierTitle]
+	Config.ACL[tierTitle] = tier
+	aclMutex.Unlock()
+
+	err = saveConfig()
+	if err != nil {
+		// Restore the previous state so that memory and disk stay in sync
+		aclMutex.Lock()
+		if existed {
+			Config.ACL[tierTitle] = old
+		} else {
+			delete(Config.ACL, tierTitle)
+		}
+		aclMutex.Unlock()
+	}
+	return err
+}
+
+func deleteTier(tierTitle string) error {
+	aclMutex.Lock()
+	old, found := Config.ACL[tierTitle]
+	if !found {
+		aclMutex.Unlock()
+		return errors.New("tier not found")
+	}
+	delete(Config.ACL, tierTitle)
+	aclMutex.Unlock()
+
+	err := saveConfig()
+	if err != nil {
+		aclMutex.Lock()
+		Config.ACL[tierTitle] = old
+		aclMutex.Unlock()
+	}
+	return err
+}
+
+// Serializes writes to the config file, which share the same temporary file
+var saveConfigMutex sync.Mutex
+
+// Write the current config back to its file, through a temporary file
+// so that a failure never leaves a truncated config behind
+func saveConfig() error {
+	saveConfigMutex.Lock()
+	defer saveConfigMutex.Unlock()
+
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	// Avoids & -> \u0026 and similar
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "    ")
+
+	apiUsersMutex.RLock()
+	aclMutex.RLock()
+	err := e.Encode(&Config)
+	aclMutex.RUnlock()
+	apiUsersMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Keep the permissions of the original file
+	mode := os.FileMode(0644)
+	info, err := os.Stat(Config.filePath)
+	if err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmpName := Config.filePath + ".tmp"
+	err = os.WriteFile(tmpName, buf.Bytes(), mode)
+	if err != nil {
+		return err
+	}
+	// WriteFile does not change the mode of an existing file, nor does it
+	// bypass the umask
+	err = os.Chmod(tmpName, mode)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, Config.filePath)
+}
+
+// Serve the ACL as json for the admin panel at /admin?acl=json
+func ACLAPI(w http.ResponseWriter, r *http.Request) {
+	out := ACLAPIOutput{
+		Tiers:   copyACL(),
+		Pages:   OrderNav,
+		Options: OptionalFields,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&out)
+}
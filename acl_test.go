@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Concurrent saves must always leave a valid config with its original mode
+func TestSaveConfig(t *testing.T) {
+	oldPath := Config.filePath
+	defer func() {
+		Config.filePath = oldPath
+	}()
+
+	Config.filePath = filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(Config.filePath, []byte("{}"), 0640)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to create config: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := saveConfig()
+			if err != nil {
+				t.Errorf("FAIL: Unable to save config: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(Config.filePath)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to read config: %s", err)
+	}
+	var out map[string]any
+	err = json.Unmarshal(data, &out)
+	if err != nil {
+		t.Errorf("FAIL: Saved config is not valid: %s", err)
+	}
+
+	info, err := os.Stat(Config.filePath)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to stat config: %s", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("FAIL: Expected mode 0640, got %o", info.Mode().Perm())
+	}
+}
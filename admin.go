@@ -15,7 +15,6 @@ import (
 	"os/exec"
 	"path"
 	"runtime/debug"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -49,12 +48,14 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 
 	pageVars := genPageNav("Admin", sig)
 
+	// Any action changing state is only accepted via POST, with a valid
+	// csrf token, as verified by enforceSigning
 	msg := r.FormValue("msg")
 	if msg != "" {
 		pageVars.InfoMessage = msg
 	}
 
-	refresh := r.FormValue("refresh")
+	refresh := r.PostFormValue("refresh")
 	if refresh != "" {
 		key, found := ScraperMap[refresh]
 		if !found {
@@ -84,8 +85,8 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	cloud := r.FormValue("cloud")
-	cloud_bl := r.FormValue("cloud_bl")
+	cloud := r.PostFormValue("cloud")
+	cloud_bl := r.PostFormValue("cloud_bl")
 	if cloud != "" || cloud_bl != "" {
 		if cloud != "" {
 			configMutex.RLock()
@@ -101,11 +102,13 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 					}
 					r.URL.RawQuery = v.Encode()
 				} else {
+					scrapersMutex.Lock()
 					for i := range Sellers {
 						if Sellers[i] != nil && Sellers[i].Info().Shorthand == seller.Info().Shorthand {
 							Sellers[i] = seller
 						}
 					}
+					scrapersMutex.Unlock()
 				}
 			}
 		} else {
@@ -122,11 +125,13 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 					}
 					r.URL.RawQuery = v.Encode()
 				} else {
+					scrapersMutex.Lock()
 					for i := range Vendors {
 						if Vendors[i] != nil && Vendors[i].Info().Shorthand == vendor.Info().Shorthand {
 							Vendors[i] = vendor
 						}
 					}
+					scrapersMutex.Unlock()
 				}
 			}
 		}
@@ -143,7 +148,12 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	spoof := r.FormValue("spoof")
+	if r.FormValue("acl") == "json" {
+		ACLAPI(w, r)
+		return
+	}
+
+	spoof := r.PostFormValue("spoof")
 	if spoof != "" {
 		baseURL := getBaseURL(r)
 		sig := sign(baseURL, spoof, nil)
@@ -155,7 +165,7 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reboot := r.FormValue("reboot")
+	reboot := r.PostFormValue("reboot")
 	doReboot := false
 	var v url.Values
 	switch reboot {
@@ -324,10 +334,85 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 		doReboot = true
 
 		user := r.FormValue("user")
+		tier := r.FormValue("tier")
+		scopes := r.FormValue("scopes")
+		cidrs := r.FormValue("cidrs")
 		dur := r.FormValue("duration")
 		duration, _ := strconv.Atoi(dur)
 
-		key, err := generateAPIKey(getBaseURL(r), user, time.Duration(duration)*24*time.Hour)
+		key, err := generateAPIKey(getBaseURL(r), user, tier, scopes, cidrs, time.Duration(duration)*24*time.Hour)
+		msg := key
+		if err != nil {
+			msg = "error: " + err.Error()
+		}
+
+		v.Set("msg", msg)
+
+	case "revokeKey":
+		v = url.Values{}
+		doReboot = true
+
+		keyId := r.FormValue("keyid")
+		err := revokeAPIKey(keyId)
+		msg := "Key " + keyId + " revoked"
+		if err != nil {
+			msg = "error: " + err.Error()
+		}
+
+		v.Set("msg", msg)
+
+	case "setTier":
+		v = url.Values{}
+		doReboot = true
+
+		tierTitle := r.FormValue("tier")
+		var tier TierACL
+		err := json.Unmarshal([]byte(r.FormValue("acl")), &tier)
+		if err == nil {
+			err = setTier(tierTitle, tier)
+		}
+		msg := "Tier " + tierTitle + " updated"
+		if err != nil {
+			msg = "error: " + err.Error()
+		}
+
+		v.Set("msg", msg)
+
+	case "deleteTier":
+		v = url.Values{}
+		doReboot = true
+
+		tierTitle := r.FormValue("tier")
+		err := deleteTier(tierTitle)
+		msg := "Tier " + tierTitle + " deleted"
+		if err != nil {
+			msg = "error: " + err.Error()
+		}
+
+		v.Set("msg", msg)
+
+	case "killSessions":
+		v = url.Values{}
+		doReboot = true
+
+		user := r.FormValue("user")
+		msg := "Sessions are not enabled"
+		if sessionStore != nil {
+			count, err := invalidateUserSessions(user)
+			msg = fmt.Sprintf("Invalidated %d sessions of %s", count, user)
+			if err != nil {
+				msg = "error: " + err.Error()
+			}
+		}
+
+		v.Set("msg", msg)
+
+	case "rotateKeys":
+		v = url.Values{}
+		doReboot = true
+
+		user := r.FormValue("user")
+		key, err := rotateAPIKeys(getBaseURL(r), user)
 		msg := key
 		if err != nil {
 			msg = "error: " + err.Error()
@@ -416,21 +501,34 @@ func Admin(w http.ResponseWriter, r *http.Request) {
 		pageVars.OtherTable = append(pageVars.OtherTable, row)
 	}
 
-	var tiers []string
-	for tierName := range Config.ACL {
-		tiers = append(tiers, tierName)
+	tiers := listTiers()
+	acl := copyACL()
+	for _, tierName := range tiers {
+		data, _ := json.MarshalIndent(acl[tierName], "", "  ")
+		pageVars.TierACLs = append(pageVars.TierACLs, string(data))
 	}
-	sort.Slice(tiers, func(i, j int) bool {
-		return tiers[i] < tiers[j]
-	})
 
 	pageVars.Tiers = tiers
+	pageVars.ACLPages = OrderNav
+	pageVars.ACLOptions = OptionalFields
 	pageVars.Uptime = uptime()
 	pageVars.DiskStatus = disk()
 	pageVars.MemoryStatus = mem()
 	pageVars.LatestHash = BuildCommit
 	pageVars.CurrentTime = time.Now()
 	pageVars.DemoKey = url.QueryEscape(getDemoKey(getBaseURL(r)))
+	pageVars.APIKeys = listAPIKeys()
+	pageVars.Sessions = listSessions()
+	pageVars.Usage = getUsageTotals(DefaultUsageTotalsDays)
+
+	pageVars.AuditFilter = AuditFilter{
+		User:    r.FormValue("audit_user"),
+		Page:    r.FormValue("audit_page"),
+		Outcome: r.FormValue("audit_outcome"),
+		Query:   r.FormValue("audit_query"),
+	}
+	pageVars.AuditEvents = filterAudit(pageVars.AuditFilter, AuditViewSize)
+	pageVars.AuditPages = auditPages()
 
 	render(w, "admin.html", pageVars)
 }
@@ -555,22 +653,81 @@ func mem() string {
 }
 
 const (
+	// Days of API usage summed in the admin table
+	DefaultUsageTotalsDays = 30
+
 	DefaultAPIDemoKeyDuration = 30 * 24 * time.Hour
 	DefaultAPIDemoUser        = "demo@mtgban.com"
 )
 
 func getDemoKey(link string) string {
-	key, _ := generateAPIKey(link, DefaultAPIDemoUser, DefaultAPIDemoKeyDuration)
+	v := url.Values{}
+	v.Set("API", "ALL_ACCESS")
+	v.Set("APImode", "all")
+	key, _ := signAPIKey(link, DefaultAPIDemoUser, v, DefaultAPIDemoKeyDuration)
 	return key
 }
 
 var apiUsersMutex sync.RWMutex
 
-func generateAPIKey(link, user string, duration time.Duration) (string, error) {
+// Issue a new key for user, and record it in the registry so that it can
+// be revoked later, tier keys carry the page permissions of the tier too
+func generateAPIKey(link, user, tier, scopes, cidrs string, duration time.Duration) (string, error) {
 	if user == "" {
 		return "", errors.New("missing user")
 	}
+	if tier != "" {
+		if !tierExists(tier) {
+			return "", errors.New("unknown tier")
+		}
+	}
+	if scopes == "" {
+		scopes = "all"
+	}
+	var allowed []string
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr != "" {
+			allowed = append(allowed, cidr)
+		}
+	}
+	_, err := parseCIDRs(allowed)
+	if err != nil {
+		return "", err
+	}
 
+	v := url.Values{}
+	if tier != "" {
+		v = getValuesForTier(tier)
+		v.Set("UserTier", tier)
+	}
+	v.Set("API", "ALL_ACCESS")
+	v.Set("APImode", scopes)
+
+	record := &APIKeyRecord{
+		Id:      newAPIKeyId(),
+		Owner:   user,
+		Tier:    tier,
+		Scopes:  strings.Split(scopes, ","),
+		CIDRs:   allowed,
+		Created: time.Now(),
+	}
+	if duration != 0 {
+		expires := record.Created.Add(duration)
+		record.Expires = &expires
+	}
+	v.Set("APIKeyId", record.Id)
+
+	err = saveAPIKey(record)
+	if err != nil {
+		return "", err
+	}
+
+	return signAPIKey(link, user, v, duration)
+}
+
+// Sign the values with the secret of the user, creating one if needed
+func signAPIKey(link, user string, v url.Values, duration time.Duration) (string, error) {
 	apiUsersMutex.RLock()
 	key, found := Config.ApiUserSecrets[user]
 	apiUsersMutex.RUnlock()
@@ -581,26 +738,14 @@ func generateAPIKey(link, user string, duration time.Duration) (string, error) {
 		Config.ApiUserSecrets[user] = key
 		apiUsersMutex.Unlock()
 
-		file, err := os.Create(Config.filePath)
-		if err != nil {
-			return "", err
-		}
-		defer file.Close()
-
-		e := json.NewEncoder(file)
-		// Avoids & -> \u0026 and similar
-		e.SetEscapeHTML(false)
-		e.SetIndent("", "    ")
-		err = e.Encode(&Config)
+		err := saveConfig()
 		if err != nil {
 			return "", err
 		}
 	}
 
-	v := url.Values{}
-	v.Set("API", "ALL_ACCESS")
-	v.Set("APImode", "all")
 	v.Set("UserEmail", user)
+	v.Set("Issued", fmt.Sprintf("%d", time.Now().Unix()))
 
 	var exp string
 	if duration != 0 {
@@ -609,8 +754,7 @@ func generateAPIKey(link, user string, duration time.Duration) (string, error) {
 		v.Set("Expires", exp)
 	}
 
-	data := fmt.Sprintf("GET%s%s%s", exp, link, v.Encode())
-	sig := signHMACSHA1Base64([]byte(key), []byte(data))
+	sig := computeSignature(exp, link, v, key)
 
 	v.Set("Signature", sig)
 	return base64.StdEncoding.EncodeToString([]byte(v.Encode())), nil
@@ -31,19 +31,31 @@ type ck2id struct {
 var CKAPIMutex sync.RWMutex
 var CKAPIOutput map[string]*ck2id
 var CKAPIData []cardkingdom.CKCard
+var CKAPITimestamp time.Time
 
 func CKMirrorAPI(w http.ResponseWriter, r *http.Request) {
 	var pricelist struct {
 		Data []cardkingdom.CKCard `json:"list"`
 	}
+	CKAPIMutex.RLock()
 	pricelist.Data = CKAPIData
+	lastModified := CKAPITimestamp
+	CKAPIMutex.RUnlock()
+
+	cacheKey := getAPICacheKey(r)
+	etag, _, done := checkAPICache(w, r, cacheKey, lastModified)
+	if done {
+		return
+	}
+	cacheWriter := newAPICacheWriter(w, cacheKey, etag)
 
-	err := json.NewEncoder(w).Encode(&pricelist)
+	err := json.NewEncoder(cacheWriter).Encode(&pricelist)
 	if err != nil {
 		log.Println(err)
 		w.Write([]byte(`{"error": "` + err.Error() + `"}`))
 		return
 	}
+	cacheWriter.Save(0)
 }
 
 func prepareCKAPI() error {
@@ -54,7 +66,6 @@ func prepareCKAPI() error {
 		log.Println(err)
 		return err
 	}
-	CKAPIData = list
 
 	// Backup option for stashing CK data
 	rdbRT := ScraperOptions["cardkingdom"].RDBs["retail"]
@@ -121,8 +132,16 @@ func prepareCKAPI() error {
 		}
 	}
 
+	// This runs alongside the other scrapers, so update the movements of
+	// its own history separately
+	if !skipRedis {
+		go refreshPriceTrends("ck", "ckbl")
+	}
+
 	CKAPIMutex.Lock()
 	CKAPIOutput = output
+	CKAPIData = list
+	CKAPITimestamp = time.Now()
 	CKAPIMutex.Unlock()
 
 	ServerNotify("api", "CK API refresh completed")
@@ -131,7 +150,7 @@ func prepareCKAPI() error {
 }
 
 func API(w http.ResponseWriter, r *http.Request) {
-	sig := r.FormValue("sig")
+	sig := getAPISignature(r)
 
 	param := GetParamFromSig(sig, "API")
 	canAPI := strings.Contains(param, "CK")
@@ -140,21 +159,30 @@ func API(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Read the output and its timestamp together, so that they always match
 	CKAPIMutex.RLock()
-	defer CKAPIMutex.RUnlock()
-	if CKAPIOutput == nil {
+	outputMap := CKAPIOutput
+	lastModified := CKAPITimestamp
+	CKAPIMutex.RUnlock()
+	if outputMap == nil {
 		log.Println("CK API called when list was empty")
 		w.Write([]byte(`{"error": "empty list"}`))
 		return
 	}
-	outputMap := CKAPIOutput
+
+	cacheKey := getAPICacheKey(r)
+	etag, _, done := checkAPICache(w, r, cacheKey, lastModified)
+	if done {
+		return
+	}
+	cacheWriter := newAPICacheWriter(w, cacheKey, etag)
 
 	// Only scryfall and mtgjson ids are supported due to the unification of finishes
 	// mtgjson is the default, perform a key conversion if scryfall is requested
 	idMode := r.FormValue("id")
 	if idMode == "scryfall" {
 		altMap := map[string]*ck2id{}
-		for uuid, meta := range CKAPIOutput {
+		for uuid, meta := range outputMap {
 			co, err := mtgmatcher.GetUUID(uuid)
 			if err != nil {
 				continue
@@ -165,12 +193,13 @@ func API(w http.ResponseWriter, r *http.Request) {
 		outputMap = altMap
 	}
 
-	err := json.NewEncoder(w).Encode(outputMap)
+	err := json.NewEncoder(cacheWriter).Encode(outputMap)
 	if err != nil {
 		log.Println(err)
 		w.Write([]byte(`{"error": "` + err.Error() + `"}`))
 		return
 	}
+	cacheWriter.Save(0)
 }
 
 var ErrMissingTCGId = errors.New("tcg id not found")
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+)
+
+type ArbitAPIEntry struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	Edition string `json:"edition"`
+	Number  string `json:"number"`
+	Finish  string `json:"finish"`
+
+	// The store the source is compared against
+	Store      string `json:"store"`
+	Conditions string `json:"conditions"`
+
+	Price          float64 `json:"price"`
+	Quantity       int     `json:"quantity,omitempty"`
+	BuyPrice       float64 `json:"buy_price,omitempty"`
+	TradePrice     float64 `json:"trade_price,omitempty"`
+	BuyQuantity    int     `json:"buy_quantity,omitempty"`
+	PriceRatio     float64 `json:"price_ratio,omitempty"`
+	ReferencePrice float64 `json:"reference_price,omitempty"`
+
+	Difference float64 `json:"difference"`
+	Spread     float64 `json:"spread"`
+}
+
+type ArbitAPIOutput struct {
+	Error string `json:"error,omitempty"`
+	Meta  struct {
+		Date    time.Time       `json:"date"`
+		Version string          `json:"version"`
+		Mode    string          `json:"mode"`
+		Source  string          `json:"source"`
+		Sort    string          `json:"sort,omitempty"`
+		Filters map[string]bool `json:"filters,omitempty"`
+	} `json:"meta"`
+
+	Results []ArbitAPIEntry `json:"results"`
+}
+
+func arbitrage2APIEntries(results []Arbitrage) []ArbitAPIEntry {
+	out := []ArbitAPIEntry{}
+	for _, result := range results {
+		for _, entry := range result.Arbit {
+			co, err := mtgmatcher.GetUUID(entry.CardId)
+			if err != nil {
+				continue
+			}
+			out = append(out, ArbitAPIEntry{
+				UUID:           entry.CardId,
+				Name:           co.Name,
+				Edition:        co.Edition,
+				Number:         co.Number,
+				Finish:         uuid2finish(entry.CardId),
+				Store:          result.Key,
+				Conditions:     entry.InventoryEntry.Conditions,
+				Price:          entry.InventoryEntry.Price,
+				Quantity:       entry.InventoryEntry.Quantity,
+				BuyPrice:       entry.BuylistEntry.BuyPrice,
+				TradePrice:     entry.BuylistEntry.TradePrice,
+				BuyQuantity:    entry.BuylistEntry.Quantity,
+				PriceRatio:     entry.BuylistEntry.PriceRatio,
+				ReferencePrice: entry.ReferenceEntry.Price,
+				Difference:     entry.Difference,
+				Spread:         entry.Spread,
+			})
+		}
+	}
+	return out
+}
+
+// Serve the same results of the Arbit, Reverse, and Global pages,
+// the mode is derived from the path
+func ArbitAPI(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+	out := ArbitAPIOutput{}
+	out.Meta.Date = time.Now()
+	out.Meta.Version = APIVersion
+
+	urlPath := strings.TrimPrefix(r.URL.Path, "/api/")
+	mode, fileName, _ := strings.Cut(urlPath, "/")
+	ext := path.Ext(fileName)
+	if ext != ".json" && ext != ".csv" {
+		out.Error = "Not found"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+	sourceOpt := strings.TrimSuffix(fileName, ext)
+
+	var pageName string
+	switch mode {
+	case "arbit":
+		pageName = "Arbit"
+	case "reverse":
+		pageName = "Reverse"
+	case "global":
+		pageName = "Global"
+	default:
+		out.Error = "Not found"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+	out.Meta.Mode = mode
+
+	// Same permissions as the page
+	canDo, _ := strconv.ParseBool(GetParamFromSig(sig, pageName))
+	if DevMode && !SigCheck {
+		canDo = true
+	}
+	if !canDo {
+		out.Error = "Not allowed"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	var allowlistSellers, blocklistVendors []string
+	var anyOptionEnabled, limitedResults bool
+	if mode == "global" {
+		// The Global page only uses this flag to limit results, its
+		// filters are always parsed without the extra options
+		var anyEnabled bool
+		allowlistSellers, blocklistVendors, anyEnabled = getGlobalLists(sig)
+		limitedResults = !anyEnabled
+	} else {
+		allowlistSellers, blocklistVendors, anyOptionEnabled = getArbitLists(sig)
+	}
+
+	source, message := findArbitSource(sourceOpt, allowlistSellers, blocklistVendors, mode == "reverse")
+	if message != "" {
+		out.Error = message
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	r.ParseForm()
+	arbitFilters := parseArbitFilters(r.Form, source, mode == "global", anyOptionEnabled)
+	sorting := r.FormValue("sort")
+
+	out.Meta.Source = source.Info().Shorthand
+	out.Meta.Sort = sorting
+	out.Meta.Filters = arbitFilters
+
+	start := time.Now()
+
+	results := runArbitrage(source, arbitFilters, sorting, blocklistVendors, mode == "global", mode == "reverse", limitedResults)
+	out.Results = arbitrage2APIEntries(results)
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("[%v] %s requested %s API for %s (%d results)", time.Since(start), user, mode, sourceOpt, len(out.Results))
+	event := newAuditEvent(sig, "api", "ArbitAPI", start)
+	event.Query = sourceOpt
+	event.Rows = len(out.Results)
+	event.Message = msg
+	recordAudit(event)
+
+	if ext == ".json" {
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	err := Arbit2CSV(csv.NewWriter(w), out.Results)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func Arbit2CSV(w *csv.Writer, results []ArbitAPIEntry) error {
+	header := []string{
+		"UUID", "Card Name", "Edition", "Number", "Finish", "Store", "Conditions",
+		"Price", "Quantity", "Buy Price", "Trade Price", "Buy Quantity", "Price Ratio",
+		"Reference Price", "Difference", "Spread",
+	}
+	err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range results {
+		record := []string{
+			entry.UUID,
+			entry.Name,
+			entry.Edition,
+			entry.Number,
+			entry.Finish,
+			entry.Store,
+			entry.Conditions,
+			fmt.Sprintf("%0.2f", entry.Price),
+			fmt.Sprint(entry.Quantity),
+			fmt.Sprintf("%0.2f", entry.BuyPrice),
+			fmt.Sprintf("%0.2f", entry.TradePrice),
+			fmt.Sprint(entry.BuyQuantity),
+			fmt.Sprintf("%0.2f", entry.PriceRatio),
+			fmt.Sprintf("%0.2f", entry.ReferencePrice),
+			fmt.Sprintf("%0.2f", entry.Difference),
+			fmt.Sprintf("%0.2f", entry.Spread),
+		}
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/mtgban/go-mtgban/mtgban"
 	"github.com/mtgban/go-mtgban/mtgmatcher"
 	"golang.org/x/exp/slices"
 )
@@ -44,7 +45,7 @@ type PriceAPIOutput struct {
 }
 
 func PriceAPI(w http.ResponseWriter, r *http.Request) {
-	sig := r.FormValue("sig")
+	sig := getAPISignature(r)
 	out := PriceAPIOutput{}
 	out.Meta.Date = time.Now()
 	out.Meta.Version = APIVersion
@@ -52,44 +53,15 @@ func PriceAPI(w http.ResponseWriter, r *http.Request) {
 
 	urlPath := strings.TrimPrefix(r.URL.Path, "/api/mtgban/")
 
-	if !strings.HasSuffix(urlPath, ".json") && !strings.HasSuffix(urlPath, ".csv") {
+	switch path.Ext(urlPath) {
+	case ".json", ".ndjson", ".csv":
+	default:
 		out.Error = "Not found"
 		json.NewEncoder(w).Encode(&out)
 		return
 	}
 
-	storesOpt := GetParamFromSig(sig, "API")
-	if DevMode && !SigCheck && storesOpt == "" {
-		storesOpt = "DEV_ACCESS"
-	}
-	var enabledStores []string
-	switch storesOpt {
-	case "ALL_ACCESS":
-		for _, seller := range Sellers {
-			if seller != nil && !slices.Contains(Config.SearchRetailBlockList, seller.Info().Shorthand) {
-				enabledStores = append(enabledStores, seller.Info().Shorthand)
-			}
-		}
-		for _, vendor := range Vendors {
-			if vendor != nil && !slices.Contains(Config.SearchBuylistBlockList, vendor.Info().Shorthand) {
-				enabledStores = append(enabledStores, vendor.Info().Shorthand)
-			}
-		}
-	case "DEV_ACCESS":
-		for _, seller := range Sellers {
-			if seller != nil {
-				enabledStores = append(enabledStores, seller.Info().Shorthand)
-			}
-		}
-		for _, vendor := range Vendors {
-			if vendor != nil {
-				enabledStores = append(enabledStores, vendor.Info().Shorthand)
-			}
-		}
-	default:
-		enabledStores = strings.Split(storesOpt, ",")
-	}
-	enabledModes := strings.Split(GetParamFromSig(sig, "APImode"), ",")
+	enabledStores := getAPIEnabledStores(sig)
 	idOpt := r.FormValue("id")
 	qty, _ := strconv.ParseBool(r.FormValue("qty"))
 	conds, _ := strconv.ParseBool(r.FormValue("conds"))
@@ -105,41 +77,9 @@ func PriceAPI(w http.ResponseWriter, r *http.Request) {
 	filterByEdition := ""
 	var filterByHash []string
 	if strings.Contains(urlPath, "/") {
-		base := path.Base(urlPath)
-		if strings.HasSuffix(urlPath, ".json") {
-			base = strings.TrimSuffix(base, ".json")
-		} else if strings.HasSuffix(urlPath, ".csv") {
-			base = strings.TrimSuffix(base, ".csv")
-		}
-
-		// Check if the path element is a set name or a hash
-		set, err := mtgmatcher.GetSet(base)
-		if err == nil {
-			filterByEdition = set.Code
-		} else {
-			for _, opts := range [][]bool{
-				// Check for nonfoil, foil, etched
-				[]bool{false, false}, []bool{true, false}, []bool{false, true},
-			} {
-				uuid, err := mtgmatcher.MatchId(base, opts...)
-				if err != nil {
-					continue
-				}
-				// Skip if hash is already present
-				if slices.Contains(filterByHash, uuid) {
-					continue
-				}
-				filterByHash = append(filterByHash, uuid)
-			}
-			// Speed up search by keeping only the needed edition
-			if len(filterByHash) > 0 {
-				co, err := mtgmatcher.GetUUID(filterByHash[0])
-				if err == nil {
-					filterByEdition = co.SetCode
-				}
-			}
-		}
+		base := strings.TrimSuffix(path.Base(urlPath), path.Ext(urlPath))
 
+		filterByEdition, filterByHash = parsePriceAPIFilter(base)
 		if filterByEdition == "" && filterByHash == nil {
 			out.Error = "Not found"
 			json.NewEncoder(w).Encode(&out)
@@ -147,14 +87,6 @@ func PriceAPI(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Only filtered output can have csv encoding, and only for retail or buylist requests
-	checkCSVoutput := (filterByEdition == "" && filterByHash == nil && filterByFinish == "") || strings.HasPrefix(urlPath, "all")
-	if strings.HasSuffix(urlPath, ".csv") && checkCSVoutput {
-		out.Error = "Invalid request"
-		json.NewEncoder(w).Encode(&out)
-		return
-	}
-
 	// Only search conditions when a single store is enabled, or if a list of card is requested
 	if len(enabledStores) == 1 {
 		conds = true
@@ -165,18 +97,64 @@ func PriceAPI(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
 	dumpType := ""
-	canRetail := slices.Contains(enabledModes, "retail") || (slices.Contains(enabledModes, "all") || (DevMode && !SigCheck))
-	canBuylist := slices.Contains(enabledModes, "buylist") || (slices.Contains(enabledModes, "all") || (DevMode && !SigCheck))
-	if (strings.HasPrefix(urlPath, "retail") || strings.HasPrefix(urlPath, "all")) && canRetail {
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+	doRetail := (strings.HasPrefix(urlPath, "retail") || strings.HasPrefix(urlPath, "all")) && canRetail
+	doBuylist := (strings.HasPrefix(urlPath, "buylist") || strings.HasPrefix(urlPath, "all")) && canBuylist
+	if doRetail {
 		dumpType += "retail"
-		out.Retail = getSellerPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds)
 	}
-	if (strings.HasPrefix(urlPath, "buylist") || strings.HasPrefix(urlPath, "all")) && canBuylist {
+	if doBuylist {
 		dumpType += "buylist"
-		out.Buylist = getVendorPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds)
 	}
 
+	if !doRetail && !doBuylist {
+		out.Error = "Not found"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	format := strings.TrimPrefix(path.Ext(urlPath), ".")
 	user := GetParamFromSig(sig, "UserEmail")
+
+	// Skip any work if the client already has the latest data
+	lastModified := getStoresLastModified(enabledStores, doRetail, doBuylist)
+	cacheKey := getAPICacheKey(r, strings.Join(enabledStores, ","), dumpType)
+	etag, rows, done := checkAPICache(w, r, cacheKey, lastModified)
+	if done {
+		addUsageCards(r, rows)
+
+		event := newAuditEvent(sig, "api", "PriceAPI", start)
+		event.Query = dumpType
+		event.Stores = enabledStores
+		event.Rows = rows
+		event.Message = fmt.Sprintf("%s requested a '%s' API dump ('%s','%q','%s') in %s, served from cache", user, dumpType, filterByEdition, filterByHash, filterByFinish, format)
+		recordAudit(event)
+		return
+	}
+
+	// Only the json output is stored, streams need to keep memory flat
+	cacheWriter := newAPICacheWriter(w, cacheKey, etag)
+	if format == "json" {
+		w = cacheWriter
+	}
+
+	var err error
+	var cards int
+	switch format {
+	case "json":
+		if doRetail {
+			out.Retail = getSellerPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds)
+		}
+		if doBuylist {
+			out.Buylist = getVendorPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds)
+		}
+	case "ndjson", "csv":
+		// Large dumps are sent card by card as soon as they are ready
+		cards, err = streamPriceAPI(w, format, doRetail, doBuylist, idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds, showFullName)
+	}
+	cards += len(out.Retail) + len(out.Buylist)
+	addUsageCards(r, cards)
+
 	msg := fmt.Sprintf("[%v] %s requested a '%s' API dump ('%s','%q','%s')", time.Since(start), user, dumpType, filterByEdition, filterByHash, filterByFinish)
 	if qty {
 		msg += " with quantities"
@@ -184,44 +162,192 @@ func PriceAPI(w http.ResponseWriter, r *http.Request) {
 	if conds {
 		msg += " with conditions"
 	}
-	if strings.HasSuffix(urlPath, ".json") {
-		msg += " in json"
-	} else if strings.HasSuffix(urlPath, ".csv") {
-		msg += " in csv"
-	}
+	msg += " in " + format
 
-	if DevMode {
-		log.Println(msg)
-	} else {
-		UserNotify("api", msg)
+	event := newAuditEvent(sig, "api", "PriceAPI", start)
+	event.Query = dumpType
+	event.Stores = enabledStores
+	event.Rows = cards
+	if err != nil {
+		event.Outcome = AuditOutcomeError
 	}
+	event.Message = msg
+	recordAudit(event)
 
-	if out.Retail == nil && out.Buylist == nil {
-		out.Error = "Not found"
-		json.NewEncoder(w).Encode(&out)
+	if err != nil {
+		log.Println(err)
 		return
 	}
-
-	if strings.HasSuffix(urlPath, ".json") {
+	if format == "json" {
 		json.NewEncoder(w).Encode(&out)
-		return
-	} else if strings.HasSuffix(urlPath, ".csv") {
+	}
+	cacheWriter.Save(cards)
+}
+
+// Number of cards sent before flushing the stream to the client
+const PriceAPIStreamFlushSize = 1000
+
+type PriceAPIEntry struct {
+	Id     string               `json:"id"`
+	Kind   string               `json:"kind"`
+	Prices map[string]*BanPrice `json:"prices"`
+}
+
+// Return the number of entries that were sent
+func streamPriceAPI(w http.ResponseWriter, format string, doRetail, doBuylist bool, idOpt string, enabledStores []string, filterByEdition string, filterByHash []string, filterByFinish string, qty, conds, showFullName bool) (int, error) {
+	var count int
+	var csvWriter *csv.Writer
+	flush := func() {
+		count++
+		if count%PriceAPIStreamFlushSize != 0 {
+			return
+		}
+		if csvWriter != nil {
+			csvWriter.Flush()
+		}
+		flusher, ok := w.(http.Flusher)
+		if ok {
+			flusher.Flush()
+		}
+	}
+
+	var writeEntry func(kind string) func(id string, prices map[string]*BanPrice) error
+	switch format {
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		writeEntry = func(kind string) func(id string, prices map[string]*BanPrice) error {
+			return func(id string, prices map[string]*BanPrice) error {
+				defer flush()
+				return encoder.Encode(&PriceAPIEntry{
+					Id:     id,
+					Kind:   kind,
+					Prices: prices,
+				})
+			}
+		}
+	case "csv":
 		w.Header().Set("Content-Type", "text/csv")
-		var err error
-		csvWriter := csv.NewWriter(w)
-		if out.Retail != nil {
-			err = BanPrice2CSV(csvWriter, out.Retail, qty, conds, showFullName)
-		} else if out.Buylist != nil {
-			err = BanPrice2CSV(csvWriter, out.Buylist, qty, conds, showFullName)
+		csvWriter = csv.NewWriter(w)
+		// Only add the kind column when both types are exported
+		shouldKind := doRetail && doBuylist
+		err := BanPriceHeader2CSV(csvWriter, qty, conds, showFullName, shouldKind)
+		if err != nil {
+			return 0, err
+		}
+		writeEntry = func(kind string) func(id string, prices map[string]*BanPrice) error {
+			if !shouldKind {
+				kind = ""
+			}
+			return func(id string, prices map[string]*BanPrice) error {
+				defer flush()
+				return BanPriceEntry2CSV(csvWriter, id, kind, prices, qty, conds, showFullName)
+			}
 		}
+	default:
+		return 0, fmt.Errorf("unsupported format %s", format)
+	}
+
+	if doRetail {
+		err := streamSellerPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds, writeEntry("retail"))
 		if err != nil {
-			log.Println(err)
+			return count, err
+		}
+	}
+	if doBuylist {
+		err := streamVendorPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds, writeEntry("buylist"))
+		if err != nil {
+			return count, err
+		}
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+		return count, csvWriter.Error()
+	}
+	return count, nil
+}
+
+// Check if the path element is a set code or a card hash, returning the
+// edition to filter by, and the list of uuids (one per finish) if a card
+func parsePriceAPIFilter(base string) (filterByEdition string, filterByHash []string) {
+	set, err := mtgmatcher.GetSet(base)
+	if err == nil {
+		filterByEdition = set.Code
+	} else {
+		filterByHash = matchAllFinishes(base)
+		// Speed up search by keeping only the needed edition
+		if len(filterByHash) > 0 {
+			co, err := mtgmatcher.GetUUID(filterByHash[0])
+			if err == nil {
+				filterByEdition = co.SetCode
+			}
 		}
-		return
 	}
+	return
+}
 
-	out.Error = "Internal Server Error"
-	json.NewEncoder(w).Encode(&out)
+// Return the uuids of all the finishes available for the given card id
+func matchAllFinishes(cardId string) []string {
+	var out []string
+	for _, opts := range [][]bool{
+		// Check for nonfoil, foil, etched
+		[]bool{false, false}, []bool{true, false}, []bool{false, true},
+	} {
+		uuid, err := mtgmatcher.MatchId(cardId, opts...)
+		if err != nil {
+			continue
+		}
+		// Skip if hash is already present
+		if slices.Contains(out, uuid) {
+			continue
+		}
+		out = append(out, uuid)
+	}
+	return out
+}
+
+// Return the list of stores the signature has access to
+func getAPIEnabledStores(sig string) []string {
+	storesOpt := GetParamFromSig(sig, "API")
+	if DevMode && !SigCheck && storesOpt == "" {
+		storesOpt = "DEV_ACCESS"
+	}
+	var enabledStores []string
+	switch storesOpt {
+	case "ALL_ACCESS":
+		for _, seller := range Sellers {
+			if seller != nil && !slices.Contains(Config.SearchRetailBlockList, seller.Info().Shorthand) {
+				enabledStores = append(enabledStores, seller.Info().Shorthand)
+			}
+		}
+		for _, vendor := range Vendors {
+			if vendor != nil && !slices.Contains(Config.SearchBuylistBlockList, vendor.Info().Shorthand) {
+				enabledStores = append(enabledStores, vendor.Info().Shorthand)
+			}
+		}
+	case "DEV_ACCESS":
+		for _, seller := range Sellers {
+			if seller != nil {
+				enabledStores = append(enabledStores, seller.Info().Shorthand)
+			}
+		}
+		for _, vendor := range Vendors {
+			if vendor != nil {
+				enabledStores = append(enabledStores, vendor.Info().Shorthand)
+			}
+		}
+	default:
+		enabledStores = strings.Split(storesOpt, ",")
+	}
+	return enabledStores
+}
+
+// Return whether the signature has access to retail and buylist prices
+func getAPIEnabledModes(sig string) (bool, bool) {
+	enabledModes := strings.Split(GetParamFromSig(sig, "APImode"), ",")
+	canRetail := slices.Contains(enabledModes, "retail") || (slices.Contains(enabledModes, "all") || (DevMode && !SigCheck))
+	canBuylist := slices.Contains(enabledModes, "buylist") || (slices.Contains(enabledModes, "all") || (DevMode && !SigCheck))
+	return canRetail, canBuylist
 }
 
 func getIdFunc(mode string) func(co *mtgmatcher.CardObject) string {
@@ -268,7 +394,104 @@ func getIdFunc(mode string) func(co *mtgmatcher.CardObject) string {
 
 func getSellerPrices(mode string, enabledStores []string, filterByEdition string, filterByHash []string, filterByFinish string, qty bool, conds bool) map[string]map[string]*BanPrice {
 	out := map[string]map[string]*BanPrice{}
+	streamSellerPrices(mode, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds, func(id string, prices map[string]*BanPrice) error {
+		out[id] = prices
+		return nil
+	})
+	return out
+}
+
+func getVendorPrices(mode string, enabledStores []string, filterByEdition string, filterByHash []string, filterByFinish string, qty bool, conds bool) map[string]map[string]*BanPrice {
+	out := map[string]map[string]*BanPrice{}
+	streamVendorPrices(mode, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds, func(id string, prices map[string]*BanPrice) error {
+		out[id] = prices
+		return nil
+	})
+	return out
+}
+
+// Loop through all the cards matching the filters, grouping together the
+// cardIds that share the same output id, and call fn for each group in order.
+// Full dumps are processed one edition at a time, so that memory is bounded
+// by the size of the largest edition rather than by the whole datastore
+func forEachPriceId(mode string, filterByEdition string, filterByHash []string, filterByFinish string, fn func(id string, cardIds []string) error) error {
 	idFunc := getIdFunc(mode)
+
+	if filterByHash != nil {
+		return forEachPriceGroup(idFunc, filterByHash, filterByEdition, filterByFinish, fn)
+	}
+
+	sets := mtgmatcher.GetSets()
+	var codes []string
+	for code := range sets {
+		if filterByEdition != "" && code != filterByEdition {
+			continue
+		}
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		var cardIds []string
+		for _, card := range sets[code].Cards {
+			cardIds = append(cardIds, matchAllFinishes(card.UUID)...)
+		}
+		err := forEachPriceGroup(idFunc, cardIds, filterByEdition, filterByFinish, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Group the given cardIds by output id and call fn for each group in order
+func forEachPriceGroup(idFunc func(co *mtgmatcher.CardObject) string, cardIds []string, filterByEdition string, filterByFinish string, fn func(id string, cardIds []string) error) error {
+	var ids []string
+	groups := map[string][]string{}
+	for _, cardId := range cardIds {
+		co, err := mtgmatcher.GetUUID(cardId)
+		if err != nil {
+			continue
+		}
+		if filterByEdition != "" && co.SetCode != filterByEdition {
+			continue
+		}
+		if filterByFinish != "" && checkFinish(co, filterByFinish) {
+			continue
+		}
+
+		id := idFunc(co)
+		group, found := groups[id]
+		if !found {
+			ids = append(ids, id)
+		}
+		// Skip duplicates, or quantities would be counted twice
+		if slices.Contains(group, cardId) {
+			continue
+		}
+		groups[id] = append(group, cardId)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		err := fn(id, groups[id])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call fn for every card id with all the retail prices from the enabled stores,
+// so that callers do not need to keep the full price map in memory
+func streamSellerPrices(mode string, enabledStores []string, filterByEdition string, filterByHash []string, filterByFinish string, qty bool, conds bool, fn func(id string, prices map[string]*BanPrice) error) error {
+	type sellerData struct {
+		tag       string
+		shouldQty bool
+		inventory mtgban.InventoryRecord
+	}
+
+	var sellers []sellerData
 	for _, seller := range Sellers {
 		if seller == nil {
 			continue
@@ -292,101 +515,60 @@ func getSellerPrices(mode string, enabledStores []string, filterByEdition string
 			continue
 		}
 
-		// Loop through cards
-		for cardId := range inventory {
-			// No price no dice
-			if len(inventory[cardId]) == 0 || inventory[cardId][0].Price == 0 {
-				continue
-			}
+		sellers = append(sellers, sellerData{
+			tag: sellerTag,
+			// Determine whether the response should include qty information
+			// Needs to be explicitly requested, all the index prices are skipped,
+			// TCG is too due to how quantities are stored in mtgban (FIXME?)
+			// (only for retail).
+			shouldQty: qty && !seller.Info().MetadataOnly && sellerTag != "TCG Player" && sellerTag != "TCG Direct",
+			inventory: inventory,
+		})
+	}
+	if len(sellers) == 0 {
+		return nil
+	}
 
+	return forEachPriceId(mode, filterByEdition, filterByHash, filterByFinish, func(id string, cardIds []string) error {
+		prices := map[string]*BanPrice{}
+		for _, cardId := range cardIds {
 			co, err := mtgmatcher.GetUUID(cardId)
 			if err != nil {
 				continue
 			}
 
-			if filterByEdition != "" && co.SetCode != filterByEdition {
-				continue
-			}
-			if filterByHash != nil && !slices.Contains(filterByHash, cardId) {
-				continue
-			}
-			if filterByFinish != "" && checkFinish(co, filterByFinish) {
-				continue
-			}
-
-			id := idFunc(co)
+			for _, seller := range sellers {
+				entries := seller.inventory[cardId]
 
-			_, found := out[id]
-			if !found {
-				out[id] = map[string]*BanPrice{}
-			}
-			if out[id][sellerTag] == nil {
-				out[id][sellerTag] = &BanPrice{}
-			}
-
-			// Determine whether the response should include qty information
-			// Needs to be explicitly requested, all the index prices are skipped,
-			// TCG is too due to how quantities are stored in mtgban (FIXME?)
-			// (only for retail).
-			shouldQty := qty && !seller.Info().MetadataOnly && sellerTag != "TCG Player" && sellerTag != "TCG Direct"
-
-			if co.Etched {
-				out[id][sellerTag].Etched = inventory[cardId][0].Price
-				if shouldQty {
-					for i := range inventory[cardId] {
-						out[id][sellerTag].QtyEtched += inventory[cardId][i].Quantity
-					}
-				}
-				if conds {
-					if out[id][sellerTag].Conditions == nil {
-						out[id][sellerTag].Conditions = map[string]float64{}
-					}
-					for i := range inventory[cardId] {
-						condTag := inventory[cardId][i].Conditions
-						out[id][sellerTag].Conditions[condTag+"_etched"] = inventory[cardId][i].Price
-					}
-				}
-			} else if co.Foil {
-				out[id][sellerTag].Foil = inventory[cardId][0].Price
-				if shouldQty {
-					for i := range inventory[cardId] {
-						out[id][sellerTag].QtyFoil += inventory[cardId][i].Quantity
-					}
-				}
-				if conds {
-					if out[id][sellerTag].Conditions == nil {
-						out[id][sellerTag].Conditions = map[string]float64{}
-					}
-					for i := range inventory[cardId] {
-						condTag := inventory[cardId][i].Conditions
-						out[id][sellerTag].Conditions[condTag+"_foil"] = inventory[cardId][i].Price
-					}
-				}
-			} else {
-				out[id][sellerTag].Regular = inventory[cardId][0].Price
-				if shouldQty {
-					for i := range inventory[cardId] {
-						out[id][sellerTag].Qty += inventory[cardId][i].Quantity
-					}
+				// No price no dice
+				if len(entries) == 0 || entries[0].Price == 0 {
+					continue
 				}
-				if conds {
-					if out[id][sellerTag].Conditions == nil {
-						out[id][sellerTag].Conditions = map[string]float64{}
-					}
-					for i := range inventory[cardId] {
-						out[id][sellerTag].Conditions[inventory[cardId][i].Conditions] = inventory[cardId][i].Price
-					}
+
+				if prices[seller.tag] == nil {
+					prices[seller.tag] = &BanPrice{}
 				}
+				addSellerPrice(prices[seller.tag], co, entries, seller.shouldQty, conds)
 			}
 		}
-	}
 
-	return out
+		if len(prices) == 0 {
+			return nil
+		}
+		return fn(id, prices)
+	})
 }
 
-func getVendorPrices(mode string, enabledStores []string, filterByEdition string, filterByHash []string, filterByFinish string, qty bool, conds bool) map[string]map[string]*BanPrice {
-	out := map[string]map[string]*BanPrice{}
-	idFunc := getIdFunc(mode)
+// Call fn for every card id with all the buylist prices from the enabled stores,
+// so that callers do not need to keep the full price map in memory
+func streamVendorPrices(mode string, enabledStores []string, filterByEdition string, filterByHash []string, filterByFinish string, qty bool, conds bool, fn func(id string, prices map[string]*BanPrice) error) error {
+	type vendorData struct {
+		tag       string
+		shouldQty bool
+		buylist   mtgban.BuylistRecord
+	}
+
+	var vendors []vendorData
 	for _, vendor := range Vendors {
 		if vendor == nil {
 			continue
@@ -410,90 +592,104 @@ func getVendorPrices(mode string, enabledStores []string, filterByEdition string
 			continue
 		}
 
-		// Loop through cards
-		for cardId := range buylist {
-			// No price no dice
-			if len(buylist[cardId]) == 0 || buylist[cardId][0].BuyPrice == 0 {
-				continue
-			}
+		vendors = append(vendors, vendorData{
+			tag:       vendorTag,
+			shouldQty: qty && !vendor.Info().MetadataOnly,
+			buylist:   buylist,
+		})
+	}
+	if len(vendors) == 0 {
+		return nil
+	}
 
+	return forEachPriceId(mode, filterByEdition, filterByHash, filterByFinish, func(id string, cardIds []string) error {
+		prices := map[string]*BanPrice{}
+		for _, cardId := range cardIds {
 			co, err := mtgmatcher.GetUUID(cardId)
 			if err != nil {
 				continue
 			}
 
-			if filterByEdition != "" && co.SetCode != filterByEdition {
-				continue
-			}
-			if filterByHash != nil && !slices.Contains(filterByHash, cardId) {
-				continue
-			}
-			if filterByFinish != "" && checkFinish(co, filterByFinish) {
-				continue
-			}
+			for _, vendor := range vendors {
+				entries := vendor.buylist[cardId]
 
-			id := idFunc(co)
-
-			_, found := out[id]
-			if !found {
-				out[id] = map[string]*BanPrice{}
-			}
-			if out[id][vendorTag] == nil {
-				out[id][vendorTag] = &BanPrice{}
-			}
-			if co.Etched {
-				out[id][vendorTag].Etched = buylist[cardId][0].BuyPrice
-				if qty && !vendor.Info().MetadataOnly {
-					for i := range buylist[cardId] {
-						out[id][vendorTag].QtyEtched += buylist[cardId][i].Quantity
-					}
-				}
-				if conds {
-					if out[id][vendorTag].Conditions == nil {
-						out[id][vendorTag].Conditions = map[string]float64{}
-					}
-					for i := range buylist[cardId] {
-						condTag := buylist[cardId][i].Conditions
-						out[id][vendorTag].Conditions[condTag+"_etched"] = buylist[cardId][i].BuyPrice
-					}
-				}
-			} else if co.Foil {
-				out[id][vendorTag].Foil = buylist[cardId][0].BuyPrice
-				if qty && !vendor.Info().MetadataOnly {
-					for i := range buylist[cardId] {
-						out[id][vendorTag].QtyFoil += buylist[cardId][i].Quantity
-					}
-				}
-				if conds {
-					if out[id][vendorTag].Conditions == nil {
-						out[id][vendorTag].Conditions = map[string]float64{}
-					}
-					for i := range buylist[cardId] {
-						condTag := buylist[cardId][i].Conditions
-						out[id][vendorTag].Conditions[condTag+"_foil"] = buylist[cardId][i].BuyPrice
-					}
-				}
-			} else {
-				out[id][vendorTag].Regular = buylist[cardId][0].BuyPrice
-				if qty && !vendor.Info().MetadataOnly {
-					for i := range buylist[cardId] {
-						out[id][vendorTag].Qty += buylist[cardId][i].Quantity
-					}
+				// No price no dice
+				if len(entries) == 0 || entries[0].BuyPrice == 0 {
+					continue
 				}
-				if conds {
-					if out[id][vendorTag].Conditions == nil {
-						out[id][vendorTag].Conditions = map[string]float64{}
-					}
-					for i := range buylist[cardId] {
-						condTag := buylist[cardId][i].Conditions
-						out[id][vendorTag].Conditions[condTag] = buylist[cardId][i].BuyPrice
-					}
+
+				if prices[vendor.tag] == nil {
+					prices[vendor.tag] = &BanPrice{}
 				}
+				addVendorPrice(prices[vendor.tag], co, entries, vendor.shouldQty, conds)
 			}
 		}
+
+		if len(prices) == 0 {
+			return nil
+		}
+		return fn(id, prices)
+	})
+}
+
+// Fill in the BanPrice fields related to the finish of the card
+func addBanPrice(bp *BanPrice, co *mtgmatcher.CardObject, price float64, quantity int, conditions map[string]float64) {
+	suffix := ""
+	if co.Etched {
+		suffix = "_etched"
+		bp.Etched = price
+		bp.QtyEtched += quantity
+	} else if co.Foil {
+		suffix = "_foil"
+		bp.Foil = price
+		bp.QtyFoil += quantity
+	} else {
+		bp.Regular = price
+		bp.Qty += quantity
 	}
 
-	return out
+	if conditions != nil {
+		if bp.Conditions == nil {
+			bp.Conditions = map[string]float64{}
+		}
+		for tag, price := range conditions {
+			bp.Conditions[tag+suffix] = price
+		}
+	}
+}
+
+func addSellerPrice(bp *BanPrice, co *mtgmatcher.CardObject, entries []mtgban.InventoryEntry, shouldQty, conds bool) {
+	var quantity int
+	var conditions map[string]float64
+	for i := range entries {
+		if shouldQty {
+			quantity += entries[i].Quantity
+		}
+		if conds {
+			if conditions == nil {
+				conditions = map[string]float64{}
+			}
+			conditions[entries[i].Conditions] = entries[i].Price
+		}
+	}
+	addBanPrice(bp, co, entries[0].Price, quantity, conditions)
+}
+
+func addVendorPrice(bp *BanPrice, co *mtgmatcher.CardObject, entries []mtgban.BuylistEntry, shouldQty, conds bool) {
+	var quantity int
+	var conditions map[string]float64
+	for i := range entries {
+		if shouldQty {
+			quantity += entries[i].Quantity
+		}
+		if conds {
+			if conditions == nil {
+				conditions = map[string]float64{}
+			}
+			conditions[entries[i].Conditions] = entries[i].BuyPrice
+		}
+	}
+	addBanPrice(bp, co, entries[0].BuyPrice, quantity, conditions)
 }
 
 func checkFinish(co *mtgmatcher.CardObject, finish string) bool {
@@ -508,98 +704,120 @@ func checkFinish(co *mtgmatcher.CardObject, finish string) bool {
 	return false
 }
 
+var BanPriceConditionKeys = []string{
+	"NM", "SP", "MP", "HP", "PO",
+	"NM_foil", "SP_foil", "MP_foil", "HP_foil", "PO_foil",
+	"NM_etched", "SP_etched", "MP_etched", "HP_etched", "PO_etched",
+}
+
 func BanPrice2CSV(w *csv.Writer, pm map[string]map[string]*BanPrice, shouldQty, shouldCond, shouldFullName bool) error {
-	var condKeys []string
+	err := BanPriceHeader2CSV(w, shouldQty, shouldCond, shouldFullName, false)
+	if err != nil {
+		return err
+	}
+
+	for id := range pm {
+		err = BanPriceEntry2CSV(w, id, "", pm[id], shouldQty, shouldCond, shouldFullName)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
 
+// Write the CSV header, with an additional column reporting the type of price
+// in case both retail and buylist are going to be present
+func BanPriceHeader2CSV(w *csv.Writer, shouldQty, shouldCond, shouldFullName, shouldKind bool) error {
 	header := []string{"UUID"}
 	if shouldFullName {
 		header = append(header, "TCG Product Id", "Card Name", "Edition", "Number", "Rarity")
 	}
-	header = append(header, "Store", "Regular Price", "Foil Price", "Etched Price")
+	header = append(header, "Store")
+	if shouldKind {
+		header = append(header, "Kind")
+	}
+	header = append(header, "Regular Price", "Foil Price", "Etched Price")
 	if shouldQty {
 		header = append(header, "Regular Quantity", "Foil Quantity", "Etched Quantity")
 	}
 	if shouldCond {
-		condKeys = []string{
-			"NM", "SP", "MP", "HP", "PO",
-			"NM_foil", "SP_foil", "MP_foil", "HP_foil", "PO_foil",
-			"NM_etched", "SP_etched", "MP_etched", "HP_etched", "PO_etched",
-		}
-		header = append(header, condKeys...)
+		header = append(header, BanPriceConditionKeys...)
 	}
 
-	err := w.Write(header)
-	if err != nil {
-		return err
-	}
+	return w.Write(header)
+}
 
-	for id := range pm {
-		var cardName, edition, number, tcgId, rarity string
-		if shouldFullName {
-			co, err := mtgmatcher.GetUUID(id)
+// Write all the store prices of a single card, kind is added as a column if not empty
+func BanPriceEntry2CSV(w *csv.Writer, id, kind string, prices map[string]*BanPrice, shouldQty, shouldCond, shouldFullName bool) error {
+	var cardName, edition, number, tcgId, rarity string
+	if shouldFullName {
+		co, err := mtgmatcher.GetUUID(id)
+		if err != nil {
+			co, err = mtgmatcher.GetUUID(mtgmatcher.Scryfall2UUID(id))
 			if err != nil {
-				co, err = mtgmatcher.GetUUID(mtgmatcher.Scryfall2UUID(id))
-				if err != nil {
-					continue
-				}
-			}
-			cardName = co.Name
-			edition = co.Edition
-			number = co.Number
-			rarity = co.Rarity
-			tcgId = co.Identifiers["tcgplayerProductId"]
-			if co.Etched {
-				tcgId = co.Identifiers["tcgplayerEtchedProductId"]
+				return nil
 			}
 		}
-		for scraper, entry := range pm[id] {
-			var regular, foil, etched string
-			var regularQty, foilQty, etchedQty string
+		cardName = co.Name
+		edition = co.Edition
+		number = co.Number
+		rarity = co.Rarity
+		tcgId = co.Identifiers["tcgplayerProductId"]
+		if co.Etched {
+			tcgId = co.Identifiers["tcgplayerEtchedProductId"]
+		}
+	}
+	for scraper, entry := range prices {
+		var regular, foil, etched string
+		var regularQty, foilQty, etchedQty string
 
-			if entry.Regular != 0 {
-				regular = fmt.Sprintf("%0.2f", entry.Regular)
-				if shouldQty && entry.Qty != 0 {
-					regularQty = fmt.Sprintf("%d", entry.Qty)
-				}
+		if entry.Regular != 0 {
+			regular = fmt.Sprintf("%0.2f", entry.Regular)
+			if shouldQty && entry.Qty != 0 {
+				regularQty = fmt.Sprintf("%d", entry.Qty)
 			}
-			if entry.Foil != 0 {
-				foil = fmt.Sprintf("%0.2f", entry.Foil)
-				if shouldQty && entry.QtyFoil != 0 {
-					foilQty = fmt.Sprintf("%d", entry.QtyFoil)
-				}
+		}
+		if entry.Foil != 0 {
+			foil = fmt.Sprintf("%0.2f", entry.Foil)
+			if shouldQty && entry.QtyFoil != 0 {
+				foilQty = fmt.Sprintf("%d", entry.QtyFoil)
 			}
-			if entry.Etched != 0 {
-				etched = fmt.Sprintf("%0.2f", entry.Etched)
-				if shouldQty && entry.QtyEtched != 0 {
-					etchedQty = fmt.Sprintf("%d", entry.QtyEtched)
-				}
+		}
+		if entry.Etched != 0 {
+			etched = fmt.Sprintf("%0.2f", entry.Etched)
+			if shouldQty && entry.QtyEtched != 0 {
+				etchedQty = fmt.Sprintf("%d", entry.QtyEtched)
 			}
+		}
 
-			record := []string{id}
-			if shouldFullName {
-				record = append(record, tcgId, cardName, edition, number, rarity)
-			}
-			record = append(record, scraper, regular, foil, etched)
-			if shouldQty {
-				record = append(record, regularQty, foilQty, etchedQty)
-			}
-			if shouldCond {
-				for _, tag := range condKeys {
-					var priceStr string
-					price := entry.Conditions[tag]
-					if price != 0 {
-						priceStr = fmt.Sprintf("%0.2f", price)
-					}
-					record = append(record, priceStr)
+		record := []string{id}
+		if shouldFullName {
+			record = append(record, tcgId, cardName, edition, number, rarity)
+		}
+		record = append(record, scraper)
+		if kind != "" {
+			record = append(record, kind)
+		}
+		record = append(record, regular, foil, etched)
+		if shouldQty {
+			record = append(record, regularQty, foilQty, etchedQty)
+		}
+		if shouldCond {
+			for _, tag := range BanPriceConditionKeys {
+				var priceStr string
+				price := entry.Conditions[tag]
+				if price != 0 {
+					priceStr = fmt.Sprintf("%0.2f", price)
 				}
+				record = append(record, priceStr)
 			}
+		}
 
-			err = w.Write(record)
-			if err != nil {
-				return err
-			}
+		err := w.Write(record)
+		if err != nil {
+			return err
 		}
-		w.Flush()
 	}
 	return nil
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mtgban/go-mtgban/mtgban"
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+)
+
+// Return the id of the nonfoil printing of a card in the test datastore
+func nonfoilTestId(t *testing.T, name string) string {
+	uuids, err := mtgmatcher.SearchEquals(name)
+	if err != nil {
+		t.Fatalf("FAIL: Card %s not found in the datastore: %s", name, err)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		co, err := mtgmatcher.GetUUID(uuid)
+		if err == nil && !co.Foil && !co.Etched && !co.Sealed {
+			return uuid
+		}
+	}
+	t.Fatalf("FAIL: No nonfoil printing of %s", name)
+	return ""
+}
+
+// Replace the loaded stores with one seller and one vendor for the duration
+// of a test, returning the ids of the cards they carry, sorted
+func setupStreamStores(t *testing.T) []string {
+	oldSellers, oldVendors := Sellers, Vendors
+	t.Cleanup(func() {
+		Sellers, Vendors = oldSellers, oldVendors
+	})
+
+	first := nonfoilTestId(t, "Ragavan, Nimble Pilferer")
+	second := nonfoilTestId(t, "Counterspell")
+
+	inventory := mtgban.InventoryRecord{
+		first: []mtgban.InventoryEntry{
+			{Price: 60, Quantity: 2, Conditions: "NM"},
+			{Price: 50, Quantity: 1, Conditions: "SP"},
+		},
+		second: []mtgban.InventoryEntry{
+			{Price: 1.5, Quantity: 10, Conditions: "NM"},
+		},
+	}
+	buylist := mtgban.BuylistRecord{
+		first: []mtgban.BuylistEntry{
+			{BuyPrice: 40, Quantity: 4, Conditions: "NM"},
+		},
+	}
+	Sellers = []mtgban.Seller{
+		mtgban.NewSellerFromInventory(inventory, mtgban.ScraperInfo{Name: "Test Seller", Shorthand: "TS"}),
+	}
+	Vendors = []mtgban.Vendor{
+		mtgban.NewVendorFromBuylist(buylist, mtgban.ScraperInfo{Name: "Test Vendor", Shorthand: "TV"}),
+	}
+
+	ids := []string{first, second}
+	sort.Strings(ids)
+	return ids
+}
+
+var StreamPriceAPITests = []struct {
+	Name    string
+	Format  string
+	Retail  bool
+	Buylist bool
+	Qty     bool
+	Conds   bool
+
+	// Lines of the output, with ID0 and ID1 standing for the card ids in
+	// order, X, Q and P for their price, quantity and formatted price, and
+	// RAGAVAN for the id of the only card on the buylist
+	Expected []string
+}{
+	{
+		Name:   "ndjson retail",
+		Format: "ndjson",
+		Retail: true,
+		Expected: []string{
+			`{"id":"ID0","kind":"retail","prices":{"TS":{"regular":X0}}}`,
+			`{"id":"ID1","kind":"retail","prices":{"TS":{"regular":X1}}}`,
+		},
+	},
+	{
+		Name:    "ndjson both kinds with quantities",
+		Format:  "ndjson",
+		Retail:  true,
+		Buylist: true,
+		Qty:     true,
+		Expected: []string{
+			`{"id":"ID0","kind":"retail","prices":{"TS":{"regular":X0,"qty":Q0}}}`,
+			`{"id":"ID1","kind":"retail","prices":{"TS":{"regular":X1,"qty":Q1}}}`,
+			`{"id":"RAGAVAN","kind":"buylist","prices":{"TV":{"regular":40,"qty":4}}}`,
+		},
+	},
+	{
+		Name:    "csv buylist",
+		Format:  "csv",
+		Buylist: true,
+		Expected: []string{
+			"UUID,Store,Regular Price,Foil Price,Etched Price",
+			"RAGAVAN,TV,40.00,,",
+		},
+	},
+	{
+		Name:    "csv both kinds",
+		Format:  "csv",
+		Retail:  true,
+		Buylist: true,
+		Expected: []string{
+			"UUID,Store,Kind,Regular Price,Foil Price,Etched Price",
+			"ID0,TS,retail,P0,,",
+			"ID1,TS,retail,P1,,",
+			"RAGAVAN,TV,buylist,40.00,,",
+		},
+	},
+	{
+		Name:   "csv conditions",
+		Format: "csv",
+		Retail: true,
+		Conds:  true,
+	},
+}
+
+func TestStreamPriceAPI(t *testing.T) {
+	ids := setupStreamStores(t)
+	ragavan := nonfoilTestId(t, "Ragavan, Nimble Pilferer")
+
+	// Values depend on which card sorts first
+	replacer := func(line string) string {
+		for i, id := range ids {
+			x, q, p := "1.5", "10", "1.50"
+			if id == ragavan {
+				x, q, p = "60", "3", "60.00"
+			}
+			n := fmt.Sprint(i)
+			line = strings.NewReplacer("ID"+n, id, "X"+n, x, "Q"+n, q, "P"+n, p).Replace(line)
+		}
+		return strings.Replace(line, "RAGAVAN", ragavan, -1)
+	}
+
+	for _, test := range StreamPriceAPITests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			count, err := streamPriceAPI(w, test.Format, test.Retail, test.Buylist, "", []string{"TS", "TV"}, "", nil, "", test.Qty, test.Conds, false)
+			if err != nil {
+				t.Fatalf("FAIL: Unexpected error: %s", err)
+			}
+
+			body := w.Body.String()
+			var lines []string
+			scanner := bufio.NewScanner(strings.NewReader(body))
+			for scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+
+			if test.Expected == nil {
+				// Only check the shape of the conditions columns
+				header := strings.Split(lines[0], ",")
+				if len(header) != 5+len(BanPriceConditionKeys) {
+					t.Fatalf("FAIL: Unexpected header %s", lines[0])
+				}
+				for _, line := range lines[1:] {
+					if len(strings.Split(line, ",")) != len(header) {
+						t.Errorf("FAIL: Expected %d columns in %s", len(header), line)
+					}
+				}
+				if !strings.Contains(body, ",50.00,") {
+					t.Errorf("FAIL: Expected the SP price to be present in %s", body)
+				}
+				return
+			}
+
+			var expected []string
+			for _, line := range test.Expected {
+				expected = append(expected, replacer(line))
+			}
+			if len(lines) != len(expected) {
+				t.Fatalf("FAIL: Expected %d lines, got %d:\n%s", len(expected), len(lines), body)
+			}
+			for i := range lines {
+				if lines[i] != expected[i] {
+					t.Errorf("FAIL: Expected '%s', got '%s'", expected[i], lines[i])
+				}
+			}
+
+			entries := len(expected)
+			if test.Format == "csv" {
+				entries--
+			}
+			if count != entries {
+				t.Errorf("FAIL: Expected %d entries, got %d", entries, count)
+			}
+
+			contentType := "text/csv"
+			if test.Format == "ndjson" {
+				contentType = "application/x-ndjson"
+				for _, line := range lines {
+					var entry PriceAPIEntry
+					err := json.Unmarshal([]byte(line), &entry)
+					if err != nil {
+						t.Errorf("FAIL: Invalid json line %s: %s", line, err)
+					}
+				}
+			}
+			if w.Header().Get("Content-Type") != contentType {
+				t.Errorf("FAIL: Expected content type %s, got %s", contentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestStreamPriceAPIFilters(t *testing.T) {
+	setupStreamStores(t)
+	ragavan := nonfoilTestId(t, "Ragavan, Nimble Pilferer")
+
+	// Stores that are not enabled are skipped
+	w := httptest.NewRecorder()
+	count, err := streamPriceAPI(w, "ndjson", true, true, "", []string{"TV"}, "", nil, "", false, false, false)
+	if err != nil || count != 1 {
+		t.Errorf("FAIL: Expected only the buylist entry, got %d (%v)", count, err)
+	}
+
+	// Filtering by card only returns that card
+	w = httptest.NewRecorder()
+	count, err = streamPriceAPI(w, "ndjson", true, false, "", []string{"TS", "TV"}, "", []string{ragavan}, "", false, false, false)
+	if err != nil || count != 1 || !strings.Contains(w.Body.String(), ragavan) {
+		t.Errorf("FAIL: Expected only the filtered card, got %d (%v)", count, err)
+	}
+
+	_, err = streamPriceAPI(httptest.NewRecorder(), "xml", true, false, "", []string{"TS"}, "", nil, "", false, false, false)
+	if err == nil {
+		t.Errorf("FAIL: Expected an error for an unsupported format")
+	}
+}
+
+func TestForEachPriceId(t *testing.T) {
+	ragavan := nonfoilTestId(t, "Ragavan, Nimble Pilferer")
+	co, _ := mtgmatcher.GetUUID(ragavan)
+
+	for _, mode := range []string{"", "scryfall"} {
+		var ids []string
+		var ragavanGroup []string
+		err := forEachPriceId(mode, "", nil, "", func(id string, cardIds []string) error {
+			ids = append(ids, id)
+			if slices.Contains(cardIds, ragavan) {
+				ragavanGroup = cardIds
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("FAIL: Unexpected error: %s", err)
+		}
+
+		seen := map[string]bool{}
+		for _, id := range ids {
+			// Fixture ids other than uuids may be shared across editions
+			if seen[id] && mode == "" {
+				t.Errorf("FAIL: Id %s was sent twice", id)
+			}
+			seen[id] = true
+		}
+
+		// All the finishes of a card share the same scryfall id
+		expected := 1
+		if mode == "scryfall" {
+			expected = len(matchAllFinishes(ragavan))
+			if !seen[co.Identifiers["scryfallId"]] {
+				t.Errorf("FAIL: Missing scryfall id of %s", co.Name)
+			}
+		}
+		if len(ragavanGroup) != expected {
+			t.Errorf("FAIL: Expected %d ids in the group of mode '%s', got %q", expected, mode, ragavanGroup)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// Maximum number of identifiers accepted in a single batch request
+	MaxBatchIdentifiers = 5000
+
+	// Maximum size of the request body
+	MaxBatchBodySize = 2 << 20
+)
+
+type BatchAPIInput struct {
+	Identifiers []string `json:"identifiers"`
+}
+
+type BatchAPIOutput struct {
+	Error string `json:"error,omitempty"`
+	Meta  struct {
+		Date    time.Time `json:"date"`
+		Version string    `json:"version"`
+		BaseURL string    `json:"base_url"`
+	} `json:"meta"`
+
+	// input > store > price {regular/foil/etched}
+	Retail  map[string]map[string]*BanPrice `json:"retail,omitempty"`
+	Buylist map[string]map[string]*BanPrice `json:"buylist,omitempty"`
+
+	// input > reason why it could not be found
+	Unresolved map[string]string `json:"unresolved,omitempty"`
+}
+
+var ErrBatchNotFound = errors.New("card not found")
+
+// Resolve an identifier to the uuids of all its finishes, it can be a mtgjson
+// or mtgban uuid, a scryfall id, a tcgplayer product id, or a string in the
+// "name|set|number" format, where number is optional
+func resolveBatchIdentifier(input string) ([]string, error) {
+	cardId := strings.TrimSpace(input)
+
+	if strings.Contains(cardId, "|") {
+		fields := strings.Split(cardId, "|")
+		if len(fields) > 3 {
+			return nil, errors.New("too many fields, use name|set|number")
+		}
+		card := &mtgmatcher.Card{
+			Name: strings.TrimSpace(fields[0]),
+		}
+		if len(fields) > 1 {
+			card.Edition = strings.TrimSpace(fields[1])
+			set, err := mtgmatcher.GetSet(card.Edition)
+			if err == nil {
+				card.Edition = set.Name
+			}
+		}
+		if len(fields) > 2 {
+			card.Variation = strings.TrimSpace(fields[2])
+		}
+
+		var err error
+		cardId, err = mtgmatcher.Match(card)
+		var alias *mtgmatcher.AliasingError
+		if errors.As(err, &alias) {
+			return nil, fmt.Errorf("ambiguous card, could be any of %d printings", len(alias.Probe()))
+		} else if err != nil {
+			return nil, ErrBatchNotFound
+		}
+	}
+
+	uuids := matchAllFinishes(cardId)
+	if len(uuids) == 0 {
+		return nil, ErrBatchNotFound
+	}
+	return uuids, nil
+}
+
+// Merge all the prices set in src into dst
+func mergeBanPrice(dst, src *BanPrice) {
+	if src.Regular != 0 {
+		dst.Regular = src.Regular
+	}
+	if src.Foil != 0 {
+		dst.Foil = src.Foil
+	}
+	if src.Etched != 0 {
+		dst.Etched = src.Etched
+	}
+	dst.Qty += src.Qty
+	dst.QtyFoil += src.QtyFoil
+	dst.QtyEtched += src.QtyEtched
+	for tag, price := range src.Conditions {
+		if dst.Conditions == nil {
+			dst.Conditions = map[string]float64{}
+		}
+		dst.Conditions[tag] = price
+	}
+}
+
+// Rebuild the price map using the input identifiers as keys
+func groupPricesByInput(prices map[string]map[string]*BanPrice, inputs map[string][]string) map[string]map[string]*BanPrice {
+	out := map[string]map[string]*BanPrice{}
+	for input, uuids := range inputs {
+		for _, uuid := range uuids {
+			for store, price := range prices[uuid] {
+				if out[input] == nil {
+					out[input] = map[string]*BanPrice{}
+				}
+				if out[input][store] == nil {
+					out[input][store] = &BanPrice{}
+				}
+				mergeBanPrice(out[input][store], price)
+			}
+		}
+	}
+	return out
+}
+
+func BatchPriceAPI(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+	out := BatchAPIOutput{}
+	out.Meta.Date = time.Now()
+	out.Meta.Version = APIVersion
+	out.Meta.BaseURL = getBaseURL(r) + "/go/"
+
+	if r.Method != http.MethodPost {
+		out.Error = "Method not allowed"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	urlPath := strings.TrimPrefix(r.URL.Path, "/api/mtgban/batch/")
+	if path.Ext(urlPath) != ".json" {
+		out.Error = "Not found"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+	kind := strings.TrimSuffix(urlPath, ".json")
+
+	var input BatchAPIInput
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBatchBodySize)).Decode(&input)
+	if err != nil {
+		out.Error = "Invalid request"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+	if len(input.Identifiers) == 0 {
+		out.Error = "No identifiers"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+	if len(input.Identifiers) > MaxBatchIdentifiers {
+		out.Error = fmt.Sprintf("Too many identifiers, maximum is %d", MaxBatchIdentifiers)
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	// Options are read from the URL only, the body is reserved to the input
+	query := r.URL.Query()
+	enabledStores := getAPIEnabledStores(sig)
+	qty, _ := strconv.ParseBool(query.Get("qty"))
+	conds, _ := strconv.ParseBool(query.Get("conds"))
+	filterByFinish := query.Get("finish")
+
+	// Filter by user preference, as long as it's listed in the enebled stores
+	filterByVendor := query.Get("vendor")
+	if slices.Contains(enabledStores, filterByVendor) {
+		enabledStores = []string{filterByVendor}
+	}
+
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+	doRetail := (kind == "retail" || kind == "all") && canRetail
+	doBuylist := (kind == "buylist" || kind == "all") && canBuylist
+	if !doRetail && !doBuylist {
+		out.Error = "Not found"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	start := time.Now()
+
+	inputs := map[string][]string{}
+	seen := map[string]bool{}
+	var allUUIDs []string
+	for _, identifier := range input.Identifiers {
+		_, found := inputs[identifier]
+		if found {
+			continue
+		}
+		uuids, err := resolveBatchIdentifier(identifier)
+		if err != nil {
+			if out.Unresolved == nil {
+				out.Unresolved = map[string]string{}
+			}
+			out.Unresolved[identifier] = err.Error()
+			continue
+		}
+		inputs[identifier] = uuids
+		for _, uuid := range uuids {
+			if !seen[uuid] {
+				seen[uuid] = true
+				allUUIDs = append(allUUIDs, uuid)
+			}
+		}
+	}
+
+	var cards int
+	if len(allUUIDs) > 0 {
+		if doRetail {
+			prices := getSellerPrices("", enabledStores, "", allUUIDs, filterByFinish, qty, conds)
+			out.Retail = groupPricesByInput(prices, inputs)
+			cards += len(prices)
+		}
+		if doBuylist {
+			prices := getVendorPrices("", enabledStores, "", allUUIDs, filterByFinish, qty, conds)
+			out.Buylist = groupPricesByInput(prices, inputs)
+			cards += len(prices)
+		}
+	}
+	addUsageCards(r, cards)
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("[%v] %s requested a '%s' API batch for %d cards (%d unresolved)", time.Since(start), user, kind, len(input.Identifiers), len(out.Unresolved))
+	event := newAuditEvent(sig, "api", "BatchAPI", start)
+	event.Query = kind
+	event.Stores = enabledStores
+	event.Rows = cards
+	event.Message = msg
+	recordAudit(event)
+
+	json.NewEncoder(w).Encode(&out)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// Responses larger than this are only validated, never stored
+	MaxAPICacheBodySize = 64 << 20
+
+	// Maximum amount of memory used by all the cached responses
+	MaxAPICacheTotalSize = 512 << 20
+)
+
+type cachedResponse struct {
+	ETag        string
+	ContentType string
+	Body        []byte
+	Created     time.Time
+
+	// Number of cards in the body, accounted on every hit
+	Rows int
+}
+
+var apiCacheMutex sync.RWMutex
+var apiCache = map[string]*cachedResponse{}
+var apiCacheSize int
+
+// Build a key representing the request, ignoring the signature, since the
+// same output can be requested by different users with the same permissions
+func getAPICacheKey(r *http.Request, extra ...string) string {
+	q := r.URL.Query()
+	q.Del("sig")
+	return r.URL.Path + "?" + q.Encode() + "|" + strings.Join(extra, "|")
+}
+
+// Return the most recent update time among the enabled stores
+func getStoresLastModified(enabledStores []string, retail, buylist bool) time.Time {
+	var lastModified time.Time
+	if retail {
+		for _, seller := range Sellers {
+			if seller == nil || !slices.Contains(enabledStores, seller.Info().Shorthand) {
+				continue
+			}
+			ts := seller.Info().InventoryTimestamp
+			if ts != nil && ts.After(lastModified) {
+				lastModified = *ts
+			}
+		}
+	}
+	if buylist {
+		for _, vendor := range Vendors {
+			if vendor == nil || !slices.Contains(enabledStores, vendor.Info().Shorthand) {
+				continue
+			}
+			ts := vendor.Info().BuylistTimestamp
+			if ts != nil && ts.After(lastModified) {
+				lastModified = *ts
+			}
+		}
+	}
+	return lastModified
+}
+
+// Set the validation headers, and reply with 304 or a previously cached body
+// when possible. Return the ETag, the number of cards that were sent from the
+// cache, and whether the request was fully handled.
+// Without a timestamp there is no way to tell when data changes, so nothing
+// is validated nor cached.
+func checkAPICache(w http.ResponseWriter, r *http.Request, key string, lastModified time.Time) (string, int, bool) {
+	if lastModified.IsZero() {
+		return "", 0, false
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(fmt.Sprint(key, lastModified.UnixNano()))))
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+
+	if isNotModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return etag, 0, true
+	}
+
+	apiCacheMutex.RLock()
+	entry, found := apiCache[key]
+	apiCacheMutex.RUnlock()
+	if found && entry.ETag == etag {
+		w.Header().Set("Content-Type", entry.ContentType)
+		w.Write(entry.Body)
+		return etag, entry.Rows, true
+	}
+
+	return etag, 0, false
+}
+
+func isNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	// If-None-Match has precedence over If-Modified-Since
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(t)
+}
+
+// A ResponseWriter that keeps a copy of the body, so that it can be stored
+// once the response is known to be valid
+// Streamed formats should not use this, or their memory usage would not be
+// flat anymore.
+type apiCacheWriter struct {
+	http.ResponseWriter
+	key      string
+	etag     string
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func newAPICacheWriter(w http.ResponseWriter, key, etag string) *apiCacheWriter {
+	return &apiCacheWriter{
+		ResponseWriter: w,
+		key:            key,
+		etag:           etag,
+	}
+}
+
+func (cw *apiCacheWriter) Write(data []byte) (int, error) {
+	if !cw.overflow && cw.etag != "" {
+		if cw.buf.Len()+len(data) > MaxAPICacheBodySize {
+			cw.overflow = true
+			cw.buf = bytes.Buffer{}
+		} else {
+			cw.buf.Write(data)
+		}
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+func (cw *apiCacheWriter) Flush() {
+	flusher, ok := cw.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// Store the response body and the number of cards it contains, evicting
+// the oldest entries if needed
+func (cw *apiCacheWriter) Save(rows int) {
+	if cw.overflow || cw.etag == "" || cw.buf.Len() == 0 {
+		return
+	}
+
+	entry := &cachedResponse{
+		ETag:        cw.etag,
+		ContentType: cw.Header().Get("Content-Type"),
+		Body:        cw.buf.Bytes(),
+		Created:     time.Now(),
+		Rows:        rows,
+	}
+
+	apiCacheMutex.Lock()
+	defer apiCacheMutex.Unlock()
+
+	old, found := apiCache[cw.key]
+	if found {
+		apiCacheSize -= len(old.Body)
+	}
+	apiCache[cw.key] = entry
+	apiCacheSize += len(entry.Body)
+
+	for apiCacheSize > MaxAPICacheTotalSize {
+		var oldestKey string
+		var oldest time.Time
+		for key, entry := range apiCache {
+			if oldestKey == "" || entry.Created.Before(oldest) {
+				oldestKey = key
+				oldest = entry.Created
+			}
+		}
+		apiCacheSize -= len(apiCache[oldestKey].Body)
+		delete(apiCache, oldestKey)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtgban/go-mtgban/mtgban"
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// How long a batch of changes is kept in memory
+	MaxChangesAge = 48 * time.Hour
+
+	// Maximum number of changes kept in memory, older batches are dropped
+	// first even if they are more recent than MaxChangesAge
+	MaxChangesEntries = 2000000
+
+	// Maximum number of changes returned in a single response, more can
+	// be retrieved by using the returned cursor
+	MaxChangesPerResponse = 50000
+)
+
+type PriceChange struct {
+	Timestamp time.Time `json:"timestamp"`
+	UUID      string    `json:"uuid"`
+	Store     string    `json:"store"`
+	Kind      string    `json:"kind"`
+	Finish    string    `json:"finish"`
+	// One of "added", "changed", "removed"
+	Status string    `json:"status"`
+	Before *BanPrice `json:"before,omitempty"`
+	After  *BanPrice `json:"after,omitempty"`
+}
+
+type ChangesAPIOutput struct {
+	Error string `json:"error,omitempty"`
+	Meta  struct {
+		Date    time.Time `json:"date"`
+		Version string    `json:"version"`
+		Cursor  string    `json:"cursor"`
+		HasMore bool      `json:"has_more"`
+	} `json:"meta"`
+
+	Changes []PriceChange `json:"changes"`
+}
+
+// All the changes found for a single store refresh
+type changesBatch struct {
+	Seq       uint64
+	Timestamp time.Time
+	Store     string
+	Kind      string
+	Changes   []PriceChange
+}
+
+var changesMutex sync.RWMutex
+var changesLog []changesBatch
+var changesSeq uint64
+
+// Total number of changes in changesLog
+var changesCount int
+
+// Any timestamp before this point may have missing changes
+var changesHorizon = time.Now()
+
+// Cursors are only valid for the current run
+var changesEpoch = time.Now().Unix()
+
+var ErrChangesTooOld = errors.New("requested changes are too old, download a full dump instead")
+
+func recordSellerChanges(info mtgban.ScraperInfo, oldInventory, newInventory mtgban.InventoryRecord) {
+	if info.SealedMode {
+		return
+	}
+
+	shouldQty := !info.MetadataOnly && info.Shorthand != "TCG Player" && info.Shorthand != "TCG Direct"
+	inventory2prices := func(inventory mtgban.InventoryRecord) map[string]*BanPrice {
+		out := map[string]*BanPrice{}
+		for cardId, entries := range inventory {
+			if len(entries) == 0 || entries[0].Price == 0 {
+				continue
+			}
+			co, err := mtgmatcher.GetUUID(cardId)
+			if err != nil {
+				continue
+			}
+			out[cardId] = &BanPrice{}
+			addSellerPrice(out[cardId], co, entries, shouldQty, true)
+		}
+		return out
+	}
+
+	recordPriceChanges(info.Shorthand, "retail", inventory2prices(oldInventory), inventory2prices(newInventory))
+}
+
+func recordVendorChanges(info mtgban.ScraperInfo, oldBuylist, newBuylist mtgban.BuylistRecord) {
+	if info.SealedMode {
+		return
+	}
+
+	shouldQty := !info.MetadataOnly
+	buylist2prices := func(buylist mtgban.BuylistRecord) map[string]*BanPrice {
+		out := map[string]*BanPrice{}
+		for cardId, entries := range buylist {
+			if len(entries) == 0 || entries[0].BuyPrice == 0 {
+				continue
+			}
+			co, err := mtgmatcher.GetUUID(cardId)
+			if err != nil {
+				continue
+			}
+			out[cardId] = &BanPrice{}
+			addVendorPrice(out[cardId], co, entries, shouldQty, true)
+		}
+		return out
+	}
+
+	recordPriceChanges(info.Shorthand, "buylist", buylist2prices(oldBuylist), buylist2prices(newBuylist))
+}
+
+func recordPriceChanges(store, kind string, before, after map[string]*BanPrice) {
+	var changes []PriceChange
+	for cardId, price := range after {
+		status := "added"
+		oldPrice, found := before[cardId]
+		if found {
+			if reflect.DeepEqual(oldPrice, price) {
+				continue
+			}
+			status = "changed"
+		}
+		changes = append(changes, PriceChange{
+			UUID:   cardId,
+			Store:  store,
+			Kind:   kind,
+			Finish: uuid2finish(cardId),
+			Status: status,
+			Before: oldPrice,
+			After:  price,
+		})
+	}
+	for cardId, oldPrice := range before {
+		_, found := after[cardId]
+		if found {
+			continue
+		}
+		changes = append(changes, PriceChange{
+			UUID:   cardId,
+			Store:  store,
+			Kind:   kind,
+			Finish: uuid2finish(cardId),
+			Status: "removed",
+			Before: oldPrice,
+		})
+	}
+
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+
+	// Diffs run in the background, so use the time they are added to the
+	// log to keep batches in order
+	now := time.Now()
+	for i := range changes {
+		changes[i].Timestamp = now
+	}
+
+	// Drop anything that is too old, or that would make the log too large
+	var i int
+	for i = 0; i < len(changesLog); i++ {
+		if time.Since(changesLog[i].Timestamp) < MaxChangesAge &&
+			changesCount+len(changes) <= MaxChangesEntries {
+			break
+		}
+		changesHorizon = changesLog[i].Timestamp
+		changesCount -= len(changesLog[i].Changes)
+	}
+	changesLog = changesLog[i:]
+
+	changesSeq++
+	changesCount += len(changes)
+	changesLog = append(changesLog, changesBatch{
+		Seq:       changesSeq,
+		Timestamp: now,
+		Store:     store,
+		Kind:      kind,
+		Changes:   changes,
+	})
+}
+
+func uuid2finish(cardId string) string {
+	co, err := mtgmatcher.GetUUID(cardId)
+	if err != nil {
+		return ""
+	}
+	if co.Etched {
+		return "etched"
+	} else if co.Foil {
+		return "foil"
+	}
+	return "nonfoil"
+}
+
+func formatChangesCursor(seq uint64) string {
+	return fmt.Sprintf("%d-%d", changesEpoch, seq)
+}
+
+func parseChangesCursor(cursor string) (uint64, error) {
+	epoch, seq, found := strings.Cut(cursor, "-")
+	if !found || epoch != fmt.Sprint(changesEpoch) {
+		return 0, ErrChangesTooOld
+	}
+	return strconv.ParseUint(seq, 10, 64)
+}
+
+func parseChangesSince(since string) (time.Time, error) {
+	ts, err := strconv.ParseInt(since, 10, 64)
+	if err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, since)
+}
+
+func ChangesAPI(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+	out := ChangesAPIOutput{}
+	out.Meta.Date = time.Now()
+	out.Meta.Version = APIVersion
+	out.Changes = []PriceChange{}
+
+	enabledStores := getAPIEnabledStores(sig)
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+
+	changesMutex.RLock()
+	defer changesMutex.RUnlock()
+
+	var since time.Time
+	var lastSeq uint64
+	var err error
+	cursor := r.FormValue("cursor")
+	sinceOpt := r.FormValue("since")
+	switch {
+	case cursor != "":
+		lastSeq, err = parseChangesCursor(cursor)
+		if err == nil && len(changesLog) > 0 && lastSeq+1 < changesLog[0].Seq {
+			err = ErrChangesTooOld
+		}
+	case sinceOpt != "":
+		since, err = parseChangesSince(sinceOpt)
+		if err == nil && since.Before(changesHorizon) {
+			err = ErrChangesTooOld
+		}
+	default:
+		err = errors.New("missing since or cursor parameter")
+	}
+	if err != nil {
+		out.Error = err.Error()
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	lastSeen := lastSeq
+	for _, batch := range changesLog {
+		if batch.Seq <= lastSeq || !batch.Timestamp.After(since) {
+			continue
+		}
+		if len(out.Changes) > 0 && len(out.Changes)+len(batch.Changes) > MaxChangesPerResponse {
+			out.Meta.HasMore = true
+			break
+		}
+		lastSeen = batch.Seq
+
+		if !slices.Contains(enabledStores, batch.Store) ||
+			(batch.Kind == "retail" && !canRetail) ||
+			(batch.Kind == "buylist" && !canBuylist) {
+			continue
+		}
+		out.Changes = append(out.Changes, batch.Changes...)
+	}
+
+	// Return the current position when everything was sent, so that
+	// the cursor stays valid even if there are no changes
+	if !out.Meta.HasMore {
+		lastSeen = changesSeq
+	}
+	out.Meta.Cursor = formatChangesCursor(lastSeen)
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("%s requested %d API changes (since '%s', cursor '%s')", user, len(out.Changes), sinceOpt, cursor)
+	event := newAuditEvent(sig, "api", "ChangesAPI", time.Time{})
+	event.Query = sinceOpt
+	event.Stores = enabledStores
+	event.Rows = len(out.Changes)
+	event.Message = msg
+	recordAudit(event)
+
+	json.NewEncoder(w).Encode(&out)
+}
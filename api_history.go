@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+	"golang.org/x/exp/slices"
+)
+
+type HistorySeries struct {
+	Name  string `json:"name"`
+	Store string `json:"store"`
+	Kind  string `json:"kind"`
+
+	// Aligned with the output labels, missing points are null
+	Data []*float64 `json:"data"`
+}
+
+type HistoryAPIOutput struct {
+	Error string `json:"error,omitempty"`
+	Meta  struct {
+		Date    time.Time `json:"date"`
+		Version string    `json:"version"`
+	} `json:"meta"`
+
+	UUID   string          `json:"uuid,omitempty"`
+	Labels []string        `json:"labels,omitempty"`
+	Series []HistorySeries `json:"series,omitempty"`
+}
+
+// Return the shorthand of the store a dataset belongs to, as used by the
+// rest of the API, or an empty string if the store is not loaded
+func datasetShorthand(config scraperConfig) string {
+	// Some datasets are named after the store itself
+	if ScraperMap[config.KindName] == config.ScraperName {
+		return config.KindName
+	}
+	if config.KindName == "buylist" {
+		for _, vendor := range Vendors {
+			if vendor != nil && ScraperMap[vendor.Info().Shorthand] == config.ScraperName {
+				return vendor.Info().Shorthand
+			}
+		}
+		return ""
+	}
+	for _, seller := range Sellers {
+		if seller != nil && ScraperMap[seller.Info().Shorthand] == config.ScraperName {
+			return seller.Info().Shorthand
+		}
+	}
+	return ""
+}
+
+// Check whether a dataset is accessible with the given permissions
+func canAccessDataset(config scraperConfig, shorthand string, enabledStores []string, canRetail, canBuylist bool) bool {
+	if config.KindName == "buylist" && !canBuylist {
+		return false
+	} else if config.KindName != "buylist" && !canRetail {
+		return false
+	}
+	return shorthand != "" && slices.Contains(enabledStores, shorthand)
+}
+
+func HistoryAPI(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+	out := HistoryAPIOutput{}
+	out.Meta.Date = time.Now()
+	out.Meta.Version = APIVersion
+
+	urlPath := strings.TrimPrefix(r.URL.Path, "/api/mtgban/history/")
+	ext := path.Ext(urlPath)
+	if ext != ".json" && ext != ".csv" {
+		out.Error = "Not found"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	// Accept any id supported by the matcher, defaulting to nonfoil
+	base := strings.TrimSuffix(urlPath, ext)
+	co, err := mtgmatcher.GetUUID(base)
+	if err != nil {
+		cardId, err := mtgmatcher.MatchId(base)
+		if err == nil {
+			co, err = mtgmatcher.GetUUID(cardId)
+		}
+		if err != nil {
+			out.Error = "Not found"
+			json.NewEncoder(w).Encode(&out)
+			return
+		}
+	}
+	out.UUID = co.UUID
+
+	// Validate the date range
+	from := r.FormValue("from")
+	to := r.FormValue("to")
+	for _, date := range []string{from, to} {
+		if date == "" {
+			continue
+		}
+		_, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			out.Error = "Invalid date, use the YYYY-MM-DD format"
+			json.NewEncoder(w).Encode(&out)
+			return
+		}
+	}
+
+	var storeFilters, kindFilters []string
+	if r.FormValue("store") != "" {
+		storeFilters = strings.Split(r.FormValue("store"), ",")
+	}
+	if r.FormValue("kind") != "" {
+		kindFilters = strings.Split(r.FormValue("kind"), ",")
+	}
+
+	enabledStores := getAPIEnabledStores(sig)
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+
+	start := time.Now()
+
+	labels, err := getDateAxisValues(co.UUID)
+	if err != nil {
+		out.Error = "No data available"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	// Keep only the requested dates, labels are sorted so string comparison is enough
+	var filteredLabels []string
+	for _, label := range labels {
+		if (from != "" && label < from) || (to != "" && label > to) {
+			continue
+		}
+		filteredLabels = append(filteredLabels, label)
+	}
+	out.Labels = filteredLabels
+
+	for _, config := range enabledDatasets {
+		if co.Sealed && !config.HasSealed {
+			continue
+		}
+		if !co.Sealed && config.OnlySealed {
+			continue
+		}
+		shorthand := datasetShorthand(config)
+		if storeFilters != nil && !slices.Contains(storeFilters, shorthand) {
+			continue
+		}
+		if kindFilters != nil && !slices.Contains(kindFilters, config.KindName) {
+			continue
+		}
+		if !canAccessDataset(config, shorthand, enabledStores, canRetail, canBuylist) {
+			continue
+		}
+
+		results, err := getDatasetValues(co.UUID, config)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		series := HistorySeries{
+			Name:  config.PublicName,
+			Store: shorthand,
+			Kind:  config.KindName,
+			Data:  make([]*float64, len(filteredLabels)),
+		}
+		for i, label := range filteredLabels {
+			price, err := strconv.ParseFloat(results[label], 64)
+			if err != nil {
+				continue
+			}
+			series.Data[i] = &price
+		}
+		out.Series = append(out.Series, series)
+	}
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("[%v] %s requested price history for %s (%d series from '%s' to '%s')", time.Since(start), user, co.UUID, len(out.Series), from, to)
+	event := newAuditEvent(sig, "api", "HistoryAPI", start)
+	event.Query = co.UUID
+	event.Stores = enabledStores
+	event.Rows = len(out.Series)
+	event.Message = msg
+	recordAudit(event)
+
+	if out.Series == nil {
+		out.Error = "Not found"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	if ext == ".json" {
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	err = History2CSV(csv.NewWriter(w), out.Labels, out.Series)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func History2CSV(w *csv.Writer, labels []string, series []HistorySeries) error {
+	header := []string{"Date"}
+	for _, entry := range series {
+		header = append(header, entry.Name)
+	}
+	err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for i, label := range labels {
+		record := []string{label}
+		for _, entry := range series {
+			var priceStr string
+			if entry.Data[i] != nil {
+				priceStr = fmt.Sprintf("%0.2f", *entry.Data[i])
+			}
+			record = append(record, priceStr)
+		}
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
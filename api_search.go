@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Maximum number of cards that can be paginated through for signatures
+// that do not specify their own SearchAPILimit
+const MaxSearchAPIResults = 1000
+
+type SearchAPIOutput struct {
+	Error string `json:"error,omitempty"`
+	Meta  struct {
+		Date       time.Time `json:"date"`
+		Version    string    `json:"version"`
+		Query      string    `json:"query"`
+		Page       int       `json:"page"`
+		TotalPages int       `json:"total_pages"`
+		Total      int       `json:"total"`
+		Limit      int       `json:"limit"`
+		Truncated  bool      `json:"truncated,omitempty"`
+	} `json:"meta"`
+
+	// Sorted list of the cards returned in this page
+	Keys []string `json:"keys"`
+
+	// uuid > conditions > entries
+	Retail  map[string]map[string][]SearchEntry `json:"retail,omitempty"`
+	Buylist map[string]map[string][]SearchEntry `json:"buylist,omitempty"`
+
+	Metadata map[string]GenericCard `json:"metadata,omitempty"`
+}
+
+// Return how many cards a signature can paginate through
+func getSearchAPILimit(sig string) int {
+	limit, err := strconv.Atoi(GetParamFromSig(sig, "SearchAPILimit"))
+	if err == nil && limit > 0 {
+		return limit
+	}
+	if GetParamFromSig(sig, "API") == "ALL_ACCESS" || (DevMode && !SigCheck) {
+		return MaxSearchAPIResults
+	}
+	return MaxSearchResults
+}
+
+func SearchAPI(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+	out := SearchAPIOutput{}
+	out.Meta.Date = time.Now()
+	out.Meta.Version = APIVersion
+
+	query := r.FormValue("q")
+	out.Meta.Query = query
+	if query == "" {
+		out.Error = "Missing query"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+	if len(query) > MaxSearchQueryLen {
+		out.Error = TooLongMessage
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	blocklistRetail, blocklistBuylist := getDefaultBlocklists(sig)
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+
+	enabledStores := getAPIEnabledStores(sig)
+
+	config := parseSearchOptionsNG(query, blocklistRetail, blocklistBuylist)
+	sealed, _ := strconv.ParseBool(r.FormValue("sealed"))
+	if sealed {
+		config.SearchMode = "sealed"
+	}
+	config.SkipRetail = config.SkipRetail || !canRetail
+	config.SkipBuylist = config.SkipBuylist || !canBuylist
+	if len(enabledStores) == 0 || (config.SkipRetail && config.SkipBuylist) {
+		out.Error = "Not allowed"
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	// Only show the stores the key has access to, same as PriceAPI, right
+	// after the blocklists for performance
+	allowlist := FilterStoreElem{
+		Name:   "store",
+		Values: fixupStoreCodeNG(strings.Join(enabledStores, ",")),
+	}
+	var blocklists int
+	if blocklistRetail != nil {
+		blocklists++
+	}
+	if blocklistBuylist != nil {
+		blocklists++
+	}
+	config.StoreFilters = slices.Insert(config.StoreFilters, blocklists, allowlist)
+
+	start := time.Now()
+
+	allKeys, err := searchAndFilter(config)
+	if err != nil {
+		out.Error = NoCardsMessage
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	// Sort before capping, so that the same subset is always returned
+	switch config.SortMode {
+	case "alpha":
+		sort.Slice(allKeys, func(i, j int) bool {
+			return sortSetsAlphabetical(allKeys[i], allKeys[j])
+		})
+	case "retail":
+		sort.Slice(allKeys, func(i, j int) bool {
+			return sortSetsByRetail(allKeys[i], allKeys[j], defaultSellerPriorityOpt)
+		})
+	case "buylist":
+		sort.Slice(allKeys, func(i, j int) bool {
+			return sortSetsByBuylist(allKeys[i], allKeys[j], defaultVendorPriorityOpt)
+		})
+	default:
+		sort.Slice(allKeys, func(i, j int) bool {
+			return sortSets(allKeys[i], allKeys[j])
+		})
+	}
+
+	limit := getSearchAPILimit(sig)
+	out.Meta.Limit = limit
+	if len(allKeys) > limit {
+		allKeys = allKeys[:limit]
+		out.Meta.Truncated = true
+	}
+
+	foundSellers, foundVendors := searchParallelNG(allKeys, config)
+
+	// Drop cards without any price, same as the Search page
+	if config.SkipEmptyBuylist || config.SkipEmptyRetail {
+		var filteredKeys []string
+		for _, cardId := range allKeys {
+			if config.SkipEmptyBuylist && len(foundVendors[cardId]) == 0 {
+				continue
+			}
+			if config.SkipEmptyRetail && (len(foundSellers[cardId]) == 0 ||
+				(len(foundSellers[cardId]) == 1 && len(foundSellers[cardId]["INDEX"]) != 0)) {
+				continue
+			}
+			filteredKeys = append(filteredKeys, cardId)
+		}
+		allKeys = filteredKeys
+	}
+
+	out.Meta.Total = len(allKeys)
+	out.Meta.TotalPages = (len(allKeys) + MaxSearchResults - 1) / MaxSearchResults
+
+	pageIndex, _ := strconv.Atoi(r.FormValue("p"))
+	if pageIndex <= 1 {
+		pageIndex = 1
+	} else if pageIndex > out.Meta.TotalPages && out.Meta.TotalPages > 0 {
+		pageIndex = out.Meta.TotalPages
+	}
+	out.Meta.Page = pageIndex
+
+	head := MaxSearchResults * (pageIndex - 1)
+	tail := MaxSearchResults * pageIndex
+	if head > len(allKeys) {
+		head = len(allKeys)
+	}
+	if tail > len(allKeys) {
+		tail = len(allKeys)
+	}
+	allKeys = allKeys[head:tail]
+
+	out.Keys = allKeys
+	out.Metadata = map[string]GenericCard{}
+	for _, cardId := range allKeys {
+		out.Metadata[cardId] = uuid2card(cardId, false, true)
+		if len(foundSellers[cardId]) != 0 {
+			if out.Retail == nil {
+				out.Retail = map[string]map[string][]SearchEntry{}
+			}
+			out.Retail[cardId] = foundSellers[cardId]
+		}
+		if len(foundVendors[cardId]) != 0 {
+			if out.Buylist == nil {
+				out.Buylist = map[string]map[string][]SearchEntry{}
+			}
+			out.Buylist[cardId] = foundVendors[cardId]
+		}
+	}
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("[%v] %s requested search API for [%s] (%d results, page %d)", time.Since(start), user, query, out.Meta.Total, pageIndex)
+	event := newAuditEvent(sig, "api", "SearchAPI", start)
+	event.Query = query
+	event.Stores = enabledStores
+	event.Rows = len(out.Keys)
+	event.Message = msg
+	recordAudit(event)
+
+	addUsageCards(r, len(out.Keys))
+	json.NewEncoder(w).Encode(&out)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// The currency each store lists prices in, before they are converted to USD
+var Country2currency = map[string]string{
+	"EU": "EUR",
+	"JP": "JPY",
+}
+
+type StoreAPIEntry struct {
+	Shorthand string `json:"shorthand"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+
+	Sealed       bool `json:"sealed"`
+	MetadataOnly bool `json:"metadata_only"`
+	NoQuantity   bool `json:"no_quantity,omitempty"`
+	NoCredit     bool `json:"no_credit,omitempty"`
+
+	Country string `json:"country,omitempty"`
+
+	// Native currency of the store, all prices are in USD regardless
+	Currency string `json:"currency"`
+
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+	Cards      int        `json:"cards"`
+	Entries    int        `json:"entries"`
+	Refreshing bool       `json:"refreshing"`
+}
+
+type StoresAPIOutput struct {
+	Error string `json:"error,omitempty"`
+	Meta  struct {
+		Date       time.Time `json:"date"`
+		Version    string    `json:"version"`
+		LastUpdate string    `json:"last_update"`
+	} `json:"meta"`
+
+	Retail  []StoreAPIEntry `json:"retail,omitempty"`
+	Buylist []StoreAPIEntry `json:"buylist,omitempty"`
+}
+
+func isScraperBusy(shorthand string) bool {
+	opts, found := ScraperOptions[ScraperMap[shorthand]]
+	return found && opts.Busy
+}
+
+func StoresAPI(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+	out := StoresAPIOutput{}
+	out.Meta.Date = time.Now()
+	out.Meta.Version = APIVersion
+	out.Meta.LastUpdate = LastUpdate
+
+	enabledStores := getAPIEnabledStores(sig)
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+
+	for _, seller := range Sellers {
+		if !canRetail {
+			break
+		}
+		if seller == nil || !slices.Contains(enabledStores, seller.Info().Shorthand) {
+			continue
+		}
+		info := seller.Info()
+
+		entry := StoreAPIEntry{
+			Shorthand:    info.Shorthand,
+			Name:         ScraperNames[info.Shorthand],
+			Kind:         "retail",
+			Sealed:       info.SealedMode,
+			MetadataOnly: info.MetadataOnly,
+			NoQuantity:   info.NoQuantityInventory,
+			Country:      info.CountryFlag,
+			Currency:     "USD",
+			LastUpdate:   info.InventoryTimestamp,
+			Refreshing:   isScraperBusy(info.Shorthand),
+		}
+		if entry.Name == "" {
+			entry.Name = info.Name
+		}
+		currency, found := Country2currency[info.CountryFlag]
+		if found {
+			entry.Currency = currency
+		}
+
+		inventory, _ := seller.Inventory()
+		entry.Cards = len(inventory)
+		for _, entries := range inventory {
+			entry.Entries += len(entries)
+		}
+
+		out.Retail = append(out.Retail, entry)
+	}
+
+	for _, vendor := range Vendors {
+		if !canBuylist {
+			break
+		}
+		if vendor == nil || !slices.Contains(enabledStores, vendor.Info().Shorthand) {
+			continue
+		}
+		info := vendor.Info()
+
+		entry := StoreAPIEntry{
+			Shorthand:    info.Shorthand,
+			Name:         ScraperNames[info.Shorthand],
+			Kind:         "buylist",
+			Sealed:       info.SealedMode,
+			MetadataOnly: info.MetadataOnly,
+			NoCredit:     info.NoCredit,
+			Country:      info.CountryFlag,
+			Currency:     "USD",
+			LastUpdate:   info.BuylistTimestamp,
+			Refreshing:   isScraperBusy(info.Shorthand),
+		}
+		if entry.Name == "" {
+			entry.Name = info.Name
+		}
+		currency, found := Country2currency[info.CountryFlag]
+		if found {
+			entry.Currency = currency
+		}
+
+		buylist, _ := vendor.Buylist()
+		entry.Cards = len(buylist)
+		for _, entries := range buylist {
+			entry.Entries += len(entries)
+		}
+
+		out.Buylist = append(out.Buylist, entry)
+	}
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("%s requested the store list (%d retail, %d buylist)", user, len(out.Retail), len(out.Buylist))
+	event := newAuditEvent(sig, "api", "StoresAPI", time.Time{})
+	event.Stores = enabledStores
+	event.Rows = len(out.Retail) + len(out.Buylist)
+	event.Message = msg
+	recordAudit(event)
+
+	json.NewEncoder(w).Encode(&out)
+}
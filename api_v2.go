@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	APIv2Version = "2"
+
+	APIv2DocsPath = "/api/v2/openapi.json"
+	APIv2DocsFile = "docs/openapi.json"
+)
+
+// Stable error codes, clients can rely on these instead of the message
+const (
+	APIv2ErrMissingSignature = "missing_signature"
+	APIv2ErrInvalidSignature = "invalid_signature"
+	APIv2ErrExpiredSignature = "expired_signature"
+	APIv2ErrRevokedKey       = "revoked_key"
+	APIv2ErrForbidden        = "forbidden"
+	APIv2ErrNotFound         = "not_found"
+	APIv2ErrInvalidParameter = "invalid_parameter"
+	APIv2ErrRateLimited      = "rate_limited"
+	APIv2ErrUnavailable      = "unavailable"
+	APIv2ErrInternal         = "internal_error"
+)
+
+type APIv2Error struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Request struct {
+			Method string     `json:"method"`
+			Path   string     `json:"path"`
+			Params url.Values `json:"params,omitempty"`
+		} `json:"request"`
+		Docs string `json:"docs"`
+	} `json:"error"`
+}
+
+func writeAPIv2Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	var out APIv2Error
+	out.Error.Status = status
+	out.Error.Code = code
+	out.Error.Message = message
+	out.Error.Request.Method = r.Method
+	out.Error.Request.Path = r.URL.Path
+	// Never echo back the signature
+	params := r.URL.Query()
+	params.Del("sig")
+	if len(params) > 0 {
+		out.Error.Request.Params = params
+	}
+	out.Error.Docs = getBaseURL(r) + APIv2DocsPath
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&out)
+}
+
+func OpenAPIv2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, APIv2DocsFile)
+}
+
+func NotFoundAPIv2(w http.ResponseWriter, r *http.Request) {
+	writeAPIv2Error(w, r, http.StatusNotFound, APIv2ErrNotFound, "unknown endpoint")
+}
+
+func PriceAPIv2(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+
+	urlPath := strings.TrimPrefix(r.URL.Path, "/api/v2/prices/")
+	ext := path.Ext(urlPath)
+	format := strings.TrimPrefix(ext, ".")
+	if !slices.Contains([]string{"json", "ndjson", "csv"}, format) {
+		writeAPIv2Error(w, r, http.StatusNotFound, APIv2ErrNotFound, "unsupported format, use one of json, ndjson, csv")
+		return
+	}
+
+	elements := strings.Split(strings.TrimSuffix(urlPath, ext), "/")
+	if len(elements) > 2 {
+		writeAPIv2Error(w, r, http.StatusNotFound, APIv2ErrNotFound, "unknown endpoint")
+		return
+	}
+	kind := elements[0]
+	if kind != "retail" && kind != "buylist" && kind != "all" {
+		writeAPIv2Error(w, r, http.StatusNotFound, APIv2ErrNotFound, "unknown price type, use one of retail, buylist, all")
+		return
+	}
+
+	// Validate parameters
+	idOpt := r.FormValue("id")
+	if !slices.Contains([]string{"", "tcg", "scryfall", "mtgjson", "mkm", "ck"}, idOpt) {
+		writeAPIv2Error(w, r, http.StatusUnprocessableEntity, APIv2ErrInvalidParameter, "invalid id, use one of tcg, scryfall, mtgjson, mkm, ck")
+		return
+	}
+	filterByFinish := r.FormValue("finish")
+	if !slices.Contains([]string{"", "nonfoil", "foil", "etched"}, filterByFinish) {
+		writeAPIv2Error(w, r, http.StatusUnprocessableEntity, APIv2ErrInvalidParameter, "invalid finish, use one of nonfoil, foil, etched")
+		return
+	}
+	flags := map[string]bool{}
+	for _, name := range []string{"qty", "conds", "full"} {
+		opt := r.FormValue(name)
+		if opt == "" {
+			continue
+		}
+		value, err := strconv.ParseBool(opt)
+		if err != nil {
+			writeAPIv2Error(w, r, http.StatusUnprocessableEntity, APIv2ErrInvalidParameter, fmt.Sprintf("invalid %s, use a boolean value", name))
+			return
+		}
+		flags[name] = value
+	}
+	qty := flags["qty"]
+	conds := flags["conds"]
+	showFullName := flags["full"]
+
+	// Check permissions
+	enabledStores := getAPIEnabledStores(sig)
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+	doRetail := (kind == "retail" || kind == "all") && canRetail
+	doBuylist := (kind == "buylist" || kind == "all") && canBuylist
+	if !doRetail && !doBuylist {
+		writeAPIv2Error(w, r, http.StatusForbidden, APIv2ErrForbidden, "no access to "+kind+" prices")
+		return
+	}
+	dumpType := ""
+	if doRetail {
+		dumpType += "retail"
+	}
+	if doBuylist {
+		dumpType += "buylist"
+	}
+
+	filterByVendor := r.FormValue("vendor")
+	if filterByVendor != "" {
+		if !slices.Contains(enabledStores, filterByVendor) {
+			writeAPIv2Error(w, r, http.StatusForbidden, APIv2ErrForbidden, "no access to store "+filterByVendor)
+			return
+		}
+		enabledStores = []string{filterByVendor}
+	}
+
+	filterByEdition := ""
+	var filterByHash []string
+	if len(elements) == 2 {
+		filterByEdition, filterByHash = parsePriceAPIFilter(elements[1])
+		if filterByEdition == "" && filterByHash == nil {
+			writeAPIv2Error(w, r, http.StatusNotFound, APIv2ErrNotFound, "no edition or card found for "+elements[1])
+			return
+		}
+	}
+
+	// Only search conditions when a single store is enabled, or if a list of card is requested
+	if len(enabledStores) == 1 {
+		conds = true
+	} else if conds {
+		conds = filterByHash != nil
+	}
+
+	// Skip any work if the client already has the latest data
+	lastModified := getStoresLastModified(enabledStores, doRetail, doBuylist)
+	cacheKey := getAPICacheKey(r, strings.Join(enabledStores, ","), dumpType)
+	start := time.Now()
+	user := GetParamFromSig(sig, "UserEmail")
+
+	etag, rows, done := checkAPICache(w, r, cacheKey, lastModified)
+	if done {
+		addUsageCards(r, rows)
+
+		event := newAuditEvent(sig, "api", "PriceAPIv2", start)
+		event.Query = dumpType
+		event.Stores = enabledStores
+		event.Rows = rows
+		event.Message = fmt.Sprintf("%s requested a '%s' API v2 dump ('%s','%q','%s') in %s, served from cache", user, dumpType, filterByEdition, filterByHash, filterByFinish, format)
+		recordAudit(event)
+		return
+	}
+	cacheWriter := newAPICacheWriter(w, cacheKey, etag)
+
+	var err error
+	var cards int
+	switch format {
+	case "json":
+		out := PriceAPIOutput{}
+		out.Meta.Date = time.Now()
+		out.Meta.Version = APIv2Version
+		out.Meta.BaseURL = getBaseURL(r) + "/go/"
+		if doRetail {
+			out.Retail = getSellerPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds)
+		}
+		if doBuylist {
+			out.Buylist = getVendorPrices(idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds)
+		}
+		err = json.NewEncoder(cacheWriter).Encode(&out)
+		cards = len(out.Retail) + len(out.Buylist)
+	case "ndjson", "csv":
+		// Streams are never stored, so that memory stays flat
+		cards, err = streamPriceAPI(w, format, doRetail, doBuylist, idOpt, enabledStores, filterByEdition, filterByHash, filterByFinish, qty, conds, showFullName)
+	}
+	addUsageCards(r, cards)
+
+	msg := fmt.Sprintf("[%v] %s requested a '%s' API v2 dump ('%s','%q','%s') in %s", time.Since(start), user, dumpType, filterByEdition, filterByHash, filterByFinish, format)
+	event := newAuditEvent(sig, "api", "PriceAPIv2", start)
+	event.Query = dumpType
+	event.Stores = enabledStores
+	event.Rows = cards
+	if err != nil {
+		event.Outcome = AuditOutcomeError
+	}
+	event.Message = msg
+	recordAudit(event)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	cacheWriter.Save(cards)
+}
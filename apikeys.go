@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultAPIKeysFile = "apikeys.json"
+
+	// How often last use information is persisted
+	APIKeysFlushInterval = 5 * time.Minute
+
+	// How often the registry is reloaded, so that keys revoked or issued
+	// by other nodes sharing the same store are picked up
+	APIKeysSyncInterval = 30 * time.Second
+)
+
+var (
+	ErrRevokedAPIKey = errors.New("revoked api key")
+	ErrIPNotAllowed  = errors.New("address not allowed for this api key")
+)
+
+type APIKeyRecord struct {
+	Id       string     `json:"id"`
+	Owner    string     `json:"owner"`
+	Tier     string     `json:"tier,omitempty"`
+	Scopes   []string   `json:"scopes"`
+	CIDRs    []string   `json:"allowed_cidrs,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+}
+
+// Interface for the persistent storage of the registry
+type APIKeyStore interface {
+	Load() (map[string]*APIKeyRecord, error)
+	// Return nil if the key is not found
+	Get(id string) (*APIKeyRecord, error)
+	// Add or replace the given records
+	Save(records []*APIKeyRecord) error
+}
+
+// Store the whole registry in a single json file
+type fileKeyStore struct {
+	sync.Mutex
+	path string
+}
+
+func (fs *fileKeyStore) Load() (map[string]*APIKeyRecord, error) {
+	records := map[string]*APIKeyRecord{}
+	file, err := os.Open(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// The file is only used by a single node, so any key not loaded in memory
+// does not exist
+func (fs *fileKeyStore) Get(id string) (*APIKeyRecord, error) {
+	return nil, nil
+}
+
+func (fs *fileKeyStore) Save(records []*APIKeyRecord) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	out, err := fs.Load()
+	if err != nil {
+		return err
+	}
+	apiKeysMutex.RLock()
+	for _, record := range records {
+		out[record.Id] = record
+	}
+	data, err := json.MarshalIndent(out, "", "    ")
+	apiKeysMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that the registry is never corrupted
+	tmpName := fs.path + ".tmp"
+	err = os.WriteFile(tmpName, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fs.path)
+}
+
+// Store each record as a field of a redis hash
+type redisKeyStore struct {
+	client *redis.Client
+}
+
+const redisAPIKeysHash = "apikeys"
+
+func (rs *redisKeyStore) Load() (map[string]*APIKeyRecord, error) {
+	records := map[string]*APIKeyRecord{}
+	results, err := rs.client.HGetAll(context.Background(), redisAPIKeysHash).Result()
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range results {
+		var record APIKeyRecord
+		err := json.Unmarshal([]byte(data), &record)
+		if err != nil {
+			log.Println("invalid api key record", id, err)
+			continue
+		}
+		records[id] = &record
+	}
+	return records, nil
+}
+
+func (rs *redisKeyStore) Get(id string) (*APIKeyRecord, error) {
+	data, err := rs.client.HGet(context.Background(), redisAPIKeysHash, id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var record APIKeyRecord
+	err = json.Unmarshal([]byte(data), &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (rs *redisKeyStore) Save(records []*APIKeyRecord) error {
+	values := map[string]interface{}{}
+	apiKeysMutex.RLock()
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			apiKeysMutex.RUnlock()
+			return err
+		}
+		values[record.Id] = string(data)
+	}
+	apiKeysMutex.RUnlock()
+	if len(values) == 0 {
+		return nil
+	}
+	return rs.client.HSet(context.Background(), redisAPIKeysHash, values).Err()
+}
+
+var apiKeysMutex sync.RWMutex
+var apiKeys map[string]*APIKeyRecord
+var apiKeysStore APIKeyStore
+
+// Last use of the keys since the last flush, kept separately so that checking
+// a key only needs a read lock on the registry
+var apiKeysUsageMutex sync.Mutex
+var apiKeysLastUsed = map[string]time.Time{}
+
+func loadAPIKeys() error {
+	if Config.APIKeys.Backend == "redis" {
+		apiKeysStore = &redisKeyStore{
+			client: redis.NewClient(&redis.Options{
+				Addr: Config.RedisAddr,
+				DB:   DBs["apikeys"],
+			}),
+		}
+	} else {
+		fname := Config.APIKeys.FilePath
+		if fname == "" {
+			fname = DefaultAPIKeysFile
+		}
+		apiKeysStore = &fileKeyStore{path: fname}
+	}
+
+	records, err := apiKeysStore.Load()
+	if err != nil {
+		return err
+	}
+
+	apiKeysMutex.Lock()
+	apiKeys = records
+	apiKeysMutex.Unlock()
+
+	log.Printf("Loaded %d api keys", len(records))
+
+	go func() {
+		for range time.NewTicker(APIKeysFlushInterval).C {
+			err := flushAPIKeysUsage()
+			if err != nil {
+				log.Println("unable to save api keys usage:", err)
+			}
+		}
+	}()
+
+	go func() {
+		for range time.NewTicker(APIKeysSyncInterval).C {
+			err := syncAPIKeys()
+			if err != nil {
+				log.Println("unable to sync api keys:", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Merge the content of the store into the registry, keeping the most recent
+// use of each key and any revocation
+// Records are never removed, as they may have been added after loading
+func syncAPIKeys() error {
+	records, err := apiKeysStore.Load()
+	if err != nil {
+		return err
+	}
+
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+
+	if apiKeys == nil {
+		apiKeys = map[string]*APIKeyRecord{}
+	}
+	for id, record := range records {
+		old, found := apiKeys[id]
+		if !found {
+			apiKeys[id] = record
+			continue
+		}
+		if old.Revoked == nil && record.Revoked != nil {
+			old.Revoked = record.Revoked
+		}
+		if record.LastUsed != nil && (old.LastUsed == nil || record.LastUsed.After(*old.LastUsed)) {
+			old.LastUsed = record.LastUsed
+		}
+	}
+
+	return nil
+}
+
+func flushAPIKeysUsage() error {
+	apiKeysUsageMutex.Lock()
+	lastUsed := apiKeysLastUsed
+	apiKeysLastUsed = map[string]time.Time{}
+	apiKeysUsageMutex.Unlock()
+
+	apiKeysMutex.Lock()
+	var records []*APIKeyRecord
+	for id, ts := range lastUsed {
+		record, found := apiKeys[id]
+		if found {
+			ts := ts
+			record.LastUsed = &ts
+			records = append(records, record)
+		}
+	}
+	apiKeysMutex.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+	return apiKeysStore.Save(records)
+}
+
+func saveAPIKey(record *APIKeyRecord) error {
+	apiKeysMutex.Lock()
+	if apiKeys == nil {
+		apiKeys = map[string]*APIKeyRecord{}
+	}
+	apiKeys[record.Id] = record
+	apiKeysMutex.Unlock()
+
+	if apiKeysStore == nil {
+		return errors.New("api key registry not loaded")
+	}
+	return apiKeysStore.Save([]*APIKeyRecord{record})
+}
+
+func newAPIKeyId() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Check that a key has not been revoked and is used from an allowed address,
+// and keep track of its usage
+// Keys issued before the registry existed have no id and are always valid
+func checkAPIKey(keyId string, ip net.IP) error {
+	if keyId == "" {
+		return nil
+	}
+
+	apiKeysMutex.RLock()
+	record, found := apiKeys[keyId]
+	var revoked bool
+	var cidrs []string
+	if found {
+		revoked = record.Revoked != nil
+		cidrs = record.CIDRs
+	}
+	apiKeysMutex.RUnlock()
+
+	// The key may have just been issued by another node
+	if !found && apiKeysStore != nil {
+		stored, err := apiKeysStore.Get(keyId)
+		if err != nil {
+			log.Println("unable to look up api key", keyId, err)
+		}
+		if stored != nil {
+			apiKeysMutex.Lock()
+			if apiKeys == nil {
+				apiKeys = map[string]*APIKeyRecord{}
+			}
+			apiKeys[keyId] = stored
+			apiKeysMutex.Unlock()
+
+			found = true
+			revoked = stored.Revoked != nil
+			cidrs = stored.CIDRs
+		}
+	}
+
+	if !found || revoked {
+		return ErrRevokedAPIKey
+	}
+	if len(cidrs) > 0 {
+		nets, err := parseCIDRs(cidrs)
+		if err != nil || ip == nil || !ipInNets(ip, nets) {
+			return ErrIPNotAllowed
+		}
+	}
+
+	apiKeysUsageMutex.Lock()
+	apiKeysLastUsed[keyId] = time.Now()
+	apiKeysUsageMutex.Unlock()
+
+	return nil
+}
+
+func revokeAPIKey(keyId string) error {
+	apiKeysMutex.Lock()
+	record, found := apiKeys[keyId]
+	if found && record.Revoked == nil {
+		now := time.Now()
+		record.Revoked = &now
+	}
+	apiKeysMutex.Unlock()
+
+	if !found {
+		return errors.New("key not found")
+	}
+	return apiKeysStore.Save([]*APIKeyRecord{record})
+}
+
+// Return the keys of a user that have not been revoked yet
+func activeAPIKeys(user string) []*APIKeyRecord {
+	apiKeysMutex.RLock()
+	defer apiKeysMutex.RUnlock()
+
+	var records []*APIKeyRecord
+	for _, record := range apiKeys {
+		if record.Owner == user && record.Revoked == nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Created.After(records[j].Created)
+	})
+	return records
+}
+
+// Revoke all the keys of a user, replace their secret so that keys without
+// an id stop working too, and issue a new key with the most recent settings
+func rotateAPIKeys(link, user string) (string, error) {
+	records := activeAPIKeys(user)
+
+	tier := ""
+	scopes := []string{"all"}
+	var cidrs []string
+	var duration time.Duration
+	if len(records) > 0 {
+		tier = records[0].Tier
+		scopes = records[0].Scopes
+		cidrs = records[0].CIDRs
+		if records[0].Expires != nil {
+			duration = records[0].Expires.Sub(records[0].Created)
+		}
+	}
+
+	for _, record := range records {
+		err := revokeAPIKey(record.Id)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	apiUsersMutex.Lock()
+	delete(Config.ApiUserSecrets, user)
+	apiUsersMutex.Unlock()
+
+	return generateAPIKey(link, user, tier, strings.Join(scopes, ","), strings.Join(cidrs, ","), duration)
+}
+
+// Return all keys, most recent first
+func listAPIKeys() []APIKeyRecord {
+	apiKeysMutex.RLock()
+	defer apiKeysMutex.RUnlock()
+
+	var records []APIKeyRecord
+	for _, record := range apiKeys {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Created.After(records[j].Created)
+	})
+	return records
+}
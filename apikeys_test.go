@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Registry shared by several nodes, as redisKeyStore would be
+type memoryKeyStore struct {
+	sync.Mutex
+	records map[string]APIKeyRecord
+}
+
+func (ms *memoryKeyStore) Load() (map[string]*APIKeyRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	out := map[string]*APIKeyRecord{}
+	for id, record := range ms.records {
+		record := record
+		out[id] = &record
+	}
+	return out, nil
+}
+
+func (ms *memoryKeyStore) Get(id string) (*APIKeyRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	record, found := ms.records[id]
+	if !found {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (ms *memoryKeyStore) Save(records []*APIKeyRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	for _, record := range records {
+		ms.records[record.Id] = *record
+	}
+	return nil
+}
+
+// Replace the registry state for the duration of a test
+func setupAPIKeys(t *testing.T, store APIKeyStore, records ...*APIKeyRecord) {
+	oldKeys, oldStore, oldUsed := apiKeys, apiKeysStore, apiKeysLastUsed
+	t.Cleanup(func() {
+		apiKeys, apiKeysStore, apiKeysLastUsed = oldKeys, oldStore, oldUsed
+	})
+
+	apiKeys = map[string]*APIKeyRecord{}
+	for _, record := range records {
+		apiKeys[record.Id] = record
+	}
+	apiKeysStore = store
+	apiKeysLastUsed = map[string]time.Time{}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	setupAPIKeys(t, nil)
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+
+	// Two nodes writing to the same file must not drop each other's keys
+	first := &fileKeyStore{path: path}
+	second := &fileKeyStore{path: path}
+
+	records, err := first.Load()
+	if err != nil || len(records) != 0 {
+		t.Fatalf("FAIL: Expected an empty registry, got %v (%v)", records, err)
+	}
+
+	err = first.Save([]*APIKeyRecord{{Id: "one", Owner: "user@example.com", Scopes: []string{"all"}}})
+	if err != nil {
+		t.Fatalf("FAIL: Unable to save: %s", err)
+	}
+	err = second.Save([]*APIKeyRecord{{Id: "two", Owner: "other@example.com", Scopes: []string{"prices"}}})
+	if err != nil {
+		t.Fatalf("FAIL: Unable to save: %s", err)
+	}
+
+	records, err = first.Load()
+	if err != nil {
+		t.Fatalf("FAIL: Unable to load: %s", err)
+	}
+	if len(records) != 2 || records["one"] == nil || records["two"] == nil {
+		t.Fatalf("FAIL: Expected both keys, got %v", records)
+	}
+	if records["two"].Owner != "other@example.com" || records["two"].Scopes[0] != "prices" {
+		t.Errorf("FAIL: Unexpected record %+v", records["two"])
+	}
+}
+
+var CheckAPIKeyTests = []struct {
+	Name     string
+	KeyId    string
+	IP       string
+	Expected error
+}{
+	{
+		Name:  "legacy key without id",
+		KeyId: "",
+	},
+	{
+		Name:  "active key",
+		KeyId: "active",
+	},
+	{
+		Name:     "unknown key",
+		KeyId:    "unknown",
+		Expected: ErrRevokedAPIKey,
+	},
+	{
+		Name:     "revoked key",
+		KeyId:    "revoked",
+		Expected: ErrRevokedAPIKey,
+	},
+	{
+		Name:  "allowed address",
+		KeyId: "restricted",
+		IP:    "10.1.2.3",
+	},
+	{
+		Name:     "disallowed address",
+		KeyId:    "restricted",
+		IP:       "192.0.2.1",
+		Expected: ErrIPNotAllowed,
+	},
+	{
+		Name:     "missing address",
+		KeyId:    "restricted",
+		Expected: ErrIPNotAllowed,
+	},
+	{
+		Name:  "allowed bare address",
+		KeyId: "single",
+		IP:    "192.0.2.1",
+	},
+	{
+		Name:     "address next to a bare address",
+		KeyId:    "single",
+		IP:       "192.0.2.2",
+		Expected: ErrIPNotAllowed,
+	},
+	{
+		Name:  "key issued by another node",
+		KeyId: "remote",
+	},
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	revoked := time.Now().Add(-time.Hour)
+	store := &memoryKeyStore{records: map[string]APIKeyRecord{
+		"remote": {Id: "remote", Owner: "user@example.com"},
+	}}
+	setupAPIKeys(t, store,
+		&APIKeyRecord{Id: "active", Owner: "user@example.com"},
+		&APIKeyRecord{Id: "revoked", Owner: "user@example.com", Revoked: &revoked},
+		&APIKeyRecord{Id: "restricted", Owner: "user@example.com", CIDRs: []string{"10.0.0.0/8"}},
+		&APIKeyRecord{Id: "single", Owner: "user@example.com", CIDRs: []string{"192.0.2.1"}},
+	)
+
+	for _, test := range CheckAPIKeyTests {
+		t.Run(test.Name, func(t *testing.T) {
+			apiKeysLastUsed = map[string]time.Time{}
+			err := checkAPIKey(test.KeyId, net.ParseIP(test.IP))
+			if err != test.Expected {
+				t.Errorf("FAIL: Expected '%v', got '%v'", test.Expected, err)
+			}
+			_, used := apiKeysLastUsed[test.KeyId]
+			if test.KeyId != "" && used != (err == nil) {
+				t.Errorf("FAIL: Expected usage to be tracked only for valid keys")
+			}
+		})
+	}
+
+	if apiKeys["remote"] == nil {
+		t.Errorf("FAIL: Expected the key from the store to be cached")
+	}
+}
+
+func TestSyncAPIKeys(t *testing.T) {
+	recent := time.Now()
+	older := recent.Add(-time.Hour)
+	store := &memoryKeyStore{records: map[string]APIKeyRecord{}}
+	setupAPIKeys(t, store, &APIKeyRecord{Id: "key", Owner: "user@example.com", LastUsed: &recent})
+
+	// Another node revokes the key, with an older usage time
+	revoked := time.Now()
+	store.Save([]*APIKeyRecord{{Id: "key", Owner: "user@example.com", LastUsed: &older, Revoked: &revoked}})
+
+	err := syncAPIKeys()
+	if err != nil {
+		t.Fatalf("FAIL: Unable to sync: %s", err)
+	}
+	err = checkAPIKey("key", nil)
+	if err != ErrRevokedAPIKey {
+		t.Errorf("FAIL: Expected the key to be revoked after syncing, got '%v'", err)
+	}
+	if !apiKeys["key"].LastUsed.Equal(recent) {
+		t.Errorf("FAIL: Expected the most recent usage to be kept, got %v", apiKeys["key"].LastUsed)
+	}
+}
+
+// Keys saved or revoked locally while the store is being loaded are kept
+func TestSyncAPIKeysKeepsLocalChanges(t *testing.T) {
+	revoked := time.Now()
+	store := &memoryKeyStore{records: map[string]APIKeyRecord{
+		"key": {Id: "key", Owner: "user@example.com"},
+	}}
+	setupAPIKeys(t, store,
+		&APIKeyRecord{Id: "new", Owner: "user@example.com"},
+		&APIKeyRecord{Id: "key", Owner: "user@example.com", Revoked: &revoked},
+	)
+
+	err := syncAPIKeys()
+	if err != nil {
+		t.Fatalf("FAIL: Unable to sync: %s", err)
+	}
+	err = checkAPIKey("new", nil)
+	if err != nil {
+		t.Errorf("FAIL: Expected the new key to be valid after syncing, got '%v'", err)
+	}
+	err = checkAPIKey("key", nil)
+	if err != ErrRevokedAPIKey {
+		t.Errorf("FAIL: Expected the key to stay revoked after syncing, got '%v'", err)
+	}
+}
+
+func TestFlushAPIKeysUsage(t *testing.T) {
+	store := &memoryKeyStore{records: map[string]APIKeyRecord{}}
+	setupAPIKeys(t, store, &APIKeyRecord{Id: "key", Owner: "user@example.com"})
+
+	err := checkAPIKey("key", nil)
+	if err != nil {
+		t.Fatalf("FAIL: Unexpected error: %s", err)
+	}
+	err = flushAPIKeysUsage()
+	if err != nil {
+		t.Fatalf("FAIL: Unable to flush: %s", err)
+	}
+
+	stored, _ := store.Get("key")
+	if stored == nil || stored.LastUsed == nil {
+		t.Fatalf("FAIL: Expected the usage to be saved, got %+v", stored)
+	}
+	if len(apiKeysLastUsed) != 0 {
+		t.Errorf("FAIL: Expected pending usage to be cleared")
+	}
+}
@@ -264,35 +264,7 @@ func arbit(w http.ResponseWriter, r *http.Request, reverse bool) {
 	}
 	pageVars := genPageNav(pageName, sig)
 
-	var anyOptionEnabled bool
-
-	var allowlistSellers []string
-	allowlistSellersOpt := GetParamFromSig(sig, "ArbitEnabled")
-
-	if allowlistSellersOpt == "ALL" || (DevMode && !SigCheck) {
-		for _, seller := range Sellers {
-			if seller == nil || seller.Info().MetadataOnly {
-				continue
-			}
-			allowlistSellers = append(allowlistSellers, seller.Info().Shorthand)
-		}
-		// Enable any option with BetaFlag
-		anyOptionEnabled = true
-	} else if allowlistSellersOpt == "DEV" {
-		allowlistSellers = append(Config.ArbitDefaultSellers, Config.DevSellers...)
-	} else if allowlistSellersOpt == "" {
-		allowlistSellers = Config.ArbitDefaultSellers
-	} else {
-		allowlistSellers = strings.Split(allowlistSellersOpt, ",")
-	}
-
-	var blocklistVendors []string
-	blocklistVendorsOpt := GetParamFromSig(sig, "ArbitDisabledVendors")
-	if blocklistVendorsOpt == "" {
-		blocklistVendors = Config.ArbitBlockVendors
-	} else if blocklistVendorsOpt != "NONE" {
-		blocklistVendors = strings.Split(blocklistVendorsOpt, ",")
-	}
+	allowlistSellers, blocklistVendors, anyOptionEnabled := getArbitLists(sig)
 
 	if r.FormValue("page") == "opt" {
 		// Load all available vendors
@@ -324,8 +296,49 @@ func arbit(w http.ResponseWriter, r *http.Request, reverse bool) {
 
 	user := GetParamFromSig(sig, "UserEmail")
 	msg := fmt.Sprintf("Request by %s took %v", user, time.Since(start))
-	UserNotify("arbit", msg)
 	LogPages["Arbit"].Println(msg)
+
+	event := newAuditEvent(sig, "arbit", pageName, start)
+	event.Query = r.FormValue("source")
+	event.Stores = allowlistSellers
+	event.Message = msg
+	recordAudit(event)
+}
+
+// Return the sellers that can be used as source, the vendors that should
+// be skipped, and whether experimental options are available
+func getArbitLists(sig string) ([]string, []string, bool) {
+	var anyOptionEnabled bool
+
+	var allowlistSellers []string
+	allowlistSellersOpt := GetParamFromSig(sig, "ArbitEnabled")
+
+	if allowlistSellersOpt == "ALL" || (DevMode && !SigCheck) {
+		for _, seller := range Sellers {
+			if seller == nil || seller.Info().MetadataOnly {
+				continue
+			}
+			allowlistSellers = append(allowlistSellers, seller.Info().Shorthand)
+		}
+		// Enable any option with BetaFlag
+		anyOptionEnabled = true
+	} else if allowlistSellersOpt == "DEV" {
+		allowlistSellers = append(Config.ArbitDefaultSellers, Config.DevSellers...)
+	} else if allowlistSellersOpt == "" {
+		allowlistSellers = Config.ArbitDefaultSellers
+	} else {
+		allowlistSellers = strings.Split(allowlistSellersOpt, ",")
+	}
+
+	var blocklistVendors []string
+	blocklistVendorsOpt := GetParamFromSig(sig, "ArbitDisabledVendors")
+	if blocklistVendorsOpt == "" {
+		blocklistVendors = Config.ArbitBlockVendors
+	} else if blocklistVendorsOpt != "NONE" {
+		blocklistVendors = strings.Split(blocklistVendorsOpt, ",")
+	}
+
+	return allowlistSellers, blocklistVendors, anyOptionEnabled
 }
 
 func Global(w http.ResponseWriter, r *http.Request) {
@@ -333,6 +346,29 @@ func Global(w http.ResponseWriter, r *http.Request) {
 
 	pageVars := genPageNav("Global", sig)
 
+	allowlistSellers, blocklistVendors, anyEnabled := getGlobalLists(sig)
+
+	// Inform the render this is Global
+	pageVars.GlobalMode = true
+
+	start := time.Now()
+
+	scraperCompare(w, r, pageVars, allowlistSellers, blocklistVendors, anyEnabled)
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("Request by %s took %v", user, time.Since(start))
+	LogPages["Global"].Println(msg)
+
+	event := newAuditEvent(sig, "global", "Global", start)
+	event.Query = r.FormValue("source")
+	event.Stores = allowlistSellers
+	event.Message = msg
+	recordAudit(event)
+}
+
+// Return the sellers used as reference, the sellers that should not be
+// probed, and whether the full tool is enabled
+func getGlobalLists(sig string) ([]string, []string, bool) {
 	anyEnabledOpt := GetParamFromSig(sig, "AnyEnabled")
 	anyEnabled, _ := strconv.ParseBool(anyEnabledOpt)
 
@@ -381,103 +417,105 @@ func Global(w http.ResponseWriter, r *http.Request) {
 		blocklistVendors = append(blocklistVendors, seller.Info().Shorthand)
 	}
 
-	// Inform the render this is Global
-	pageVars.GlobalMode = true
+	return allowlistSellers, blocklistVendors, anyEnabled
+}
 
-	start := time.Now()
+// Look up the source scraper, a Seller or Vendor depending on operation mode,
+// returning a message if not found or not allowed
+func findArbitSource(shorthand string, allowlistSellers []string, blocklistVendors []string, reverseMode bool) (mtgban.Scraper, string) {
+	var source mtgban.Scraper
+	if reverseMode {
+		if slices.Contains(blocklistVendors, shorthand) {
+			log.Println("Unauthorized attempt with", shorthand)
+			return nil, "Unknown " + shorthand + " seller"
+		}
 
-	scraperCompare(w, r, pageVars, allowlistSellers, blocklistVendors, anyEnabled)
+		for _, vendor := range Vendors {
+			if vendor == nil {
+				continue
+			}
+			if vendor.Info().Shorthand == shorthand {
+				source = vendor
+				break
+			}
+		}
+	} else {
+		if !slices.Contains(allowlistSellers, shorthand) {
+			log.Println("Unauthorized attempt with", shorthand)
+			return nil, "Unknown " + shorthand + " seller"
+		}
 
-	user := GetParamFromSig(sig, "UserEmail")
-	msg := fmt.Sprintf("Request by %s took %v", user, time.Since(start))
-	UserNotify("global", msg)
-	LogPages["Global"].Println(msg)
-}
+		for _, seller := range Sellers {
+			if seller == nil {
+				continue
+			}
 
-func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, allowlistSellers []string, blocklistVendors []string, flags ...bool) {
-	r.ParseForm()
+			if seller.Info().Shorthand == shorthand {
+				source = seller
+				break
+			}
+		}
+	}
+	if source == nil {
+		return nil, "Unknown " + shorthand + " source"
+	}
+	return source, ""
+}
 
-	var source mtgban.Scraper
-	var message string
-	var sorting string
+// Parse the boolean options from the form, skipping anything that is not
+// available for the current mode or source
+func parseArbitFilters(form url.Values, source mtgban.Scraper, globalMode bool, anyOptionEnabled bool) map[string]bool {
 	arbitFilters := map[string]bool{}
 
-	limitedResults := len(flags) > 0 && !flags[0]
-	anyOptionEnabled := len(flags) > 1 && flags[1]
-
-	pageVars.CanShowAll = anyOptionEnabled
-
 	// Set these flags for global, since it's likely users will want them
-	if pageVars.GlobalMode {
+	if globalMode {
 		arbitFilters["nopenny"] = !arbitFilters["nopenny"]
 		arbitFilters["nodiff"] = !arbitFilters["nodiff"]
 	}
 
-	for k, v := range r.Form {
-		switch k {
-		case "source":
-			// Source can be a Seller or Vendor depending on operation mode
-			if pageVars.ReverseMode {
-				if slices.Contains(blocklistVendors, v[0]) {
-					log.Println("Unauthorized attempt with", v[0])
-					message = "Unknown " + v[0] + " seller"
-					break
-				}
+	for _, k := range FilterOptKeys {
+		v, found := form[k]
+		if !found || len(v) == 0 {
+			continue
+		}
+		// Skip options reserved for arbit-only
+		if globalMode && FilterOptConfig[k].ArbitOnly {
+			continue
+		}
+		// Skip experimental options
+		if !anyOptionEnabled && FilterOptConfig[k].BetaFlag {
+			continue
+		}
+		// Skip sealed options when on sealed
+		if source != nil && source.Info().SealedMode && FilterOptConfig[k].NoSealed {
+			continue
+		}
+		if source != nil && !source.Info().SealedMode && FilterOptConfig[k].SealedOnly {
+			continue
+		}
+		arbitFilters[k], _ = strconv.ParseBool(v[0])
+	}
 
-				for _, vendor := range Vendors {
-					if vendor == nil {
-						continue
-					}
-					if vendor.Info().Shorthand == v[0] {
-						source = vendor
-						break
-					}
-				}
-			} else {
-				if !slices.Contains(allowlistSellers, v[0]) {
-					log.Println("Unauthorized attempt with", v[0])
-					message = "Unknown " + v[0] + " seller"
-					break
-				}
+	return arbitFilters
+}
 
-				for _, seller := range Sellers {
-					if seller == nil {
-						continue
-					}
+func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, allowlistSellers []string, blocklistVendors []string, flags ...bool) {
+	r.ParseForm()
 
-					if seller.Info().Shorthand == v[0] {
-						source = seller
-						break
-					}
-				}
-			}
-			if source == nil {
-				message = "Unknown " + v[0] + " source"
-			}
+	var source mtgban.Scraper
+	var message string
 
-		case "sort":
-			sorting = v[0]
+	limitedResults := len(flags) > 0 && !flags[0]
+	anyOptionEnabled := len(flags) > 1 && flags[1]
 
-		// Assume anything else is a boolean option
-		default:
-			// Skip options reserved for arbit-only
-			if pageVars.GlobalMode && FilterOptConfig[k].ArbitOnly {
-				continue
-			}
-			// Skip experimental options
-			if !anyOptionEnabled && FilterOptConfig[k].BetaFlag {
-				continue
-			}
-			// Skip sealed options when on sealed
-			if source != nil && source.Info().SealedMode && FilterOptConfig[k].NoSealed {
-				continue
-			}
-			if source != nil && !source.Info().SealedMode && FilterOptConfig[k].SealedOnly {
-				continue
-			}
-			arbitFilters[k], _ = strconv.ParseBool(v[0])
-		}
+	pageVars.CanShowAll = anyOptionEnabled
+
+	sourceOpt := r.FormValue("source")
+	if sourceOpt != "" {
+		source, message = findArbitSource(sourceOpt, allowlistSellers, blocklistVendors, pageVars.ReverseMode)
 	}
+	sorting := r.FormValue("sort")
+	arbitFilters := parseArbitFilters(r.Form, source, pageVars.GlobalMode, anyOptionEnabled)
 
 	if message != "" {
 		pageVars.Title = "Errors have been made"
@@ -558,10 +596,55 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 	pageVars.ArbitFilters = arbitFilters
 	pageVars.ArbitOptKeys = FilterOptKeys
 	pageVars.ArbitOptConfig = FilterOptConfig
+	pageVars.SortOption = sorting
 
-	pageVars.Arb = []Arbitrage{}
+	pageVars.Arb = runArbitrage(source, arbitFilters, sorting, blocklistVendors, pageVars.GlobalMode, pageVars.ReverseMode, limitedResults)
 	pageVars.Metadata = map[string]GenericCard{}
 
+	for _, entry := range pageVars.Arb {
+		arbit := entry.Arbit
+		for i := range arbit {
+			cardId := arbit[i].CardId
+			_, found := pageVars.Metadata[cardId]
+			if found {
+				continue
+			}
+			pageVars.Metadata[cardId] = uuid2card(cardId, true)
+			if pageVars.Metadata[cardId].Reserved {
+				pageVars.HasReserved = true
+			}
+			if pageVars.Metadata[cardId].Stocks {
+				pageVars.HasStocks = true
+			}
+			if pageVars.Metadata[cardId].SypList {
+				pageVars.HasSypList = true
+			}
+		}
+	}
+
+	if len(pageVars.Arb) == 0 {
+		pageVars.InfoMessage = "No arbitrage available!"
+	}
+
+	if pageVars.GlobalMode {
+		pageVars.Title = "Market Imbalance in " + source.Info().Name
+	} else {
+		pageVars.Title = "Arbitrage"
+		if pageVars.ReverseMode {
+			pageVars.Title += " towards "
+		} else {
+			pageVars.Title += " from "
+		}
+		pageVars.Title += source.Info().Name
+	}
+
+	render(w, "arbit.html", pageVars)
+}
+
+// Compare source against all the other compatible scrapers, with the given options
+func runArbitrage(source mtgban.Scraper, arbitFilters map[string]bool, sorting string, blocklistVendors []string, globalMode, reverseMode, limitedResults bool) []Arbitrage {
+	results := []Arbitrage{}
+
 	opts := &mtgban.ArbitOpts{
 		MinSpread:     MinSpread,
 		MaxSpread:     MaxSpread,
@@ -578,7 +661,7 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 	}
 
 	// Customize opts for Globals
-	if pageVars.GlobalMode {
+	if globalMode {
 		opts.MinSpread = MinSpreadGlobal
 		opts.MaxSpread = MaxSpreadGlobal
 
@@ -602,7 +685,7 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 
 	// The pool of scrapers that source will be compared against
 	var scrapers []mtgban.Scraper
-	if pageVars.GlobalMode || pageVars.ReverseMode {
+	if globalMode || reverseMode {
 		for _, seller := range Sellers {
 			if seller == nil {
 				continue
@@ -627,14 +710,14 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 		if scraper.Info().Shorthand == source.Info().Shorthand {
 			continue
 		}
-		if !pageVars.ReverseMode {
+		if !reverseMode {
 			if slices.Contains(blocklistVendors, scraper.Info().Shorthand) {
 				continue
 			}
 		}
 
 		// Set custom scraper options
-		if pageVars.GlobalMode && scraper.Info().Shorthand == TCG_DIRECT {
+		if globalMode && scraper.Info().Shorthand == TCG_DIRECT {
 			opts.Conditions = BadConditions
 		}
 		if scraper.Info().Shorthand == "ABU" {
@@ -643,9 +726,9 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 
 		var arbit []mtgban.ArbitEntry
 		var err error
-		if pageVars.GlobalMode {
+		if globalMode {
 			arbit, err = mtgban.Mismatch(opts, scraper.(mtgban.Seller), source.(mtgban.Seller))
-		} else if pageVars.ReverseMode {
+		} else if reverseMode {
 			arbit, err = mtgban.Arbit(opts, source.(mtgban.Vendor), scraper.(mtgban.Seller))
 		} else {
 			arbit, err = mtgban.Arbit(opts, scraper.(mtgban.Vendor), source.(mtgban.Seller))
@@ -660,7 +743,7 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 		}
 
 		// For Global, drop results before sorting, to add some extra variance
-		if pageVars.GlobalMode {
+		if globalMode {
 			maxResults := MaxResultsGlobal
 			// Lower max number of results for the preview
 			if limitedResults {
@@ -682,7 +765,7 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 				return arbit[i].InventoryEntry.Price > arbit[j].InventoryEntry.Price
 			})
 		case "buy_price":
-			if pageVars.GlobalMode {
+			if globalMode {
 				sort.Slice(arbit, func(i, j int) bool {
 					return arbit[i].ReferenceEntry.Price > arbit[j].ReferenceEntry.Price
 				})
@@ -704,10 +787,9 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 				return arbit[i].Spread > arbit[j].Spread
 			})
 		}
-		pageVars.SortOption = sorting
 
 		// For Arbit, drop any excessive results after sorting
-		if !pageVars.GlobalMode && len(arbit) > MaxArbitResults {
+		if !globalMode && len(arbit) > MaxArbitResults {
 			arbit = arbit[:MaxArbitResults]
 		}
 
@@ -726,7 +808,7 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 			HasCredit: !scraper.Info().NoCredit,
 			HasNoQty:  scraper.Info().MetadataOnly || scraper.Info().NoQuantityInventory,
 		}
-		if pageVars.GlobalMode {
+		if globalMode {
 			entry.HasCredit = false
 			entry.HasNoConds = source.Info().MetadataOnly
 		}
@@ -734,41 +816,8 @@ func scraperCompare(w http.ResponseWriter, r *http.Request, pageVars PageVars, a
 			entry.HasNoConds = scraper.Info().MetadataOnly
 		}
 
-		pageVars.Arb = append(pageVars.Arb, entry)
-		for i := range arbit {
-			cardId := arbit[i].CardId
-			_, found := pageVars.Metadata[cardId]
-			if found {
-				continue
-			}
-			pageVars.Metadata[cardId] = uuid2card(cardId, true)
-			if pageVars.Metadata[cardId].Reserved {
-				pageVars.HasReserved = true
-			}
-			if pageVars.Metadata[cardId].Stocks {
-				pageVars.HasStocks = true
-			}
-			if pageVars.Metadata[cardId].SypList {
-				pageVars.HasSypList = true
-			}
-		}
-	}
-
-	if len(pageVars.Arb) == 0 {
-		pageVars.InfoMessage = "No arbitrage available!"
-	}
-
-	if pageVars.GlobalMode {
-		pageVars.Title = "Market Imbalance in " + source.Info().Name
-	} else {
-		pageVars.Title = "Arbitrage"
-		if pageVars.ReverseMode {
-			pageVars.Title += " towards "
-		} else {
-			pageVars.Title += " from "
-		}
-		pageVars.Title += source.Info().Name
+		results = append(results, entry)
 	}
 
-	render(w, "arbit.html", pageVars)
+	return results
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/leemcloughlin/logfile"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	AuditFileName = "audit.jsonl"
+
+	// Number of events kept in memory for the admin view
+	AuditBufferSize = 5000
+
+	// Number of events kept in the redis list
+	AuditRedisMaxLen = 100000
+
+	// Number of events shown in the admin view
+	AuditViewSize = 200
+
+	AuditOutcomeOK     = "ok"
+	AuditOutcomeError  = "error"
+	AuditOutcomeDenied = "denied"
+)
+
+// Sinks used when none are configured
+var DefaultAuditSinks = []string{"file", "discord"}
+
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	User     string    `json:"user"`
+	Tier     string    `json:"tier,omitempty"`
+	Page     string    `json:"page"`
+	Query    string    `json:"query,omitempty"`
+	Stores   []string  `json:"stores,omitempty"`
+	Rows     int       `json:"rows"`
+	Duration float64   `json:"duration_ms"`
+	Outcome  string    `json:"outcome"`
+
+	// Identity carried by a signature that failed validation, kept out of
+	// the message so that it is never notified
+	ClaimedUser string `json:"claimed_user,omitempty"`
+
+	// Human readable description of the event
+	Message string `json:"message,omitempty"`
+}
+
+type AuditSink interface {
+	Write(event *AuditEvent) error
+}
+
+// Append events to a JSON-lines file, rotated by size
+type fileAuditSink struct {
+	sync.Mutex
+	logFile *logfile.LogFile
+}
+
+func (fs *fileAuditSink) Write(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.logFile.Write(append(data, '\n'))
+	return err
+}
+
+// Push events to a capped redis list, newest first
+type redisAuditSink struct {
+	client *redis.Client
+}
+
+const redisAuditList = "audit"
+
+func (rs *redisAuditSink) Write(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	err = rs.client.LPush(ctx, redisAuditList, data).Err()
+	if err != nil {
+		return err
+	}
+	return rs.client.LTrim(ctx, redisAuditList, 0, AuditRedisMaxLen-1).Err()
+}
+
+// Forward the message of the event to the Discord webhook, events without
+// a message or that were denied are not notified
+type discordAuditSink struct{}
+
+func (ds *discordAuditSink) Write(event *AuditEvent) error {
+	if event.Message == "" || event.Outcome == AuditOutcomeDenied {
+		return nil
+	}
+	if DevMode {
+		log.Println(event.Message)
+		return nil
+	}
+	UserNotify(event.Kind, event.Message)
+	return nil
+}
+
+var auditSinks []AuditSink
+
+// Latest events, used by the admin view
+var auditMutex sync.RWMutex
+var auditBuffer []AuditEvent
+
+func loadAudit() error {
+	sinks := Config.Audit.Sinks
+	if len(sinks) == 0 {
+		sinks = DefaultAuditSinks
+	}
+
+	auditSinks = nil
+	for _, sink := range sinks {
+		switch sink {
+		case "file":
+			fname := path.Join(LogDir, AuditFileName)
+			loadAuditBuffer(fname)
+
+			logFile, err := logfile.New(&logfile.LogFile{
+				FileName:    fname,
+				MaxSize:     10 * 1024 * 1024,
+				Flags:       logfile.FileOnly,
+				OldVersions: 5,
+			})
+			if err != nil {
+				return err
+			}
+			auditSinks = append(auditSinks, &fileAuditSink{logFile: logFile})
+		case "redis":
+			auditSinks = append(auditSinks, &redisAuditSink{
+				client: redis.NewClient(&redis.Options{
+					Addr: Config.RedisAddr,
+					DB:   DBs["audit"],
+				}),
+			})
+		case "discord":
+			auditSinks = append(auditSinks, &discordAuditSink{})
+		default:
+			return fmt.Errorf("unknown audit sink %s", sink)
+		}
+	}
+	return nil
+}
+
+// Restore the latest events from the current log file
+func loadAuditBuffer(fname string) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			continue
+		}
+		events = append(events, event)
+		if len(events) > AuditBufferSize {
+			events = events[1:]
+		}
+	}
+
+	auditMutex.Lock()
+	auditBuffer = events
+	auditMutex.Unlock()
+}
+
+// Prepare an event for the user of the signature, timed from start
+func newAuditEvent(sig, kind, page string, start time.Time) *AuditEvent {
+	event := &AuditEvent{
+		Time:    time.Now(),
+		Kind:    kind,
+		User:    GetParamFromSig(sig, "UserEmail"),
+		Tier:    GetParamFromSig(sig, "UserTier"),
+		Page:    page,
+		Outcome: AuditOutcomeOK,
+	}
+	if !start.IsZero() {
+		event.Duration = float64(time.Since(start).Microseconds()) / 1000
+	}
+	return event
+}
+
+// Prepare an event for a signature that failed validation, the identity it
+// carries is chosen by the client and is not recorded as the user
+func newUnverifiedAuditEvent(sig, kind, page string) *AuditEvent {
+	event := newAuditEvent("", kind, page, time.Time{})
+	event.ClaimedUser = GetParamFromSig(sig, "UserEmail")
+	return event
+}
+
+func recordAudit(event *AuditEvent) {
+	auditMutex.Lock()
+	auditBuffer = append(auditBuffer, *event)
+	if len(auditBuffer) > AuditBufferSize {
+		auditBuffer = auditBuffer[len(auditBuffer)-AuditBufferSize:]
+	}
+	auditMutex.Unlock()
+
+	for _, sink := range auditSinks {
+		err := sink.Write(event)
+		if err != nil {
+			log.Println("audit error:", err)
+		}
+	}
+}
+
+type AuditFilter struct {
+	User    string
+	Page    string
+	Outcome string
+	Query   string
+}
+
+// Return the latest events matching all the non-empty filters, newest first
+func filterAudit(filter AuditFilter, limit int) []AuditEvent {
+	auditMutex.RLock()
+	defer auditMutex.RUnlock()
+
+	var events []AuditEvent
+	for i := len(auditBuffer) - 1; i >= 0 && len(events) < limit; i-- {
+		event := auditBuffer[i]
+		if filter.User != "" && !strings.Contains(event.User, filter.User) && !strings.Contains(event.ClaimedUser, filter.User) {
+			continue
+		}
+		if filter.Page != "" && !strings.EqualFold(event.Page, filter.Page) {
+			continue
+		}
+		if filter.Outcome != "" && event.Outcome != filter.Outcome {
+			continue
+		}
+		if filter.Query != "" && !strings.Contains(strings.ToLower(event.Query), strings.ToLower(filter.Query)) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Return the list of pages found in the buffer, for the admin filters
+func auditPages() []string {
+	auditMutex.RLock()
+	defer auditMutex.RUnlock()
+
+	var pages []string
+	for _, event := range auditBuffer {
+		if !slices.Contains(pages, event.Page) {
+			pages = append(pages, event.Page)
+		}
+	}
+	slices.Sort(pages)
+	return pages
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+// The identity of a signature that failed validation is never trusted
+func TestUnverifiedAuditEvent(t *testing.T) {
+	sig := encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "UserTier": {"Admin"}})
+	event := newUnverifiedAuditEvent(sig, "api", "/api/search")
+
+	if event.User != "" || event.Tier != "" {
+		t.Errorf("FAIL: Expected no user or tier, got '%s' and '%s'", event.User, event.Tier)
+	}
+	if event.ClaimedUser != "user@example.com" {
+		t.Errorf("FAIL: Expected the claimed user to be recorded, got '%s'", event.ClaimedUser)
+	}
+	if event.Message != "" {
+		t.Errorf("FAIL: Expected no message to be notified, got '%s'", event.Message)
+	}
+}
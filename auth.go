@@ -11,7 +11,6 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -19,7 +18,6 @@ import (
 
 	"github.com/NYTimes/gziphandler"
 	cleanhttp "github.com/hashicorp/go-cleanhttp"
-	"golang.org/x/oauth2"
 )
 
 var PatreonHost string
@@ -228,72 +226,41 @@ func getBaseURL(r *http.Request) string {
 
 func Auth(w http.ResponseWriter, r *http.Request) {
 	baseURL := getBaseURL(r)
-	code := r.FormValue("code")
-	if code == "" {
-		http.Redirect(w, r, baseURL, http.StatusFound)
-		return
-	}
-
-	token, err := getUserToken(code, baseURL, r.FormValue("state"))
-	if err != nil {
-		LogPages["Admin"].Println("getUserToken", err.Error())
-		http.Redirect(w, r, baseURL+"?errmsg=TokenNotFound", http.StatusFound)
-		return
-	}
 
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	tc := oauth2.NewClient(r.Context(), ts)
-
-	userData, err := getUserIds(tc)
+	identity, redir, err := getAuthProvider().Authenticate(w, r)
 	if err != nil {
-		LogPages["Admin"].Println("getUserId", err.Error())
-		http.Redirect(w, r, baseURL+"?errmsg=UserNotFound", http.StatusFound)
-		return
-	}
-
-	tierTitle := ""
-	invite, found := Config.Patreon.Emails[userData.Email]
-	if found {
-		tierTitle = invite
-	}
-
-	if tierTitle == "" {
-		for _, userId := range userData.UserIds[1:] {
-			foundTitle, _ := getUserTier(tc, userId)
-			switch foundTitle {
-			case "PIONEER", "PIONEER (Early Adopters)":
-				tierTitle = "Pioneer"
-			case "MODERN", "MODERN (Early Adopters)":
-				tierTitle = "Modern"
-			case "LEGACY", "LEGACY (Early Adopters)":
-				tierTitle = "Legacy"
-			case "VINTAGE", "VINTAGE (Early Adopters)":
-				tierTitle = "Vintage"
-			case "Test Role":
-				tierTitle = "Test Role"
-			}
+		errmsg := "UserNotFound"
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			errmsg = authErr.Code
+		}
+		LogPages["Admin"].Println("Authenticate", err.Error())
+		if errmsg == "" {
+			http.Redirect(w, r, baseURL, http.StatusFound)
+			return
 		}
+		http.Redirect(w, r, baseURL+"?errmsg="+errmsg, http.StatusFound)
+		return
 	}
 
-	if tierTitle == "" {
-		LogPages["Admin"].Println("getUserTier returned an empty tier")
+	// Only accept tiers that are known to the ACL
+	if identity.Tier == "" || !tierExists(identity.Tier) {
+		LogPages["Admin"].Println("Authenticate returned an unknown tier", identity.Tier)
 		http.Redirect(w, r, baseURL+"?errmsg=TierNotFound", http.StatusFound)
 		return
 	}
 
-	LogPages["Admin"].Println(userData)
-	LogPages["Admin"].Println(tierTitle)
+	LogPages["Admin"].Println(identity)
 
 	// Sign our base URL with our tier and other data
-	sig := sign(baseURL, tierTitle, userData)
+	sig := sign(baseURL, identity.Tier, identity)
 
 	// Keep it secret. Keep it safe.
 	putSignatureInCookies(w, r, sig)
 
 	// Redirect to the URL indicated in this query param, or go to homepage
-	redir := r.FormValue("state")
 	if redir == "" {
-		redir = getBaseURL(r)
+		redir = baseURL
 	}
 
 	// Redirect, we're done here
@@ -308,10 +275,14 @@ func signHMACSHA1Base64(key []byte, data []byte) string {
 
 func getSignatureFromCookies(r *http.Request) string {
 	var sig string
-	for _, cookie := range r.Cookies() {
-		if cookie.Name == "MTGBAN" {
-			sig = cookie.Value
-			break
+	if sessionStore != nil {
+		sig = getSignatureFromSession(r)
+	} else {
+		for _, cookie := range r.Cookies() {
+			if cookie.Name == "MTGBAN" {
+				sig = cookie.Value
+				break
+			}
 		}
 	}
 
@@ -347,6 +318,21 @@ func putSignatureInCookies(w http.ResponseWriter, r *http.Request, sig string) {
 		Path:    "/",
 		Expires: endOfThisMonth,
 		Value:   sig,
+
+		// Do not send the cookie along cross-site POSTs
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	// The cookie only holds an opaque reference to the signature
+	if sessionStore != nil {
+		id, err := putSignatureInSession(r, sig)
+		if err != nil {
+			log.Println("unable to store session", err)
+			return
+		}
+		cookie.Name = SessionCookieName
+		cookie.Value = id
+		cookie.HttpOnly = true
 	}
 
 	http.SetCookie(w, &cookie)
@@ -375,15 +361,15 @@ func enforceAPISigning(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer recoverPanic(r, w)
 
-		w.Header().Add("RateLimit-Limit", fmt.Sprint(APIRequestsPerSec))
-
 		ip, err := IpAddress(r)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		if !APIRateLimiter.allow(string(ip)) {
+		res := APIRateLimiter.allow(ip.String(), verifiedSignature(getBaseURL(r), getAPISignature(r), true))
+		setRateLimitHeaders(w, res)
+		if !res.Allowed {
 			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
@@ -395,72 +381,180 @@ func enforceAPISigning(next http.Handler) http.Handler {
 
 		w.Header().Add("Content-Type", "application/json")
 
-		sig := r.FormValue("sig")
-		if SigCheck && sig == "" {
-			log.Println("API error, empty signature")
-			w.Write([]byte(`{"error": "empty signature"}`))
-			return
+		sig := getAPISignature(r)
+		err = validateAPISignature(r)
+		verified := err == nil
+		if err == nil {
+			err = checkQuota(sig)
 		}
+		if err != nil {
+			var event *AuditEvent
+			if verified {
+				event = newAuditEvent(sig, "api", r.URL.Path, time.Time{})
+			} else {
+				event = newUnverifiedAuditEvent(sig, "api", r.URL.Path)
+			}
+			event.Outcome = AuditOutcomeDenied
+			event.Query = err.Error()
+			recordAudit(event)
 
-		raw, err := base64.StdEncoding.DecodeString(sig)
-		if SigCheck && err != nil {
-			log.Println("API error, no sig", err)
-			w.Write([]byte(`{"error": "invalid signature"}`))
+			w.Write([]byte(`{"error": "` + apiV1ErrorMessage(err) + `"}`))
 			return
 		}
 
-		v, err := url.ParseQuery(string(raw))
-		if SigCheck && err != nil {
-			log.Println("API error, no b64", err)
-			w.Write([]byte(`{"error": "invalid b64 signature"}`))
-			return
-		}
+		uw, r := withUsage(w, r)
+		gziphandler.GzipHandler(next).ServeHTTP(uw, r)
+		recordUsage(GetParamFromSig(sig, "UserEmail"), uw.bytes, uw.cards)
+	})
+}
 
-		q := url.Values{}
-		q.Set("API", v.Get("API"))
+// Same as enforceAPISigning, but reporting failures with the appropriate
+// status codes and a structured error body
+func enforceAPIv2Signing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer recoverPanic(r, w)
 
-		for _, optional := range OptionalFields {
-			val := v.Get(optional)
-			if val != "" {
-				q.Set(optional, val)
-			}
+		ip, err := IpAddress(r)
+		if err != nil {
+			writeAPIv2Error(w, r, http.StatusInternalServerError, APIv2ErrInternal, "unable to determine client address")
+			return
 		}
 
-		sig = v.Get("Signature")
-		exp := v.Get("Expires")
-
-		secret := os.Getenv("BAN_SECRET")
-		apiUsersMutex.RLock()
-		user_secret, found := Config.ApiUserSecrets[v.Get("UserEmail")]
-		apiUsersMutex.RUnlock()
-		if found {
-			secret = user_secret
+		res := APIRateLimiter.allow(ip.String(), verifiedSignature(getBaseURL(r), getAPISignature(r), true))
+		setRateLimitHeaders(w, res)
+		if !res.Allowed {
+			writeAPIv2Error(w, r, http.StatusTooManyRequests, APIv2ErrRateLimited, "too many requests")
+			return
 		}
 
-		var expires int64
-		if exp != "" {
-			expires, err = strconv.ParseInt(exp, 10, 64)
-			if err != nil {
-				log.Println("API error", err.Error())
-				w.Write([]byte(`{"error": "invalid or expired signature"}`))
-				return
-			}
-			q.Set("Expires", exp)
+		if !DatabaseLoaded {
+			w.Header().Set("Retry-After", "60")
+			writeAPIv2Error(w, r, http.StatusServiceUnavailable, APIv2ErrUnavailable, "server is starting up, try again later")
+			return
 		}
 
-		data := fmt.Sprintf("%s%s%s%s", r.Method, exp, getBaseURL(r), q.Encode())
-		valid := signHMACSHA1Base64([]byte(secret), []byte(data))
+		err = validateAPISignature(r)
+		switch err {
+		case nil:
+		case ErrEmptySignature:
+			writeAPIv2Error(w, r, http.StatusUnauthorized, APIv2ErrMissingSignature, "missing signature")
+			return
+		case ErrExpiredSignature:
+			writeAPIv2Error(w, r, http.StatusUnauthorized, APIv2ErrExpiredSignature, err.Error())
+			return
+		case ErrRevokedAPIKey:
+			writeAPIv2Error(w, r, http.StatusUnauthorized, APIv2ErrRevokedKey, "revoked key")
+			return
+		case ErrIPNotAllowed:
+			writeAPIv2Error(w, r, http.StatusForbidden, APIv2ErrForbidden, "address not allowed for this key")
+			return
+		default:
+			writeAPIv2Error(w, r, http.StatusUnauthorized, APIv2ErrInvalidSignature, "invalid signature")
+			return
+		}
 
-		if SigCheck && (valid != sig || (exp != "" && (expires < time.Now().Unix()))) {
-			log.Println("API error, invalid", data)
-			w.Write([]byte(`{"error": "invalid or expired signature"}`))
+		sig := getAPISignature(r)
+		err = checkQuota(sig)
+		if err != nil {
+			writeAPIv2Error(w, r, http.StatusTooManyRequests, APIv2ErrRateLimited, err.Error())
 			return
 		}
 
-		gziphandler.GzipHandler(next).ServeHTTP(w, r)
+		w.Header().Add("Content-Type", "application/json")
+
+		uw, r := withUsage(w, r)
+		gziphandler.GzipHandler(next).ServeHTTP(uw, r)
+		recordUsage(GetParamFromSig(sig, "UserEmail"), uw.bytes, uw.cards)
 	})
 }
 
+var (
+	ErrEmptySignature      = errors.New("empty signature")
+	ErrInvalidSignature    = errors.New("invalid signature")
+	ErrInvalidB64Signature = errors.New("invalid b64 signature")
+	ErrMismatchedSignature = errors.New("invalid or expired signature")
+	ErrExpiredSignature    = errors.New("expired signature")
+)
+
+// Clients of the first version of the API match on the error text, so any
+// failure that is not about the format of the signature is reported with the
+// original message, distinct errors are only exposed by the v2 API
+func apiV1ErrorMessage(err error) string {
+	switch err {
+	case ErrEmptySignature, ErrInvalidSignature, ErrInvalidB64Signature:
+		return err.Error()
+	}
+	return ErrMismatchedSignature.Error()
+}
+
+// API signatures are only read from the URL, so that the body of POST
+// requests is left untouched for the handlers
+func getAPISignature(r *http.Request) string {
+	return r.URL.Query().Get("sig")
+}
+
+// Verify the API signature of a request, returning one of the signature errors
+func validateAPISignature(r *http.Request) error {
+	sig := getAPISignature(r)
+	if SigCheck && sig == "" {
+		log.Println("API error, empty signature")
+		return ErrEmptySignature
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if SigCheck && err != nil {
+		log.Println("API error, no sig", err)
+		return ErrInvalidSignature
+	}
+
+	v, err := url.ParseQuery(string(raw))
+	if SigCheck && err != nil {
+		log.Println("API error, no b64", err)
+		return ErrInvalidB64Signature
+	}
+
+	q := signedValues(v, true)
+
+	sig = v.Get("Signature")
+	exp := v.Get("Expires")
+
+	apiUsersMutex.RLock()
+	userSecret := Config.ApiUserSecrets[v.Get("UserEmail")]
+	apiUsersMutex.RUnlock()
+
+	var expires int64
+	if exp != "" {
+		expires, err = strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			log.Println("API error", err.Error())
+			return ErrMismatchedSignature
+		}
+	}
+
+	// Signatures are always generated for GET, but are valid for POST too
+	err = verifySignature(sig, exp, getBaseURL(r), v, q, userSecret)
+	if SigCheck && err != nil {
+		log.Println("API error,", err, q.Encode())
+		if err == ErrLegacySignature {
+			return err
+		}
+		return ErrMismatchedSignature
+	}
+	if SigCheck && exp != "" && expires < time.Now().Unix() {
+		log.Println("API error, expired", q.Encode())
+		return ErrExpiredSignature
+	}
+
+	ip, _ := IpAddress(r)
+	err = checkAPIKey(v.Get("APIKeyId"), ip)
+	if SigCheck && err != nil {
+		log.Println("API error,", err, v.Get("APIKeyId"))
+		return err
+	}
+
+	return nil
+}
+
 func enforceSigning(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer recoverPanic(r, w)
@@ -495,12 +589,33 @@ func enforceSigning(next http.Handler) http.Handler {
 
 		pageVars := genPageNav("Error", sig)
 
-		if !UserRateLimiter.allow(GetParamFromSig(sig, "UserEmail")) && r.URL.Path != "/admin" {
-			pageVars.Title = "Too Many Requests"
-			pageVars.ErrorMessage = ErrMsgUseAPI
+		// Only trust the user and the limit of a signature that was made by us,
+		// anybody else is limited by address
+		limitSig := verifiedSignature(getBaseURL(r), sig, false)
+		limitKey := GetParamFromSig(limitSig, "UserEmail")
+		if limitKey == "" {
+			limitKey = getClientIP(r)
+		}
 
-			render(w, "home.html", pageVars)
-			return
+		// Suggestions have their own bucket sized for typing, and the tier
+		// limit meant for pages does not apply to them
+		if r.URL.Path == "/api/suggest" {
+			res := SuggestRateLimiter.allow(limitKey, "")
+			setRateLimitHeaders(w, res)
+			if !res.Allowed {
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+		} else {
+			res := UserRateLimiter.allow(limitKey, limitSig)
+			setRateLimitHeaders(w, res)
+			if !res.Allowed && r.URL.Path != "/admin" {
+				pageVars.Title = "Too Many Requests"
+				pageVars.ErrorMessage = ErrMsgUseAPI
+
+				render(w, "home.html", pageVars)
+				return
+			}
 		}
 
 		raw, err := base64.StdEncoding.DecodeString(sig)
@@ -527,28 +642,21 @@ func enforceSigning(next http.Handler) http.Handler {
 			return
 		}
 
-		q := url.Values{}
-		for _, optional := range append(OrderNav, OptionalFields...) {
-			val := v.Get(optional)
-			if val != "" {
-				q.Set(optional, val)
-			}
-		}
+		q := signedValues(v, false)
 
 		expectedSig := v.Get("Signature")
 		exp := v.Get("Expires")
 
-		data := fmt.Sprintf("GET%s%s%s", exp, getBaseURL(r), q.Encode())
-		valid := signHMACSHA1Base64([]byte(os.Getenv("BAN_SECRET")), []byte(data))
+		sigErr := verifySignature(expectedSig, exp, getBaseURL(r), v, q, "")
 		expires, err := strconv.ParseInt(exp, 10, 64)
-		if SigCheck && (err != nil || valid != expectedSig || expires < time.Now().Unix()) {
+		if SigCheck && (err != nil || sigErr != nil || expires < time.Now().Unix()) {
 			if r.Method != "GET" {
 				http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
 				return
 			}
 			pageVars.Title = "Unauthorized"
 			pageVars.ErrorMessage = ErrMsg
-			if valid == expectedSig && expires < time.Now().Unix() {
+			if (sigErr == nil && expires < time.Now().Unix()) || sigErr == ErrLegacySignature {
 				pageVars.ErrorMessage = ErrMsgExpired
 				pageVars.PatreonLogin = true
 				if DevMode {
@@ -559,6 +667,8 @@ func enforceSigning(next http.Handler) http.Handler {
 			if DevMode {
 				if err != nil {
 					pageVars.ErrorMessage += " - " + err.Error()
+				} else if sigErr != nil {
+					pageVars.ErrorMessage += " - " + sigErr.Error()
 				} else {
 					pageVars.ErrorMessage += " - wrong host"
 				}
@@ -568,6 +678,40 @@ func enforceSigning(next http.Handler) http.Handler {
 			return
 		}
 
+		// The user was forced to log out after this signature was issued
+		if SigCheck && signatureRevoked(v) {
+			deleteSession(r)
+
+			pageVars.Title = "Unauthorized"
+			pageVars.ErrorMessage = ErrMsgExpired
+			pageVars.PatreonLogin = true
+			if DevMode {
+				pageVars.ErrorMessage += " - sig revoked"
+			}
+
+			render(w, "home.html", pageVars)
+			return
+		}
+
+		// Requests changing state need to come from one of our own forms
+		if r.Method == http.MethodPost {
+			err := validateCSRFToken(r, sig)
+			if err != nil {
+				event := newAuditEvent(sig, "page", r.URL.Path, time.Time{})
+				event.Outcome = AuditOutcomeDenied
+				event.Query = err.Error()
+				recordAudit(event)
+
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		// Transparently upgrade signatures made with an older scheme or key
+		if SigCheck && needsResigning(v) {
+			putSignatureInCookies(w, r, resign(getBaseURL(r), v))
+		}
+
 		if !DatabaseLoaded {
 			page := "home.html"
 			for _, navName := range OrderNav {
@@ -593,6 +737,10 @@ func enforceSigning(next http.Handler) http.Handler {
 					canDo = true
 				}
 				if SigCheck && !canDo {
+					event := newAuditEvent(sig, "page", nav.Name, time.Time{})
+					event.Outcome = AuditOutcomeDenied
+					recordAudit(event)
+
 					pageVars = genPageNav(nav.Name, sig)
 					pageVars.Title = "This feature is BANned"
 					pageVars.ErrorMessage = ErrMsgPlus
@@ -639,6 +787,8 @@ func recoverPanic(r *http.Request, w http.ResponseWriter) {
 
 func getValuesForTier(tierTitle string) url.Values {
 	v := url.Values{}
+	aclMutex.RLock()
+	defer aclMutex.RUnlock()
 	tier, found := Config.ACL[tierTitle]
 	if !found {
 		return v
@@ -661,20 +811,21 @@ func getValuesForTier(tierTitle string) url.Values {
 	return v
 }
 
-func sign(link string, tierTitle string, userData *PatreonUserData) string {
+func sign(link string, tierTitle string, identity *AuthIdentity) string {
 	v := getValuesForTier(tierTitle)
-	if userData != nil {
-		v.Set("UserName", userData.FullName)
-		v.Set("UserEmail", userData.Email)
+	if identity != nil {
+		v.Set("UserName", identity.Name)
+		v.Set("UserEmail", identity.Email)
 		v.Set("UserTier", tierTitle)
 	}
 
+	v.Set("Issued", fmt.Sprintf("%d", time.Now().Unix()))
+
 	expires := time.Now().Add(DefaultSignatureDuration)
-	data := fmt.Sprintf("GET%d%s%s", expires.Unix(), link, v.Encode())
-	key := os.Getenv("BAN_SECRET")
-	sig := signHMACSHA1Base64([]byte(key), []byte(data))
+	exp := fmt.Sprintf("%d", expires.Unix())
+	sig := computeSignature(exp, link, v, "")
 
-	v.Set("Expires", fmt.Sprintf("%d", expires.Unix()))
+	v.Set("Expires", exp)
 	v.Set("Signature", sig)
 	str := base64.StdEncoding.EncodeToString([]byte(v.Encode()))
 
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// The data of a logged in user, as returned by an AuthProvider
+type AuthIdentity struct {
+	Name  string
+	Email string
+	Tier  string
+}
+
+// An error carrying the code shown to the user on the home page
+type AuthError struct {
+	Code string
+	Err  error
+}
+
+func (e *AuthError) Error() string {
+	return e.Code + ": " + e.Err.Error()
+}
+
+type AuthProvider interface {
+	// Start the login flow, state is the url to return to once completed
+	Login(w http.ResponseWriter, r *http.Request, state string)
+
+	// Complete the login flow from the /auth endpoint, returning the identity
+	// of the user and the url to redirect to
+	Authenticate(w http.ResponseWriter, r *http.Request) (*AuthIdentity, string, error)
+}
+
+var AuthProviders = map[string]AuthProvider{
+	"patreon": &patreonProvider{},
+	"oidc":    &oidcProvider{},
+	"local":   &localProvider{},
+	"header":  &headerProvider{},
+}
+
+func getAuthProvider() AuthProvider {
+	provider, found := AuthProviders[Config.Auth.Provider]
+	if !found {
+		return AuthProviders["patreon"]
+	}
+	return provider
+}
+
+// Return the tier associated to the first value found in tierMap
+func mapTier(values []string, tierMap map[string]string, defaultTier string) string {
+	for _, value := range values {
+		tier, found := tierMap[value]
+		if found {
+			return tier
+		}
+	}
+	return defaultTier
+}
+
+type patreonProvider struct{}
+
+func (p *patreonProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", PatreonClientId)
+	redirectURI := PatreonHost
+	if redirectURI == "" {
+		redirectURI = getBaseURL(r) + "/auth"
+	}
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", "identity identity[email] campaigns campaigns.members")
+	v.Set("state", state)
+	http.Redirect(w, r, "https://www.patreon.com/oauth2/authorize?"+v.Encode(), http.StatusFound)
+}
+
+func (p *patreonProvider) Authenticate(w http.ResponseWriter, r *http.Request) (*AuthIdentity, string, error) {
+	baseURL := getBaseURL(r)
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, "", &AuthError{Err: errors.New("missing code")}
+	}
+
+	token, err := getUserToken(code, baseURL, r.FormValue("state"))
+	if err != nil {
+		return nil, "", &AuthError{Code: "TokenNotFound", Err: err}
+	}
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	tc := oauth2.NewClient(r.Context(), ts)
+
+	userData, err := getUserIds(tc)
+	if err != nil {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: err}
+	}
+
+	tierTitle := ""
+	invite, found := Config.Patreon.Emails[userData.Email]
+	if found {
+		tierTitle = invite
+	}
+
+	if tierTitle == "" {
+		for _, userId := range userData.UserIds[1:] {
+			foundTitle, _ := getUserTier(tc, userId)
+			switch foundTitle {
+			case "PIONEER", "PIONEER (Early Adopters)":
+				tierTitle = "Pioneer"
+			case "MODERN", "MODERN (Early Adopters)":
+				tierTitle = "Modern"
+			case "LEGACY", "LEGACY (Early Adopters)":
+				tierTitle = "Legacy"
+			case "VINTAGE", "VINTAGE (Early Adopters)":
+				tierTitle = "Vintage"
+			case "Test Role":
+				tierTitle = "Test Role"
+			}
+		}
+	}
+
+	return &AuthIdentity{
+		Name:  userData.FullName,
+		Email: userData.Email,
+		Tier:  tierTitle,
+	}, r.FormValue("state"), nil
+}
+
+// Generic OpenID Connect provider, the identity is retrieved from the
+// userinfo endpoint, and the tier is derived from one of its claims
+type oidcProvider struct{}
+
+const oidcStateCookie = "MTGBAN_OIDC"
+
+func (p *oidcProvider) config(r *http.Request) *oauth2.Config {
+	scopes := Config.Auth.OIDC.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	return &oauth2.Config{
+		ClientID:     Config.Auth.OIDC.ClientId,
+		ClientSecret: Config.Auth.OIDC.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  Config.Auth.OIDC.AuthURL,
+			TokenURL: Config.Auth.OIDC.TokenURL,
+		},
+		RedirectURL: getBaseURL(r) + "/auth",
+		Scopes:      scopes,
+	}
+}
+
+func (p *oidcProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	// Bind the flow to this browser, the state returned must match the cookie
+	nonce := newAPIKeyId()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    nonce,
+		Path:     "/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, p.config(r).AuthCodeURL(nonce+"|"+state), http.StatusFound)
+}
+
+func (p *oidcProvider) Authenticate(w http.ResponseWriter, r *http.Request) (*AuthIdentity, string, error) {
+	nonce, redir, _ := strings.Cut(r.FormValue("state"), "|")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || !hmac.Equal([]byte(cookie.Value), []byte(nonce)) {
+		return nil, "", &AuthError{Code: "TokenNotFound", Err: errors.New("state mismatch")}
+	}
+
+	config := p.config(r)
+	token, err := config.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		return nil, "", &AuthError{Code: "TokenNotFound", Err: err}
+	}
+
+	resp, err := config.Client(r.Context(), token).Get(Config.Auth.OIDC.UserInfoURL)
+	if err != nil {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: fmt.Errorf("userinfo returned %s", resp.Status)}
+	}
+
+	var claims map[string]interface{}
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: err}
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: errors.New("missing email claim")}
+	}
+	name, _ := claims["name"].(string)
+
+	// The claim can be either a single value or a list
+	var values []string
+	switch claim := claims[Config.Auth.OIDC.TierClaim].(type) {
+	case string:
+		values = []string{claim}
+	case []interface{}:
+		for _, value := range claim {
+			str, ok := value.(string)
+			if ok {
+				values = append(values, str)
+			}
+		}
+	}
+
+	return &AuthIdentity{
+		Name:  name,
+		Email: strings.ToLower(email),
+		Tier:  mapTier(values, Config.Auth.OIDC.TierMap, Config.Auth.OIDC.DefaultTier),
+	}, redir, nil
+}
+
+// Local accounts with bcrypt hashed passwords, as listed in the config file
+type localProvider struct{}
+
+const localLoginCookie = "MTGBAN_LOGIN"
+
+func (p *localProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	// There is no session yet, so bind the form to a cookie instead
+	token := newAPIKeyId()
+	http.SetCookie(w, &http.Cookie{
+		Name:     localLoginCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	pageVars := genPageNav("Login", "")
+	pageVars.LocalLogin = true
+	pageVars.LoginState = state
+	pageVars.CSRFToken = token
+
+	render(w, "home.html", pageVars)
+}
+
+func (p *localProvider) Authenticate(w http.ResponseWriter, r *http.Request) (*AuthIdentity, string, error) {
+	if r.Method != http.MethodPost {
+		return nil, "", &AuthError{Err: errors.New("login needs to be POSTed")}
+	}
+
+	// Slow down password guessing
+	ip, err := IpAddress(r)
+	if err != nil {
+		return nil, "", &AuthError{Code: "LoginFailed", Err: err}
+	}
+	res := LoginRateLimiter.allow(ip.String(), "")
+	if !res.Allowed {
+		setRateLimitHeaders(w, res)
+		return nil, "", &AuthError{Code: "TooManyRequests", Err: errors.New("too many login attempts from " + ip.String())}
+	}
+
+	cookie, err := r.Cookie(localLoginCookie)
+	if err != nil || !hmac.Equal([]byte(cookie.Value), []byte(r.PostFormValue(CSRFFieldName))) {
+		return nil, "", &AuthError{Code: "TokenNotFound", Err: ErrInvalidCSRFToken}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:    localLoginCookie,
+		Path:    "/",
+		Expires: time.Now(),
+	})
+
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	password := r.FormValue("password")
+
+	account, found := Config.Auth.Local.Users[email]
+	if !found {
+		return nil, "", &AuthError{Code: "LoginFailed", Err: errors.New("unknown account " + email)}
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password))
+	if err != nil {
+		return nil, "", &AuthError{Code: "LoginFailed", Err: err}
+	}
+
+	return &AuthIdentity{
+		Name:  account.Name,
+		Email: email,
+		Tier:  account.Tier,
+	}, r.FormValue("state"), nil
+}
+
+// Trust the identity set by an authenticating reverse proxy
+type headerProvider struct{}
+
+// The headers can be trusted only if there is a way to tell that the request
+// went through the proxy, either a shared secret or a list of proxy addresses
+func headerProviderSecured() bool {
+	opts := Config.Auth.Header
+	hasSecret := opts.SecretHeader != "" && opts.Secret != ""
+	return hasSecret || len(Config.TrustedProxies) != 0
+}
+
+// Refuse configurations that would let anybody log in as any user
+func validateAuthConfig() error {
+	switch Config.Auth.Provider {
+	case "header":
+		if Config.Auth.Header.SecretHeader != "" && Config.Auth.Header.Secret == "" {
+			return errors.New("header auth: secret_header is set but secret is empty")
+		}
+		if !headerProviderSecured() {
+			return errors.New("header auth needs either a secret or trusted_proxies")
+		}
+	}
+	return nil
+}
+
+func (p *headerProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	v := url.Values{}
+	v.Set("state", state)
+	http.Redirect(w, r, "/auth?"+v.Encode(), http.StatusFound)
+}
+
+func (p *headerProvider) Authenticate(w http.ResponseWriter, r *http.Request) (*AuthIdentity, string, error) {
+	opts := Config.Auth.Header
+
+	// Make sure the request went through the proxy, by checking the shared
+	// secret and the address it came from, whichever are configured
+	if !headerProviderSecured() {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: errors.New("header provider not secured")}
+	}
+	if opts.SecretHeader != "" {
+		secret := r.Header.Get(opts.SecretHeader)
+		if !hmac.Equal([]byte(secret), []byte(opts.Secret)) {
+			return nil, "", &AuthError{Code: "UserNotFound", Err: errors.New("invalid proxy secret")}
+		}
+	}
+	if len(Config.TrustedProxies) != 0 && !ipInNets(parseHostIP(r.RemoteAddr), trustedProxies) {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: errors.New("request not from a trusted proxy")}
+	}
+
+	email := strings.ToLower(r.Header.Get(opts.EmailHeader))
+	if email == "" {
+		return nil, "", &AuthError{Code: "UserNotFound", Err: errors.New("missing email header")}
+	}
+
+	var groups []string
+	if opts.GroupsHeader != "" {
+		for _, group := range strings.Split(r.Header.Get(opts.GroupsHeader), ",") {
+			groups = append(groups, strings.TrimSpace(group))
+		}
+	}
+
+	return &AuthIdentity{
+		Name:  r.Header.Get(opts.UserHeader),
+		Email: email,
+		Tier:  mapTier(groups, opts.TierMap, opts.DefaultTier),
+	}, r.FormValue("state"), nil
+}
+
+// Start the login flow of the configured provider
+func Login(w http.ResponseWriter, r *http.Request) {
+	getAuthProvider().Login(w, r, r.FormValue("state"))
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ValidateAuthConfigTests = []struct {
+	Name           string
+	Provider       string
+	SecretHeader   string
+	Secret         string
+	TrustedProxies []string
+	Valid          bool
+}{
+	{
+		Name:  "default provider",
+		Valid: true,
+	},
+	{
+		Name:     "header without any protection",
+		Provider: "header",
+	},
+	{
+		Name:         "header with an empty secret",
+		Provider:     "header",
+		SecretHeader: "X-Proxy-Secret",
+	},
+	{
+		Name:         "header with a secret",
+		Provider:     "header",
+		SecretHeader: "X-Proxy-Secret",
+		Secret:       "proxysecret",
+		Valid:        true,
+	},
+	{
+		Name:           "header with trusted proxies",
+		Provider:       "header",
+		TrustedProxies: []string{"10.0.0.1"},
+		Valid:          true,
+	},
+}
+
+// Auth tests change the global configuration, so they cannot be parallel
+func TestValidateAuthConfig(t *testing.T) {
+	old := Config
+	defer func() {
+		Config = old
+	}()
+
+	for _, test := range ValidateAuthConfigTests {
+		t.Run(test.Name, func(t *testing.T) {
+			Config.Auth.Provider = test.Provider
+			Config.Auth.Header.SecretHeader = test.SecretHeader
+			Config.Auth.Header.Secret = test.Secret
+			Config.TrustedProxies = test.TrustedProxies
+
+			err := validateAuthConfig()
+			if (err == nil) != test.Valid {
+				t.Errorf("FAIL: Expected valid %v, got '%v'", test.Valid, err)
+			}
+		})
+	}
+}
+
+var HeaderProviderTests = []struct {
+	Name           string
+	Secret         string
+	TrustedProxies []string
+
+	RemoteAddr    string
+	RequestSecret string
+	Email         string
+
+	// Empty if the identity is expected to be accepted
+	ErrorCode string
+}{
+	{
+		Name:       "not secured",
+		RemoteAddr: "10.0.0.1:1234",
+		Email:      "user@example.com",
+		ErrorCode:  "UserNotFound",
+	},
+	{
+		Name:          "valid secret",
+		Secret:        "proxysecret",
+		RemoteAddr:    "192.0.2.1:1234",
+		RequestSecret: "proxysecret",
+		Email:         "User@Example.com",
+	},
+	{
+		Name:          "wrong secret",
+		Secret:        "proxysecret",
+		RemoteAddr:    "192.0.2.1:1234",
+		RequestSecret: "guess",
+		Email:         "user@example.com",
+		ErrorCode:     "UserNotFound",
+	},
+	{
+		Name:       "missing secret",
+		Secret:     "proxysecret",
+		RemoteAddr: "192.0.2.1:1234",
+		Email:      "user@example.com",
+		ErrorCode:  "UserNotFound",
+	},
+	{
+		Name:           "trusted proxy",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		RemoteAddr:     "10.0.0.1:1234",
+		Email:          "user@example.com",
+	},
+	{
+		Name:           "untrusted proxy",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		RemoteAddr:     "192.0.2.1:1234",
+		Email:          "user@example.com",
+		ErrorCode:      "UserNotFound",
+	},
+	{
+		Name:           "valid secret from an untrusted proxy",
+		Secret:         "proxysecret",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		RemoteAddr:     "192.0.2.1:1234",
+		RequestSecret:  "proxysecret",
+		Email:          "user@example.com",
+		ErrorCode:      "UserNotFound",
+	},
+	{
+		Name:           "missing email",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		RemoteAddr:     "10.0.0.1:1234",
+		ErrorCode:      "UserNotFound",
+	},
+}
+
+func TestHeaderProvider(t *testing.T) {
+	old := Config
+	oldProxies := trustedProxies
+	defer func() {
+		Config = old
+		trustedProxies = oldProxies
+	}()
+
+	Config.Auth.Header.EmailHeader = "X-Auth-Email"
+	Config.Auth.Header.UserHeader = "X-Auth-User"
+	Config.Auth.Header.DefaultTier = "Free"
+
+	provider := &headerProvider{}
+	for _, test := range HeaderProviderTests {
+		t.Run(test.Name, func(t *testing.T) {
+			Config.Auth.Header.SecretHeader = ""
+			Config.Auth.Header.Secret = test.Secret
+			if test.Secret != "" {
+				Config.Auth.Header.SecretHeader = "X-Proxy-Secret"
+			}
+			Config.TrustedProxies = test.TrustedProxies
+			err := loadTrustedProxies()
+			if err != nil {
+				t.Fatalf("FAIL: Unable to load proxies: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+			req.RemoteAddr = test.RemoteAddr
+			if test.RequestSecret != "" {
+				req.Header.Set("X-Proxy-Secret", test.RequestSecret)
+			}
+			if test.Email != "" {
+				req.Header.Set("X-Auth-Email", test.Email)
+				req.Header.Set("X-Auth-User", "User")
+			}
+
+			identity, _, err := provider.Authenticate(httptest.NewRecorder(), req)
+			if test.ErrorCode != "" {
+				var authErr *AuthError
+				if !errors.As(err, &authErr) || authErr.Code != test.ErrorCode {
+					t.Fatalf("FAIL: Expected error code %s, got '%v'", test.ErrorCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FAIL: Unexpected error: %s", err)
+			}
+			if identity.Email != strings.ToLower(test.Email) || identity.Tier != "Free" {
+				t.Errorf("FAIL: Unexpected identity %+v", identity)
+			}
+		})
+	}
+}
+
+var LocalLoginTests = []struct {
+	Name     string
+	Method   string
+	Cookie   string
+	Token    string
+	Password string
+
+	// Empty if the identity is expected to be accepted
+	ErrorCode string
+}{
+	{
+		Name:     "not posted",
+		Method:   http.MethodGet,
+		Cookie:   "logintoken",
+		Token:    "logintoken",
+		Password: "hunter2",
+	},
+	{
+		Name:      "missing cookie",
+		Method:    http.MethodPost,
+		Token:     "logintoken",
+		Password:  "hunter2",
+		ErrorCode: "TokenNotFound",
+	},
+	{
+		Name:      "missing token",
+		Method:    http.MethodPost,
+		Cookie:    "logintoken",
+		Password:  "hunter2",
+		ErrorCode: "TokenNotFound",
+	},
+	{
+		Name:      "mismatched token",
+		Method:    http.MethodPost,
+		Cookie:    "logintoken",
+		Token:     "othertoken",
+		Password:  "hunter2",
+		ErrorCode: "TokenNotFound",
+	},
+	{
+		Name:      "wrong password",
+		Method:    http.MethodPost,
+		Cookie:    "logintoken",
+		Token:     "logintoken",
+		Password:  "hunter3",
+		ErrorCode: "LoginFailed",
+	},
+	{
+		Name:     "valid login",
+		Method:   http.MethodPost,
+		Cookie:   "logintoken",
+		Token:    "logintoken",
+		Password: "hunter2",
+	},
+}
+
+// Set up a single local account with the given password
+func setupLocalAccount(t *testing.T, password string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to hash password: %s", err)
+	}
+	users := map[string]interface{}{
+		"users": map[string]interface{}{
+			"user@example.com": map[string]string{
+				"name":          "User",
+				"tier":          "Pioneer",
+				"password_hash": string(hash),
+			},
+		},
+	}
+	data, _ := json.Marshal(users)
+	err = json.Unmarshal(data, &Config.Auth.Local)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to set up accounts: %s", err)
+	}
+}
+
+func newLocalLoginRequest(method, addr, cookie, token, password string) *http.Request {
+	form := url.Values{}
+	form.Set("email", " User@Example.com ")
+	form.Set("password", password)
+	if token != "" {
+		form.Set(CSRFFieldName, token)
+	}
+	req := httptest.NewRequest(method, "/auth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = addr
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: localLoginCookie, Value: cookie})
+	}
+	return req
+}
+
+func TestLocalLogin(t *testing.T) {
+	old := Config
+	oldLimiter := LoginRateLimiter
+	defer func() {
+		Config = old
+		LoginRateLimiter = oldLimiter
+	}()
+	setupLocalAccount(t, "hunter2")
+
+	provider := &localProvider{}
+	for i, test := range LocalLoginTests {
+		t.Run(test.Name, func(t *testing.T) {
+			LoginRateLimiter = &rateLimiter{
+				name:     "login",
+				rate:     LoginRequestsPerSec,
+				burst:    LoginBurst,
+				visitors: map[string]*visitor{},
+			}
+			addr := fmt.Sprintf("192.0.2.%d:1234", i+1)
+			req := newLocalLoginRequest(test.Method, addr, test.Cookie, test.Token, test.Password)
+
+			identity, _, err := provider.Authenticate(httptest.NewRecorder(), req)
+			if test.Method != http.MethodPost {
+				if err == nil {
+					t.Fatalf("FAIL: Expected an error for a %s request", test.Method)
+				}
+				return
+			}
+			if test.ErrorCode != "" {
+				var authErr *AuthError
+				if !errors.As(err, &authErr) || authErr.Code != test.ErrorCode {
+					t.Fatalf("FAIL: Expected error code %s, got '%v'", test.ErrorCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FAIL: Unexpected error: %s", err)
+			}
+			if identity.Email != "user@example.com" || identity.Tier != "Pioneer" {
+				t.Errorf("FAIL: Unexpected identity %+v", identity)
+			}
+		})
+	}
+}
+
+func TestLocalLoginRateLimit(t *testing.T) {
+	old := Config
+	oldLimiter := LoginRateLimiter
+	defer func() {
+		Config = old
+		LoginRateLimiter = oldLimiter
+	}()
+	setupLocalAccount(t, "hunter2")
+	LoginRateLimiter = &rateLimiter{
+		name:     "login",
+		rate:     LoginRequestsPerSec,
+		burst:    LoginBurst,
+		visitors: map[string]*visitor{},
+	}
+
+	provider := &localProvider{}
+	for i := 0; i < LoginBurst; i++ {
+		req := newLocalLoginRequest(http.MethodPost, "192.0.2.1:1234", "logintoken", "logintoken", "guess")
+		_, _, err := provider.Authenticate(httptest.NewRecorder(), req)
+		var authErr *AuthError
+		if !errors.As(err, &authErr) || authErr.Code != "LoginFailed" {
+			t.Fatalf("FAIL: Expected attempt %d to fail the login, got '%v'", i, err)
+		}
+	}
+
+	// Even the right password is refused once the limit is hit
+	w := httptest.NewRecorder()
+	req := newLocalLoginRequest(http.MethodPost, "192.0.2.1:1234", "logintoken", "logintoken", "hunter2")
+	_, _, err := provider.Authenticate(w, req)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.Code != "TooManyRequests" {
+		t.Fatalf("FAIL: Expected the attempt to be rate limited, got '%v'", err)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("FAIL: Expected a Retry-After header")
+	}
+
+	// Other addresses are not affected
+	req = newLocalLoginRequest(http.MethodPost, "192.0.2.2:1234", "logintoken", "logintoken", "hunter2")
+	_, _, err = provider.Authenticate(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Errorf("FAIL: Expected a different address to log in, got '%v'", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+	"github.com/mtgban/go-mtgban/mtgmatcher/mtgjson"
+	"golang.org/x/exp/slices"
+)
+
+// Gameplay attributes of a card that mtgmatcher does not keep around,
+// shared by all the printings of the same card
+type cardExtra struct {
+	// Oracle text, in lowercase, of all the faces of the card
+	Text string
+
+	ManaValue float64
+
+	// Kept as strings since they may contain symbols like '*'
+	Power     string
+	Toughness string
+
+	// Lowercase keywords of all faces
+	Keywords []string
+
+	// Lowercase formats where the card is legal or restricted
+	Legal []string
+}
+
+var cardExtrasMutex sync.RWMutex
+var cardExtras = map[string]*cardExtra{}
+
+// A printing together with the fields that mtgjson.Card does not decode
+type printingWithExtras struct {
+	mtgjson.Card
+	Text       string            `json:"text"`
+	ManaValue  float64           `json:"manaValue"`
+	Power      string            `json:"power"`
+	Toughness  string            `json:"toughness"`
+	Keywords   []string          `json:"keywords"`
+	Legalities map[string]string `json:"legalities"`
+}
+
+// The cards of the set shadow the ones of the embedded mtgjson.Set
+type setWithExtras struct {
+	mtgjson.Set
+	Cards []printingWithExtras `json:"cards"`
+}
+
+type allPrintingsWithExtras struct {
+	mtgjson.AllPrintings
+	Data map[string]*setWithExtras `json:"data"`
+}
+
+// Decode the AllPrintings file once, returning what mtgmatcher needs to
+// build its datastore and the fields needed by the gameplay filters
+func loadAllPrintings(r io.Reader) (mtgjson.AllPrintings, map[string]*cardExtra, error) {
+	var payload allPrintingsWithExtras
+	err := json.NewDecoder(r).Decode(&payload)
+	if err != nil {
+		return mtgjson.AllPrintings{}, nil, err
+	}
+	if len(payload.Data) == 0 {
+		return mtgjson.AllPrintings{}, nil, errors.New("empty AllPrintings file")
+	}
+
+	allPrintings := payload.AllPrintings
+	allPrintings.Data = map[string]*mtgjson.Set{}
+
+	extras := map[string]*cardExtra{}
+	for code, set := range payload.Data {
+		cards := make([]mtgjson.Card, 0, len(set.Cards))
+		for _, card := range set.Cards {
+			cards = append(cards, card.Card)
+			addCardExtra(extras, &card)
+		}
+		set.Set.Cards = cards
+		allPrintings.Data[code] = &set.Set
+	}
+
+	return allPrintings, extras, nil
+}
+
+func addCardExtra(extras map[string]*cardExtra, card *printingWithExtras) {
+	extra, found := extras[card.Name]
+	if !found {
+		extra = &cardExtra{
+			ManaValue: card.ManaValue,
+		}
+		for format, status := range card.Legalities {
+			switch status {
+			case "Legal", "Restricted":
+				extra.Legal = append(extra.Legal, strings.ToLower(format))
+			}
+		}
+		extras[card.Name] = extra
+	}
+
+	// Every printing carries the same gameplay data, so only the
+	// faces that were not seen yet need to be added
+	text := strings.ToLower(card.Text)
+	if text != "" && !strings.Contains(extra.Text, text) {
+		if extra.Text != "" {
+			extra.Text += "\n"
+		}
+		extra.Text += text
+	}
+	if extra.Power == "" && (card.Side == "" || card.Side == "a") {
+		extra.Power = card.Power
+		extra.Toughness = card.Toughness
+	}
+	for _, keyword := range card.Keywords {
+		keyword = strings.ToLower(keyword)
+		if !slices.Contains(extra.Keywords, keyword) {
+			extra.Keywords = append(extra.Keywords, keyword)
+		}
+	}
+}
+
+func setCardExtras(extras map[string]*cardExtra) {
+	cardExtrasMutex.Lock()
+	cardExtras = extras
+	cardExtrasMutex.Unlock()
+}
+
+func getCardExtra(co *mtgmatcher.CardObject) *cardExtra {
+	cardExtrasMutex.RLock()
+	defer cardExtrasMutex.RUnlock()
+	return cardExtras[co.Name]
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const cardExtrasTestData = `{"meta": {"version": "5.2.2"}, "data": {"TST": {"code": "TST", "name": "Test Set", "cards": [
+	{"name": "Front // Back", "side": "a", "uuid": "uuid-a", "text": "Flying", "manaValue": 3, "power": "2", "toughness": "*", "keywords": ["Flying"], "legalities": {"modern": "Legal", "legacy": "Banned"}},
+	{"name": "Front // Back", "side": "b", "uuid": "uuid-b", "text": "Trample", "power": "5", "toughness": "5", "keywords": ["Trample"]}
+]}}}`
+
+// A single decode returns both the printings and their gameplay fields
+func TestLoadAllPrintings(t *testing.T) {
+	allPrintings, extras, err := loadAllPrintings(strings.NewReader(cardExtrasTestData))
+	if err != nil {
+		t.Fatalf("FAIL: Unexpected error: %s", err)
+	}
+
+	set, found := allPrintings.Data["TST"]
+	if !found || set.Name != "Test Set" || len(set.Cards) != 2 {
+		t.Fatalf("FAIL: Unexpected set %+v", set)
+	}
+	if set.Cards[1].UUID != "uuid-b" || set.Cards[1].Side != "b" {
+		t.Errorf("FAIL: Unexpected card %+v", set.Cards[1])
+	}
+	if allPrintings.Meta.Version != "5.2.2" {
+		t.Errorf("FAIL: Expected the meta to be kept, got %+v", allPrintings.Meta)
+	}
+
+	extra := extras["Front // Back"]
+	if extra == nil {
+		t.Fatalf("FAIL: Missing card extras")
+	}
+	if extra.Text != "flying\ntrample" {
+		t.Errorf("FAIL: Expected the text of both faces, got %q", extra.Text)
+	}
+	if extra.ManaValue != 3 || extra.Power != "2" || extra.Toughness != "*" {
+		t.Errorf("FAIL: Expected the stats of the front face, got %+v", extra)
+	}
+	if strings.Join(extra.Keywords, ",") != "flying,trample" {
+		t.Errorf("FAIL: Unexpected keywords %q", extra.Keywords)
+	}
+	if strings.Join(extra.Legal, ",") != "modern" {
+		t.Errorf("FAIL: Unexpected legalities %q", extra.Legal)
+	}
+
+	_, _, err = loadAllPrintings(strings.NewReader(`{"data": {}}`))
+	if err == nil {
+		t.Errorf("FAIL: Expected an error for an empty file")
+	}
+}
@@ -127,9 +127,14 @@ func getDateAxisValues(cardId string) ([]string, error) {
 	return keys, nil
 }
 
-func getDataset(cardId string, labels []string, config scraperConfig) (*Dataset, error) {
+// Get all the date/price pairs stored for the given card
+func getDatasetValues(cardId string, config scraperConfig) (map[string]string, error) {
 	db := ScraperOptions[config.ScraperName].RDBs[config.KindName]
-	results, err := db.HGetAll(context.Background(), cardId).Result()
+	return db.HGetAll(context.Background(), cardId).Result()
+}
+
+func getDataset(cardId string, labels []string, config scraperConfig) (*Dataset, error) {
+	results, err := getDatasetValues(cardId, config)
 	if err != nil {
 		return nil, err
 	}
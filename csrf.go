@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	CSRFFieldName  = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+var ErrInvalidCSRFToken = errors.New("invalid csrf token")
+
+// Derive the token from the user and the expiration of the signature, so that
+// it is unique per login and survives the signature being upgraded
+func csrfToken(sig string) string {
+	data := "csrf|" + GetParamFromSig(sig, "UserEmail") + "|" + GetParamFromSig(sig, "Expires")
+	h := hmac.New(sha256.New, []byte(os.Getenv("BAN_SECRET")))
+	h.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func getCSRFToken(r *http.Request) string {
+	token := r.Header.Get(CSRFHeaderName)
+	if token != "" {
+		return token
+	}
+	// Make sure that large uploads are parsed with the expected limits
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.ParseMultipartForm(MaxUploadFileSize)
+	}
+	return r.PostFormValue(CSRFFieldName)
+}
+
+func validateCSRFToken(r *http.Request, sig string) error {
+	token := getCSRFToken(r)
+	if token == "" || !hmac.Equal([]byte(token), []byte(csrfToken(sig))) {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
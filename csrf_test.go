@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFTokenDerivation(t *testing.T) {
+	t.Setenv("BAN_SECRET", "bansecret")
+
+	sig := encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "Expires": {"1700000000"}})
+	token := csrfToken(sig)
+	if token == "" {
+		t.Fatalf("FAIL: Expected a token")
+	}
+	if csrfToken(sig) != token {
+		t.Errorf("FAIL: Expected the token to be stable for the same signature")
+	}
+	if csrfToken(encodeTestSig(url.Values{"UserEmail": {"other@example.com"}, "Expires": {"1700000000"}})) == token {
+		t.Errorf("FAIL: Expected a different token for a different user")
+	}
+	if csrfToken(encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "Expires": {"1800000000"}})) == token {
+		t.Errorf("FAIL: Expected a different token for a different login")
+	}
+
+	t.Setenv("BAN_SECRET", "othersecret")
+	if csrfToken(sig) == token {
+		t.Errorf("FAIL: Expected a different token for a different secret")
+	}
+}
+
+var CSRFRequestTests = []struct {
+	Name     string
+	Header   string
+	Form     string
+	Upload   string
+	Expected error
+}{
+	{
+		Name:     "missing",
+		Expected: ErrInvalidCSRFToken,
+	},
+	{
+		Name:   "header",
+		Header: "valid",
+	},
+	{
+		Name: "form",
+		Form: "valid",
+	},
+	{
+		Name:   "multipart",
+		Upload: "valid",
+	},
+	{
+		Name:     "wrong header",
+		Header:   "wrong",
+		Expected: ErrInvalidCSRFToken,
+	},
+	{
+		Name:     "wrong form",
+		Form:     "wrong",
+		Expected: ErrInvalidCSRFToken,
+	},
+	{
+		Name:     "header takes precedence",
+		Header:   "wrong",
+		Form:     "valid",
+		Expected: ErrInvalidCSRFToken,
+	},
+}
+
+func TestValidateCSRFToken(t *testing.T) {
+	t.Setenv("BAN_SECRET", "bansecret")
+
+	sig := encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "Expires": {"1700000000"}})
+	tokens := map[string]string{
+		"valid": csrfToken(sig),
+		"wrong": csrfToken(encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "Expires": {"1700000001"}})),
+	}
+
+	for _, test := range CSRFRequestTests {
+		t.Run(test.Name, func(t *testing.T) {
+			var req *http.Request
+			if test.Upload != "" {
+				var body bytes.Buffer
+				writer := multipart.NewWriter(&body)
+				writer.WriteField(CSRFFieldName, tokens[test.Upload])
+				part, _ := writer.CreateFormFile("file", "list.csv")
+				part.Write([]byte("Card Name\nLightning Bolt\n"))
+				writer.Close()
+
+				req = httptest.NewRequest(http.MethodPost, "/upload", &body)
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+			} else {
+				form := url.Values{}
+				if test.Form != "" {
+					form.Set(CSRFFieldName, tokens[test.Form])
+				}
+				req = httptest.NewRequest(http.MethodPost, "/admin", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if test.Header != "" {
+				req.Header.Set(CSRFHeaderName, tokens[test.Header])
+			}
+
+			err := validateCSRFToken(req, sig)
+			if err != test.Expected {
+				t.Errorf("FAIL: Expected '%v', got '%v'", test.Expected, err)
+			}
+		})
+	}
+}
@@ -178,6 +178,15 @@ var filteredEditions = []string{
 	"WC99",
 }
 
+// Suggest card names similar to the query, if any
+func didYouMean(query string) string {
+	suggestions := suggestNames(query, false, MaxNameSuggestions)
+	if len(suggestions) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\nDid you mean \"%s\"?", strings.Join(suggestions, "\", \""))
+}
+
 func parseMessage(content string) (*searchResult, string) {
 	// Clean up query, no blocklist because we only need keys
 	config := parseSearchOptionsNG(content, nil, nil)
@@ -218,10 +227,13 @@ func parseMessage(content string) (*searchResult, string) {
 			printings, err := mtgmatcher.Printings4Card(query)
 			if err == nil {
 				msg = fmt.Sprintf("%s\n\"%s\" is printed in %s.", msg, query, printings2line(printings))
+			} else {
+				msg += didYouMean(query)
 			}
 			return nil, msg
 		}
-		return nil, fmt.Sprintf("No card found for \"%s\" 乁| ･ิ ∧ ･ิ |ㄏ", query)
+		msg := fmt.Sprintf("No card found for \"%s\" 乁| ･ิ ∧ ･ิ |ㄏ", query)
+		return nil, msg + didYouMean(query)
 	}
 
 	if len(uuids) == 0 {
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/apache/arrow/go/v12/parquet"
+	"github.com/apache/arrow/go/v12/parquet/compress"
+	"github.com/apache/arrow/go/v12/parquet/pqarrow"
+	"github.com/mtgban/go-mtgban/mtgban"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// Number of rows buffered before being flushed as a row group
+	ExportBatchSize = 100000
+
+	ExportRetailFileName  = "mtgban_retail.parquet"
+	ExportBuylistFileName = "mtgban_buylist.parquet"
+)
+
+var ExportSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "uuid", Type: arrow.BinaryTypes.String},
+	{Name: "store", Type: arrow.BinaryTypes.String},
+	{Name: "kind", Type: arrow.BinaryTypes.String},
+	{Name: "finish", Type: arrow.BinaryTypes.String},
+	{Name: "condition", Type: arrow.BinaryTypes.String},
+	{Name: "price", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "quantity", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "timestamp", Type: arrow.FixedWidthTypes.Timestamp_s},
+}, nil)
+
+// Buffer rows and write them to the parquet file in batches
+type exportWriter struct {
+	builder *array.RecordBuilder
+	writer  *pqarrow.FileWriter
+	rows    int
+}
+
+func newExportWriter(file *os.File) (*exportWriter, error) {
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	writer, err := pqarrow.NewFileWriter(ExportSchema, file, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return nil, err
+	}
+	return &exportWriter{
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, ExportSchema),
+		writer:  writer,
+	}, nil
+}
+
+func (ew *exportWriter) Append(cardId, store, kind, conditions string, price float64, quantity int, ts time.Time) error {
+	ew.builder.Field(0).(*array.StringBuilder).Append(cardId)
+	ew.builder.Field(1).(*array.StringBuilder).Append(store)
+	ew.builder.Field(2).(*array.StringBuilder).Append(kind)
+	ew.builder.Field(3).(*array.StringBuilder).Append(uuid2finish(cardId))
+	ew.builder.Field(4).(*array.StringBuilder).Append(conditions)
+	ew.builder.Field(5).(*array.Float64Builder).Append(price)
+	ew.builder.Field(6).(*array.Int64Builder).Append(int64(quantity))
+	ew.builder.Field(7).(*array.TimestampBuilder).Append(arrow.Timestamp(ts.Unix()))
+
+	ew.rows++
+	if ew.rows%ExportBatchSize == 0 {
+		return ew.flush()
+	}
+	return nil
+}
+
+func (ew *exportWriter) flush() error {
+	record := ew.builder.NewRecord()
+	defer record.Release()
+	if record.NumRows() == 0 {
+		return nil
+	}
+	return ew.writer.Write(record)
+}
+
+func (ew *exportWriter) Close() error {
+	defer ew.builder.Release()
+	err := ew.flush()
+	if err != nil {
+		ew.writer.Close()
+		return err
+	}
+	return ew.writer.Close()
+}
+
+// Write the snapshot to a temporary file, and move it in place only when complete,
+// so that downloads never see a partial file
+func writeExportFile(fname string, fill func(ew *exportWriter) error) error {
+	tmpName := fname + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ew, err := newExportWriter(file)
+	if err != nil {
+		return err
+	}
+	err = fill(ew)
+	if err != nil {
+		ew.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	err = ew.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, fname)
+}
+
+// Copy the global slices, without waiting for any refresh in progress, which
+// only holds the lock while replacing its own entry
+func copyScrapers() ([]mtgban.Seller, []mtgban.Vendor) {
+	scrapersMutex.RLock()
+	defer scrapersMutex.RUnlock()
+
+	sellers := make([]mtgban.Seller, len(Sellers))
+	copy(sellers, Sellers)
+	vendors := make([]mtgban.Vendor, len(Vendors))
+	copy(vendors, Vendors)
+
+	return sellers, vendors
+}
+
+func exportSellers(ew *exportWriter, sellers []mtgban.Seller) error {
+	for _, seller := range sellers {
+		if seller == nil || slices.Contains(Config.SearchRetailBlockList, seller.Info().Shorthand) {
+			continue
+		}
+		inventory, err := seller.Inventory()
+		if err != nil {
+			continue
+		}
+		ts := time.Now()
+		if seller.Info().InventoryTimestamp != nil {
+			ts = *seller.Info().InventoryTimestamp
+		}
+		for cardId, entries := range inventory {
+			for _, entry := range entries {
+				err := ew.Append(cardId, seller.Info().Shorthand, "retail", entry.Conditions, entry.Price, entry.Quantity, ts)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func exportVendors(ew *exportWriter, vendors []mtgban.Vendor) error {
+	for _, vendor := range vendors {
+		if vendor == nil || slices.Contains(Config.SearchBuylistBlockList, vendor.Info().Shorthand) {
+			continue
+		}
+		buylist, err := vendor.Buylist()
+		if err != nil {
+			continue
+		}
+		ts := time.Now()
+		if vendor.Info().BuylistTimestamp != nil {
+			ts = *vendor.Info().BuylistTimestamp
+		}
+		for cardId, entries := range buylist {
+			for _, entry := range entries {
+				err := ew.Append(cardId, vendor.Info().Shorthand, "buylist", entry.Conditions, entry.BuyPrice, entry.Quantity, ts)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Write the latest snapshot in the given directory, and optionally keep a copy
+// in a subdirectory named after the current date
+func exportSnapshot(baseDir, fname string, fill func(ew *exportWriter) error) error {
+	latest := path.Join(baseDir, fname)
+	err := writeExportFile(latest, fill)
+	if err != nil {
+		return err
+	}
+	if !Config.Export.KeepDated {
+		return nil
+	}
+
+	targetDir := path.Join(baseDir, time.Now().Format("2006-01-02"))
+	err = mkDirIfNotExisting(targetDir)
+	if err != nil {
+		return err
+	}
+	target := path.Join(targetDir, fname)
+	os.Remove(target)
+	return os.Link(latest, target)
+}
+
+// Export all prices in columnar format, called after every full refresh
+func exportSnapshots() {
+	if !Config.Export.Enabled {
+		return
+	}
+	defer recoverPanicScraper()
+
+	start := time.Now()
+	sellers, vendors := copyScrapers()
+
+	err := exportSnapshot(InventoryDir, ExportRetailFileName, func(ew *exportWriter) error {
+		return exportSellers(ew, sellers)
+	})
+	if err != nil {
+		ServerNotify("export", "retail: "+err.Error(), true)
+	}
+	err = exportSnapshot(BuylistDir, ExportBuylistFileName, func(ew *exportWriter) error {
+		return exportVendors(ew, vendors)
+	})
+	if err != nil {
+		ServerNotify("export", "buylist: "+err.Error(), true)
+	}
+	ServerNotify("export", fmt.Sprintf("snapshots exported in %v", time.Since(start)))
+}
+
+// Serve the parquet snapshots at /api/mtgban/export/{retail|buylist}.parquet
+// with an optional date=YYYY-MM-DD parameter to retrieve older snapshots
+func ExportAPI(w http.ResponseWriter, r *http.Request) {
+	sig := getAPISignature(r)
+
+	// Snapshots contain every store, so full access is needed
+	if GetParamFromSig(sig, "API") != "ALL_ACCESS" && !(DevMode && !SigCheck) {
+		w.Write([]byte(`{"error": "Not allowed"}`))
+		return
+	}
+
+	kind := strings.TrimSuffix(path.Base(r.URL.Path), ".parquet")
+	canRetail, canBuylist := getAPIEnabledModes(sig)
+
+	var baseDir, fname string
+	switch {
+	case kind == "retail" && canRetail:
+		baseDir = InventoryDir
+		fname = ExportRetailFileName
+	case kind == "buylist" && canBuylist:
+		baseDir = BuylistDir
+		fname = ExportBuylistFileName
+	default:
+		w.Write([]byte(`{"error": "Not found"}`))
+		return
+	}
+
+	date := r.FormValue("date")
+	if date != "" {
+		_, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			w.Write([]byte(`{"error": "Invalid date, use the YYYY-MM-DD format"}`))
+			return
+		}
+		baseDir = path.Join(baseDir, date)
+	}
+
+	filePath := path.Join(baseDir, fname)
+	if !fileExists(filePath) {
+		w.Write([]byte(`{"error": "Not found"}`))
+		return
+	}
+
+	user := GetParamFromSig(sig, "UserEmail")
+	msg := fmt.Sprintf("%s requested the %s parquet export (%s)", user, kind, date)
+	event := newAuditEvent(sig, "api", "ExportAPI", time.Time{})
+	event.Query = kind + " " + date
+	event.Message = msg
+	recordAudit(event)
+
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fname+"\"")
+	http.ServeFile(w, r, filePath)
+}
@@ -14,7 +14,11 @@ func Home(w http.ResponseWriter, r *http.Request) {
 
 	switch errmsg {
 	case "TokenNotFound":
-		message = "There was a problem authenticating you with Patreon."
+		message = "There was a problem authenticating you."
+	case "LoginFailed":
+		message = "Invalid email or password."
+	case "TooManyRequests":
+		message = "Too many login attempts, please try again later."
 	case "UserNotFound", "TierNotFound":
 		message = ErrMsg
 	case "logout":
@@ -32,6 +36,11 @@ func Home(w http.ResponseWriter, r *http.Request) {
 		}
 		http.SetCookie(w, &cookie)
 
+		// And the session it may refer to
+		deleteSession(r)
+		cookie.Name = SessionCookieName
+		http.SetCookie(w, &cookie)
+
 		// Delete signature
 		sig = ""
 	}
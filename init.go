@@ -78,7 +78,17 @@ func loadDatastore() error {
 	}
 	defer allPrintingsReader.Close()
 
-	return mtgmatcher.LoadDatastore(allPrintingsReader)
+	// The gameplay fields are read in the same pass as the datastore
+	allPrintings, extras, err := loadAllPrintings(allPrintingsReader)
+	if err != nil {
+		return err
+	}
+	mtgmatcher.NewDatastore(allPrintings)
+	setCardExtras(extras)
+
+	buildNameIndex()
+
+	return nil
 }
 
 func loadInventoryFromFile(fname string) (mtgban.Seller, error) {
@@ -357,15 +367,17 @@ func untangleMarket(init bool, currentDir string, newbc *mtgban.BanClient, scrap
 				start := time.Now()
 				log.Printf("Stashing %s inventory data to DB", seller.Info().Shorthand)
 				inv, _ := seller.Inventory()
-				key := seller.Info().InventoryTimestamp.Format("2006-01-02")
+				date := seller.Info().InventoryTimestamp.Format("2006-01-02")
 				for uuid, entries := range inv {
-					err = db.HSet(context.Background(), uuid, key, entries[0].Price).Err()
+					err = db.HSet(context.Background(), uuid, date, entries[0].Price).Err()
 					if err != nil {
 						ServerNotify("redis", err.Error())
 						break
 					}
 				}
 				log.Println("Took", time.Since(start))
+
+				go refreshHistoryTrends(key, seller.Info().Shorthand)
 			}
 		}
 
@@ -429,6 +441,11 @@ var DBs = map[string]int{
 	"starcitygames": 6,
 	"abugames":      7,
 	"tcglow_median": 8,
+	"apikeys":       9,
+	"sessions":      10,
+	"ratelimit":     11,
+	"usage":         12,
+	"audit":         13,
 }
 
 var ScraperOptions = map[string]*scraperOption{
@@ -898,12 +915,14 @@ func loadScrapers() {
 	})
 
 	// Allocate enough space for the global pointers
+	scrapersMutex.Lock()
 	if Sellers == nil {
 		Sellers = make([]mtgban.Seller, len(newSellers))
 	}
 	if Vendors == nil {
 		Vendors = make([]mtgban.Vendor, len(newVendors))
 	}
+	scrapersMutex.Unlock()
 
 	updateStaticData()
 
@@ -949,6 +968,14 @@ func loadScrapers() {
 	} else {
 		ServerNotify("refresh", "full refresh completed")
 	}
+
+	// Histories are recomputed as they are stashed, when booting the ones
+	// that were not refreshed need to be loaded too
+	if init {
+		go refreshPriceTrends()
+	}
+
+	go exportSnapshots()
 }
 
 func updateStaticData() {
@@ -1000,7 +1027,9 @@ func loadSellers(newSellers []mtgban.Seller) {
 				log.Println(err)
 				continue
 			}
+			scrapersMutex.Lock()
 			Sellers[i] = seller
+			scrapersMutex.Unlock()
 
 			inv, _ := seller.Inventory()
 			log.Printf("Loaded from file with %d entries", len(inv))
@@ -1052,6 +1081,8 @@ func loadSellers(newSellers []mtgban.Seller) {
 					}
 				}
 				log.Println("Took", time.Since(start))
+
+				go refreshHistoryTrends(ScraperMap[Sellers[i].Info().Shorthand], "retail")
 			}
 
 			err := dumpInventoryToFile(Sellers[i], currentDir, fname)
@@ -1091,7 +1122,9 @@ func loadVendors(newVendors []mtgban.Vendor) {
 				log.Println(err)
 				continue
 			}
+			scrapersMutex.Lock()
 			Vendors[i] = vendor
+			scrapersMutex.Unlock()
 
 			bl, _ := vendor.Buylist()
 			log.Printf("Loaded from file with %d entries", len(bl))
@@ -1129,6 +1162,8 @@ func loadVendors(newVendors []mtgban.Vendor) {
 					}
 				}
 				log.Println("Took", time.Since(start))
+
+				go refreshHistoryTrends(ScraperMap[Vendors[i].Info().Shorthand], "buylist")
 			}
 
 			err := dumpBuylistToFile(Vendors[i], currentDir, fname)
@@ -1,20 +1,38 @@
 /*
  * The autocomplete function takes a form containing an input field.
- * It will load the names to be completed once and create div elemenents
- * containing possible suggestions.
+ * It will query the server for names completing the current input and
+ * create div elemenents containing possible suggestions.
  * If a user scrolls up and down, selects an entry and presses Enter, or
  * clicks on a field, they will be submitting the form automatically.
  */
-async function autocomplete(form, inp) {
+function autocomplete(form, inp, sealed = false) {
     var currentFocus;
     var minlen = 3;
-    const arr = await fetchNames();
+    var timer;
+    var lastRequest = 0;
+
+    /* Ask the server for the names matching the input */
+    async function fetchSuggestions(val) {
+        let params = new URLSearchParams({q: val, sealed: sealed});
+        let response = await fetch("/api/suggest?" + params.toString());
+        /* Rate limited or failed requests just show no suggestions */
+        if (!response.ok) {
+            return [];
+        }
+        let data = await response.json();
+        if (!Array.isArray(data)) {
+            return [];
+        }
+        return data;
+    }
 
     /* Execute a function when someone writes in the text field: */
     inp.addEventListener("input", function(e) {
-        var a, b, i, val = this.value;
+        var val = this.value;
+        var input = this;
         /* Close any already open lists of autocompleted values */
         closeAllLists();
+        clearTimeout(timer);
         if (!val) {
             return false;
         }
@@ -22,49 +40,78 @@ async function autocomplete(form, inp) {
         if (val.length < minlen) {
             return false;
         }
+
+        /* Wait for the user to stop typing before querying */
+        timer = setTimeout(async function() {
+            var requestId = ++lastRequest;
+            var arr;
+            try {
+                arr = await fetchSuggestions(val);
+            } catch (err) {
+                return;
+            }
+            /* Drop any response that arrived out of order */
+            if (requestId != lastRequest || input.value != val) {
+                return;
+            }
+            showSuggestions(input, val, arr);
+        }, 150);
+    });
+
+    function showSuggestions(input, val, arr) {
+        var a, b, i;
+        closeAllLists();
         currentFocus = -1;
         /* Create a DIV element that will contain the items (values) */
         a = document.createElement("DIV");
-        a.setAttribute("id", this.id + "autocomplete-list");
+        a.setAttribute("id", input.id + "autocomplete-list");
         a.setAttribute("class", "autocomplete-items");
 
         /* Append the DIV element as a child of the autocomplete container */
-        this.parentNode.appendChild(a);
+        input.parentNode.appendChild(a);
 
         /* For each item in the array... */
         for (i = 0; i < arr.length; i++) {
-            /* Check if the item starts with the same letters as the text field value */
-            if (arr[i].substr(0, val.length).toUpperCase() == val.toUpperCase() || arr[i].substr(0, val.length).normalize("NFD").replace(/[\u0300-\u036f]/g, "").toUpperCase() == val.toUpperCase()) {
-                /* Create a DIV element for each matching element */
-                b = document.createElement("DIV");
+            /* Create a DIV element for each matching element */
+            b = document.createElement("DIV");
+
+            /* Make the matching letters bold, if the item starts with them */
+            var head = arr[i].substr(0, val.length);
+            if (head.toUpperCase() == val.toUpperCase() || head.normalize("NFD").replace(/[\u0300-\u036f]/g, "").toUpperCase() == val.toUpperCase()) {
+                var strong = document.createElement("STRONG");
+                strong.textContent = head;
+                b.appendChild(strong);
+                b.appendChild(document.createTextNode(arr[i].substr(val.length)));
+            } else {
+                b.appendChild(document.createTextNode(arr[i]));
+            }
 
-                /* Make the matching letters bold */
-                b.innerHTML = "<strong>" + arr[i].substr(0, val.length) + "</strong>";
-                b.innerHTML += arr[i].substr(val.length);
+            /* Insert a input field that will hold the current array item's value */
+            var hidden = document.createElement("INPUT");
+            hidden.type = "hidden";
+            hidden.value = arr[i];
+            b.appendChild(hidden);
 
-                /* Insert a input field that will hold the current array item's value */
-                b.innerHTML += "<input type='hidden' value='" + arr[i].replace("'", "&apos;").replace("\"", "&quot;") + "'>";
-                /* Execute a function when someone clicks on the item value (DIV element) */
-                b.addEventListener("click", function(e) {
-                    /* Insert the value for the autocomplete text field */
-                    inp.value = this.getElementsByTagName("input")[0].value;
-                    /* Close the list of autocompleted values,
-                     * (or any other open lists of autocompleted values */
-                    closeAllLists();
+            /* Execute a function when someone clicks on the item value (DIV element) */
+            b.addEventListener("click", function(e) {
+                /* Insert the value for the autocomplete text field */
+                inp.value = this.getElementsByTagName("input")[0].value;
+                /* Close the list of autocompleted values,
+                 * (or any other open lists of autocompleted values */
+                closeAllLists();
 
-                    /* Submit the form (so that onSubmit may trigger) */
-                    /* We need to use this extended workaround due to Safari */
-                    const fakeButton = document.createElement('button');
-                    fakeButton.type = this.type;
-                    fakeButton.style.display = 'none';
-                    form.appendChild(fakeButton);
-                    fakeButton.click();
-                    fakeButton.remove();
-                });
-                a.appendChild(b);
-            }
+                /* Submit the form (so that onSubmit may trigger) */
+                /* We need to use this extended workaround due to Safari */
+                const fakeButton = document.createElement('button');
+                fakeButton.type = this.type;
+                fakeButton.style.display = 'none';
+                form.appendChild(fakeButton);
+                fakeButton.click();
+                fakeButton.remove();
+            });
+            a.appendChild(b);
         }
-    });
+    }
 
     /* Execute a function presses a key on the keyboard */
     inp.addEventListener("keydown", function(e) {
@@ -138,8 +138,10 @@ func loadScrapersNG() error {
 			log.Printf("-- OK: %d entries", len(bl))
 			vendors = append(vendors, vendor)
 		}
+		scrapersMutex.Lock()
 		Sellers = sellers
 		Vendors = vendors
+		scrapersMutex.Unlock()
 
 		log.Printf("Loaded %d sellers and %d vendors from cache", len(sellers), len(vendors))
 	}
@@ -167,7 +169,9 @@ func refreshSellerCache() {
 		ServerNotify("refresh", fmt.Sprintf("unable to refresh sellers: %v", err))
 		return
 	}
+	scrapersMutex.Lock()
 	Sellers = sellers
+	scrapersMutex.Unlock()
 
 	log.Printf("Loaded %d sellers from the cloud", len(sellers))
 }
@@ -222,7 +226,9 @@ func refreshVendorCache() {
 		ServerNotify("refresh", fmt.Sprintf("unable to refresh vendors: %v", err))
 		return
 	}
+	scrapersMutex.Lock()
 	Vendors = vendors
+	scrapersMutex.Unlock()
 
 	log.Printf("Loaded %d vendors from the cloud", len(vendors))
 }
@@ -15,6 +15,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -42,6 +43,10 @@ type PageVars struct {
 	PatreonLogin bool
 	ShowPromo    bool
 
+	LocalLogin bool
+	LoginState string
+	CSRFToken  string
+
 	Title          string
 	ErrorMessage   string
 	WarningMessage string
@@ -62,6 +67,11 @@ type PageVars struct {
 	CanShowAll       bool
 	CleanSearchQuery string
 
+	SearchWarnings []string
+	ExplainMode    bool
+	SearchExplain  []ExplainStage
+	Suggestions    []NameSuggestion
+
 	ScraperShort   string
 	HasAffiliate   bool
 	CanDownloadCSV bool
@@ -120,7 +130,16 @@ type PageVars struct {
 	LatestHash   string
 	CacheSize    int
 	Tiers        []string
+	TierACLs     []string
+	ACLPages     []string
+	ACLOptions   []string
 	DemoKey      string
+	APIKeys      []APIKeyRecord
+	Sessions     []Session
+	Usage        []UsageRecord
+	AuditEvents  []AuditEvent
+	AuditPages   []string
+	AuditFilter  AuditFilter
 
 	AxisLabels  []string
 	Datasets    []*Dataset
@@ -206,10 +225,12 @@ var OptionalFields = []string{
 	"UserName",
 	"UserEmail",
 	"UserTier",
+	"Issued",
 	"SearchDisabled",
 	"SearchBuylistDisabled",
 	"SearchSealed",
 	"SearchDownloadCSV",
+	"SearchAPILimit",
 	"ArbitEnabled",
 	"ArbitDisabledVendors",
 	"NewsEnabled",
@@ -220,6 +241,10 @@ var OptionalFields = []string{
 	"AnyEnabled",
 	"AnyExperimentsEnabled",
 	"APImode",
+	"APIKeyId",
+	"RateLimit",
+	"APIDailyRequests",
+	"APIDailyCards",
 }
 
 // The key matches the query parameter of the permissions defined in sign()
@@ -294,11 +319,12 @@ func init() {
 			Page:   "arbit.html",
 		},
 		"Admin": NavElem{
-			Name:   "Admin",
-			Short:  "❌",
-			Link:   "/admin",
-			Handle: Admin,
-			Page:   "admin.html",
+			Name:    "Admin",
+			Short:   "❌",
+			Link:    "/admin",
+			Handle:  Admin,
+			Page:    "admin.html",
+			CanPOST: true,
 
 			AlwaysOnForDev: true,
 		},
@@ -329,6 +355,38 @@ var Config struct {
 		Secret map[string]string `json:"secret"`
 		Emails map[string]string `json:"emails"`
 	} `json:"patreon"`
+	Auth struct {
+		// One of patreon (default), oidc, local, header
+		Provider string `json:"provider"`
+		OIDC     struct {
+			AuthURL      string            `json:"auth_url"`
+			TokenURL     string            `json:"token_url"`
+			UserInfoURL  string            `json:"userinfo_url"`
+			ClientId     string            `json:"client_id"`
+			ClientSecret string            `json:"client_secret"`
+			Scopes       []string          `json:"scopes"`
+			TierClaim    string            `json:"tier_claim"`
+			TierMap      map[string]string `json:"tier_map"`
+			DefaultTier  string            `json:"default_tier"`
+		} `json:"oidc"`
+		Local struct {
+			// Indexed by lowercase email
+			Users map[string]struct {
+				Name         string `json:"name"`
+				Tier         string `json:"tier"`
+				PasswordHash string `json:"password_hash"`
+			} `json:"users"`
+		} `json:"local"`
+		Header struct {
+			UserHeader   string            `json:"user_header"`
+			EmailHeader  string            `json:"email_header"`
+			GroupsHeader string            `json:"groups_header"`
+			SecretHeader string            `json:"secret_header"`
+			Secret       string            `json:"secret"`
+			TierMap      map[string]string `json:"tier_map"`
+			DefaultTier  string            `json:"default_tier"`
+		} `json:"header"`
+	} `json:"auth"`
 	ApiUserSecrets    map[string]string `json:"api_user_secrets"`
 	GoogleCredentials string            `json:"google_credentials"`
 
@@ -339,6 +397,55 @@ var Config struct {
 		BucketName     string `json:"bucket_name"`
 	} `json:"uploader"`
 
+	APIKeys struct {
+		// Either "file" (default) or "redis"
+		Backend  string `json:"backend"`
+		FilePath string `json:"file_path"`
+	} `json:"api_keys"`
+
+	Sessions struct {
+		// When enabled, the cookie only holds an opaque session id
+		// and users need to log in again to get one
+		Enabled bool `json:"enabled"`
+		// Either "memory" (default) or "redis"
+		Backend string `json:"backend"`
+		// Where forced logouts are saved with the memory backend
+		FilePath string `json:"file_path"`
+	} `json:"sessions"`
+
+	RateLimit struct {
+		// Either "memory" (default) or "redis" to share limits across nodes
+		Backend string `json:"backend"`
+	} `json:"rate_limit"`
+
+	Usage struct {
+		// Either "file" (default) or "redis"
+		Backend  string `json:"backend"`
+		FilePath string `json:"file_path"`
+	} `json:"usage"`
+
+	Audit struct {
+		// Any of "file", "redis", "discord", defaults to file and discord
+		Sinks []string `json:"sinks"`
+	} `json:"audit"`
+
+	// Proxies allowed to set X-Forwarded-For and X-Real-Ip, as CIDRs
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	Signature struct {
+		// Secrets by key id, used to sign and verify signatures
+		Keyring map[string]string `json:"keyring"`
+		// The key id used for new signatures, BAN_SECRET is used if empty
+		ActiveKey string `json:"active_key"`
+		// Date (YYYY-MM-DD) after which legacy signatures are rejected
+		LegacyCutoff string `json:"legacy_cutoff"`
+	} `json:"signature"`
+
+	Export struct {
+		Enabled   bool `json:"enabled"`
+		KeepDated bool `json:"keep_dated"`
+	} `json:"export"`
+
 	/* The location of the configuation file */
 	filePath string
 }
@@ -353,6 +460,10 @@ var LastUpdate string
 var DatabaseLoaded bool
 var Sellers []mtgban.Seller
 var Vendors []mtgban.Vendor
+
+// Held only while entries of Sellers and Vendors are being replaced, so that
+// the slices can be copied without waiting for a refresh to complete
+var scrapersMutex sync.RWMutex
 var Infos map[string]mtgban.InventoryRecord
 
 var SealedEditionsSorted []string
@@ -432,6 +543,8 @@ func genPageNav(activeTab, sig string) PageVars {
 		PatreonId:    PatreonClientId,
 		PatreonURL:   PatreonHost,
 		PatreonLogin: showPatreonLogin,
+
+		CSRFToken: csrfToken(sig),
 	}
 
 	// Allocate a new navigation bar
@@ -473,13 +586,25 @@ func loadVars(cfg string) error {
 	defer file.Close()
 
 	d := json.NewDecoder(file)
+	aclMutex.Lock()
 	err = d.Decode(&Config)
+	aclMutex.Unlock()
 	if err != nil {
 		return err
 	}
 
 	Config.filePath = cfg
 
+	err = loadTrustedProxies()
+	if err != nil {
+		return err
+	}
+
+	err = validateAuthConfig()
+	if err != nil {
+		return err
+	}
+
 	if Config.Port == "" {
 		Config.Port = DefaultConfigPort
 	}
@@ -577,6 +702,36 @@ func main() {
 		}
 	}
 
+	loadSessions()
+	loadRateLimiter()
+
+	err = loadAPIKeys()
+	if err != nil {
+		if DevMode {
+			log.Println("error loading api keys:", err)
+		} else {
+			log.Fatalln("error loading api keys:", err)
+		}
+	}
+
+	err = loadUsage()
+	if err != nil {
+		if DevMode {
+			log.Println("error loading api usage:", err)
+		} else {
+			log.Fatalln("error loading api usage:", err)
+		}
+	}
+
+	err = loadAudit()
+	if err != nil {
+		if DevMode {
+			log.Println("error loading audit log:", err)
+		} else {
+			log.Fatalln("error loading audit log:", err)
+		}
+	}
+
 	err = openDBs()
 	if err != nil {
 		if DevMode {
@@ -685,11 +840,26 @@ func main() {
 	http.Handle("/sealed", enforceSigning(http.HandlerFunc(Search)))
 
 	http.Handle("/api/mtgban/", enforceAPISigning(http.HandlerFunc(PriceAPI)))
+	http.Handle("/api/mtgban/changes", enforceAPISigning(http.HandlerFunc(ChangesAPI)))
+	http.Handle("/api/mtgban/stores.json", enforceAPISigning(http.HandlerFunc(StoresAPI)))
+	http.Handle("/api/mtgban/export/", enforceAPISigning(http.HandlerFunc(ExportAPI)))
+	http.Handle("/api/mtgban/batch/", enforceAPISigning(http.HandlerFunc(BatchPriceAPI)))
+	http.Handle("/api/mtgban/history/", enforceAPISigning(http.HandlerFunc(HistoryAPI)))
+	http.Handle("/api/arbit/", enforceAPISigning(http.HandlerFunc(ArbitAPI)))
+	http.Handle("/api/reverse/", enforceAPISigning(http.HandlerFunc(ArbitAPI)))
+	http.Handle("/api/global/", enforceAPISigning(http.HandlerFunc(ArbitAPI)))
+	http.Handle("/api/search.json", enforceAPISigning(http.HandlerFunc(SearchAPI)))
+	http.Handle("/api/v2/prices/", enforceAPIv2Signing(http.HandlerFunc(PriceAPIv2)))
+	http.HandleFunc(APIv2DocsPath, OpenAPIv2)
+	http.HandleFunc("/api/v2/", NotFoundAPIv2)
 	http.Handle("/api/mtgjson/ck.json", enforceAPISigning(http.HandlerFunc(API)))
 	http.Handle("/api/tcgplayer/lastsold/", enforceSigning(http.HandlerFunc(TCGLastSoldAPI)))
+	http.Handle("/api/suggest", enforceSigning(http.HandlerFunc(SuggestAPI)))
 	http.Handle("/api/cardkingdom/pricelist.json", noSigning(http.HandlerFunc(CKMirrorAPI)))
 	http.HandleFunc("/favicon.ico", Favicon)
 	http.HandleFunc("/auth", Auth)
+	http.HandleFunc("/login", Login)
+	http.Handle("/usage", enforceSigning(http.HandlerFunc(Usage)))
 
 	srv := &http.Server{
 		Addr: ":" + Config.Port,
@@ -761,6 +931,9 @@ func render(w http.ResponseWriter, tmpl string, pageVars PageVars) {
 		"tolower": func(s string) string {
 			return strings.ToLower(s)
 		},
+		"print_bytes": func(n int64) string {
+			return fmt.Sprintf("%0.2f MB", float64(n)/1024/1024)
+		},
 		"load_partner": func(s string) string {
 			return Config.Affiliate[s]
 		},
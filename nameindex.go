@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// Number of "did you mean" suggestions
+	MaxNameSuggestions = 5
+
+	// Number of names returned by the autocomplete endpoint
+	MaxAutocompleteResults = 20
+
+	// Number of candidates sharing the most trigrams that are ranked
+	// by edit distance
+	maxFuzzyCandidates = 50
+
+	// Minimum ratio of trigrams shared with the query
+	minTrigramSimilarity = 0.3
+)
+
+// In-memory index of card and sealed product names, supporting prefix
+// lookups and typo-tolerant searches
+type nameIndex struct {
+	names  []string
+	norms  []string
+	sealed []bool
+
+	// Number of trigrams of each name
+	gramCount []int
+
+	// Positions of the names containing each trigram
+	trigrams map[string][]int
+
+	// Positions of the names, sorted by their normalized version
+	sorted []int
+}
+
+var nameIndexMutex sync.RWMutex
+var NameIndex *nameIndex
+
+func newNameIndex() *nameIndex {
+	return &nameIndex{
+		trigrams: map[string][]int{},
+	}
+}
+
+func (ni *nameIndex) add(name string, sealed bool) {
+	norm := mtgmatcher.Normalize(name)
+	if norm == "" {
+		return
+	}
+
+	index := len(ni.names)
+	ni.names = append(ni.names, name)
+	ni.norms = append(ni.norms, norm)
+	ni.sealed = append(ni.sealed, sealed)
+
+	grams := trigrams(norm)
+	ni.gramCount = append(ni.gramCount, len(grams))
+	for _, gram := range grams {
+		ni.trigrams[gram] = append(ni.trigrams[gram], index)
+	}
+}
+
+// Rebuild the index from the names currently loaded in the datastore
+func buildNameIndex() {
+	ni := newNameIndex()
+
+	seen := map[string]bool{}
+	for _, set := range mtgmatcher.GetSets() {
+		for _, card := range set.Cards {
+			if seen[card.Name] {
+				continue
+			}
+			seen[card.Name] = true
+			ni.add(card.Name, false)
+		}
+		for _, product := range set.SealedProduct {
+			if seen["sealed|"+product.Name] {
+				continue
+			}
+			seen["sealed|"+product.Name] = true
+			ni.add(product.Name, true)
+		}
+	}
+
+	ni.sortNames()
+
+	nameIndexMutex.Lock()
+	NameIndex = ni
+	nameIndexMutex.Unlock()
+
+	log.Println("Name index built with", len(ni.names), "names and", len(ni.trigrams), "trigrams")
+}
+
+// Prepare the index for prefix lookups, needs to be called once all the
+// names have been added
+func (ni *nameIndex) sortNames() {
+	ni.sorted = make([]int, len(ni.names))
+	for i := range ni.sorted {
+		ni.sorted[i] = i
+	}
+	sort.Slice(ni.sorted, func(i, j int) bool {
+		return ni.norms[ni.sorted[i]] < ni.norms[ni.sorted[j]]
+	})
+}
+
+func trigrams(str string) []string {
+	runes := []rune("  " + str + " ")
+	var out []string
+	seen := map[string]bool{}
+	for i := 0; i+3 <= len(runes); i++ {
+		gram := string(runes[i : i+3])
+		if seen[gram] {
+			continue
+		}
+		seen[gram] = true
+		out = append(out, gram)
+	}
+	return out
+}
+
+func levenshtein(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = curr[j-1] + 1
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// Return the names closest to the query, first by trigram similarity and
+// then ranked by edit distance
+func (ni *nameIndex) fuzzy(query string, sealed bool, limit int) []string {
+	norm := mtgmatcher.Normalize(query)
+	if norm == "" {
+		return nil
+	}
+
+	grams := trigrams(norm)
+	shared := map[int]int{}
+	for _, gram := range grams {
+		for _, index := range ni.trigrams[gram] {
+			if ni.sealed[index] == sealed {
+				shared[index]++
+			}
+		}
+	}
+
+	type candidate struct {
+		index      int
+		similarity float64
+		distance   int
+	}
+	var candidates []candidate
+	for index, count := range shared {
+		similarity := 2 * float64(count) / float64(len(grams)+ni.gramCount[index])
+		if similarity < minTrigramSimilarity {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			index:      index,
+			similarity: similarity,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].similarity == candidates[j].similarity {
+			return ni.norms[candidates[i].index] < ni.norms[candidates[j].index]
+		}
+		return candidates[i].similarity > candidates[j].similarity
+	})
+	if len(candidates) > maxFuzzyCandidates {
+		candidates = candidates[:maxFuzzyCandidates]
+	}
+
+	for i := range candidates {
+		candidates[i].distance = levenshtein(norm, ni.norms[candidates[i].index])
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	var out []string
+	for _, candidate := range candidates {
+		if len(out) >= limit {
+			break
+		}
+		out = append(out, ni.names[candidate.index])
+	}
+	return out
+}
+
+// Return the names starting with the query, in alphabetical order
+func (ni *nameIndex) prefix(query string, sealed bool, limit int) []string {
+	norm := mtgmatcher.Normalize(query)
+	if norm == "" {
+		return nil
+	}
+
+	start := sort.Search(len(ni.sorted), func(i int) bool {
+		return ni.norms[ni.sorted[i]] >= norm
+	})
+
+	var out []string
+	for _, index := range ni.sorted[start:] {
+		if len(out) >= limit || !strings.HasPrefix(ni.norms[index], norm) {
+			break
+		}
+		if ni.sealed[index] != sealed {
+			continue
+		}
+		out = append(out, ni.names[index])
+	}
+	return out
+}
+
+// Return a ranked list of names similar to the query, for "did you mean"
+func suggestNames(query string, sealed bool, limit int) []string {
+	nameIndexMutex.RLock()
+	defer nameIndexMutex.RUnlock()
+
+	if NameIndex == nil {
+		return nil
+	}
+	return NameIndex.fuzzy(query, sealed, limit)
+}
+
+// Return the names completing the query, falling back to similar names
+// if there are not enough
+func autocompleteNames(query string, sealed bool, limit int) []string {
+	nameIndexMutex.RLock()
+	defer nameIndexMutex.RUnlock()
+
+	if NameIndex == nil {
+		return nil
+	}
+
+	names := NameIndex.prefix(query, sealed, limit)
+	if len(names) < limit && len(query) > 3 {
+		for _, name := range NameIndex.fuzzy(query, sealed, limit) {
+			if len(names) >= limit {
+				break
+			}
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Handler for /api/suggest, used to autocomplete the search box
+func SuggestAPI(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("q")
+	sealed, _ := strconv.ParseBool(r.FormValue("sealed"))
+
+	names := autocompleteNames(query, sealed, MaxAutocompleteResults)
+	if names == nil {
+		names = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(names)
+	if err != nil {
+		log.Println(err)
+		w.Write([]byte(`{"error": "` + err.Error() + `"}`))
+		return
+	}
+}
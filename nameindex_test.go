@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var LevenshteinTests = []struct {
+	A        string
+	B        string
+	Expected int
+}{
+	{"", "", 0},
+	{"bolt", "", 4},
+	{"", "bolt", 4},
+	{"bolt", "bolt", 0},
+	{"bolt", "blot", 2},
+	{"counterspell", "countrspell", 1},
+	{"kitten", "sitting", 3},
+	{"jötun", "jotun", 1},
+}
+
+func TestLevenshtein(t *testing.T) {
+	for _, test := range LevenshteinTests {
+		distance := levenshtein(test.A, test.B)
+		if distance != test.Expected {
+			t.Errorf("FAIL: Expected distance %d between '%s' and '%s', got %d", test.Expected, test.A, test.B, distance)
+		}
+	}
+}
+
+func TestTrigrams(t *testing.T) {
+	grams := trigrams("aaaa")
+	expected := []string{"  a", " aa", "aaa", "aa "}
+	if len(grams) != len(expected) {
+		t.Fatalf("FAIL: Expected %q, got %q", expected, grams)
+	}
+	for i := range grams {
+		if grams[i] != expected[i] {
+			t.Errorf("FAIL: Expected %q, got %q", expected, grams)
+		}
+	}
+}
+
+// Names used to check ranking, independently from the datastore
+var NameIndexTestNames = []string{
+	"Lightning Bolt",
+	"Lightning Helix",
+	"Lightning Greaves",
+	"Chain Lightning",
+	"Lightmine Field",
+	"Bolt Bend",
+	"Counterspell",
+	"Mana Leak",
+}
+
+var NameIndexTestSealed = []string{
+	"Modern Horizons 2 Draft Booster Box",
+	"Modern Horizons 2 Collector Booster",
+}
+
+var NameIndexTests = []struct {
+	Name     string
+	Query    string
+	Sealed   bool
+	Prefix   bool
+	Limit    int
+	Expected []string
+}{
+	{
+		Name:     "typo",
+		Query:    "lightnign bolt",
+		Limit:    1,
+		Expected: []string{"Lightning Bolt"},
+	},
+	{
+		Name:     "missing letter",
+		Query:    "countrspell",
+		Limit:    5,
+		Expected: []string{"Counterspell"},
+	},
+	{
+		Name:     "closest first",
+		Query:    "lightning helx",
+		Limit:    2,
+		Expected: []string{"Lightning Helix", "Lightning Bolt"},
+	},
+	{
+		Name:     "nothing similar",
+		Query:    "xyzzy",
+		Limit:    5,
+		Expected: nil,
+	},
+	{
+		Name:     "sealed only",
+		Query:    "modern horizon 2 colector booster",
+		Sealed:   true,
+		Limit:    1,
+		Expected: []string{"Modern Horizons 2 Collector Booster"},
+	},
+	{
+		Name:     "no cards for sealed",
+		Query:    "lightning bolt",
+		Sealed:   true,
+		Limit:    5,
+		Expected: nil,
+	},
+	{
+		Name:     "prefix",
+		Query:    "lightn",
+		Prefix:   true,
+		Limit:    5,
+		Expected: []string{"Lightning Bolt", "Lightning Greaves", "Lightning Helix"},
+	},
+	{
+		Name:     "prefix limit",
+		Query:    "light",
+		Prefix:   true,
+		Limit:    2,
+		Expected: []string{"Lightmine Field", "Lightning Bolt"},
+	},
+	{
+		Name:     "prefix normalized",
+		Query:    "LIGHTNING-B",
+		Prefix:   true,
+		Limit:    5,
+		Expected: []string{"Lightning Bolt"},
+	},
+	{
+		Name:     "prefix sealed",
+		Query:    "modern",
+		Prefix:   true,
+		Sealed:   true,
+		Limit:    5,
+		Expected: []string{"Modern Horizons 2 Collector Booster", "Modern Horizons 2 Draft Booster Box"},
+	},
+	{
+		Name:     "empty query",
+		Query:    "",
+		Prefix:   true,
+		Limit:    5,
+		Expected: nil,
+	},
+}
+
+func TestNameIndex(t *testing.T) {
+	ni := newNameIndex()
+	for _, name := range NameIndexTestNames {
+		ni.add(name, false)
+	}
+	for _, name := range NameIndexTestSealed {
+		ni.add(name, true)
+	}
+	ni.sortNames()
+
+	for _, test := range NameIndexTests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+			var names []string
+			if test.Prefix {
+				names = ni.prefix(test.Query, test.Sealed, test.Limit)
+			} else {
+				names = ni.fuzzy(test.Query, test.Sealed, test.Limit)
+			}
+			if len(names) != len(test.Expected) {
+				t.Fatalf("FAIL: Expected %q, got %q", test.Expected, names)
+			}
+			for i := range names {
+				if names[i] != test.Expected[i] {
+					t.Fatalf("FAIL: Expected %q, got %q", test.Expected, names)
+				}
+			}
+		})
+	}
+}
+
+// The index built from the test datastore is used by the handler
+func TestSuggestAPI(t *testing.T) {
+	var tests = []struct {
+		Query    string
+		Expected []string
+	}{
+		{"ragavn", []string{"Ragavan, Nimble Pilferer"}},
+		{"urza", []string{"Urza's Saga"}},
+		{"xyzzy", []string{}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/suggest?q="+test.Query, nil)
+		w := httptest.NewRecorder()
+		SuggestAPI(w, req)
+
+		var names []string
+		err := json.Unmarshal(w.Body.Bytes(), &names)
+		if err != nil {
+			t.Fatalf("FAIL: Invalid response for '%s': %s", test.Query, err)
+		}
+		if names == nil || len(names) != len(test.Expected) {
+			t.Errorf("FAIL: Expected %q for '%s', got %q", test.Expected, test.Query, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.Expected[i] {
+				t.Errorf("FAIL: Expected %q for '%s', got %q", test.Expected, test.Query, names)
+			}
+		}
+	}
+}
@@ -1,80 +1,339 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/go-redis/redis/v8"
 	"golang.org/x/time/rate"
 )
 
 type visitor struct {
 	*rate.Limiter
+	lastSeen time.Time
 }
 
 type rateLimiter struct {
-	sync.RWMutex
+	sync.Mutex
+
+	// Prefix used for the keys of the shared buckets
+	name string
 
 	burst    int
 	rate     rate.Limit
 	visitors map[string]*visitor
+
+	lastEviction time.Time
+}
+
+// The state of a bucket after a request has been accounted for
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     float64
+	Remaining int
+
+	// Time until the bucket is full again
+	Reset time.Duration
+
+	// Time until the next request is allowed, if this one was not
+	RetryAfter time.Duration
 }
 
 const (
 	APIRequestsPerSec  = 10
 	UserRequestsPerSec = 3
+
+	// One login attempt every ten seconds, after the first few
+	LoginRequestsPerSec = 0.1
+	LoginBurst          = 5
+
+	// Suggestions are requested while typing, so they need a larger bucket
+	SuggestRequestsPerSec = 10
+	SuggestBurst          = 10
+
+	// Visitors that have not been seen in this long are dropped
+	RateLimitIdleTimeout = 10 * time.Minute
 )
 
 var APIRateLimiter = &rateLimiter{
+	name:     "api",
 	rate:     APIRequestsPerSec,
 	burst:    2,
 	visitors: map[string]*visitor{},
 }
 
 var UserRateLimiter = &rateLimiter{
+	name:     "user",
 	rate:     UserRequestsPerSec,
 	burst:    1,
 	visitors: map[string]*visitor{},
 }
 
-// Allow checks if given ip has not exceeded rate limit
-func (l *rateLimiter) allow(ip string) bool {
-	l.RLock()
-	v, exists := l.visitors[ip]
-	l.RUnlock()
+var SuggestRateLimiter = &rateLimiter{
+	name:     "suggest",
+	rate:     SuggestRequestsPerSec,
+	burst:    SuggestBurst,
+	visitors: map[string]*visitor{},
+}
+
+var LoginRateLimiter = &rateLimiter{
+	name:     "login",
+	rate:     LoginRequestsPerSec,
+	burst:    LoginBurst,
+	visitors: map[string]*visitor{},
+}
+
+// Token bucket shared across nodes, state is kept in a hash with the amount
+// of tokens left and the timestamp of the last update
+var rateLimitScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+var rateLimitRedis *redis.Client
+
+func loadRateLimiter() {
+	if Config.RateLimit.Backend != "redis" {
+		return
+	}
+	rateLimitRedis = redis.NewClient(&redis.Options{
+		Addr: Config.RedisAddr,
+		DB:   DBs["ratelimit"],
+	})
+	log.Println("Rate limits shared via redis")
+}
 
+// Return the limit set for the tier of the signature, or the default one
+// The signature needs to be verified by the caller, see verifiedSignature()
+func (l *rateLimiter) limitForSig(sig string) rate.Limit {
+	limit, err := strconv.ParseFloat(GetParamFromSig(sig, "RateLimit"), 64)
+	if err != nil || limit <= 0 {
+		return l.rate
+	}
+	return rate.Limit(limit)
+}
+
+// Allow checks if given key has not exceeded the rate limit set for sig
+func (l *rateLimiter) allow(key, sig string) RateLimitResult {
+	limit := l.limitForSig(sig)
+	burst := l.burst
+
+	var tokens float64
+	var allowed bool
+	if rateLimitRedis != nil {
+		var err error
+		allowed, tokens, err = l.takeShared(key, limit, burst)
+		if err != nil {
+			// Do not lock everybody out if redis is unavailable
+			log.Println("rate limit error:", err)
+			allowed, tokens = l.takeLocal(key, limit, burst)
+		}
+	} else {
+		allowed, tokens = l.takeLocal(key, limit, burst)
+	}
+
+	res := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     float64(limit),
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     time.Duration((float64(burst) - tokens) / float64(limit) * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / float64(limit) * float64(time.Second))
+	}
+	return res
+}
+
+func (l *rateLimiter) takeLocal(key string, limit rate.Limit, burst int) (bool, float64) {
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastEviction) > RateLimitIdleTimeout {
+		for key, v := range l.visitors {
+			if now.Sub(v.lastSeen) > RateLimitIdleTimeout {
+				delete(l.visitors, key)
+			}
+		}
+		l.lastEviction = now
+	}
+
+	v, exists := l.visitors[key]
 	if !exists {
 		v = &visitor{
-			Limiter: rate.NewLimiter(l.rate, l.burst),
+			Limiter: rate.NewLimiter(limit, burst),
 		}
-		l.Lock()
-		l.visitors[ip] = v
-		l.Unlock()
+		l.visitors[key] = v
+	} else if v.Limit() != limit || v.Burst() != burst {
+		// The tier of the visitor changed
+		v.SetLimitAt(now, limit)
+		v.SetBurstAt(now, burst)
 	}
+	v.lastSeen = now
 
-	return v.Allow()
+	allowed := v.AllowN(now, 1)
+	return allowed, v.TokensAt(now)
 }
 
-func IpAddress(r *http.Request) (net.IP, error) {
-	addr := r.RemoteAddr
+func (l *rateLimiter) takeShared(key string, limit rate.Limit, burst int) (bool, float64, error) {
+	now := time.Now().UnixMilli()
+	res, err := rateLimitScript.Run(context.Background(), rateLimitRedis, []string{"ratelimit:" + l.name + ":" + key}, float64(limit), burst, now).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected reply %v", res)
+	}
+	allowed, _ := res[0].(int64)
+	str, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed == 1, tokens, nil
+}
 
-	xReal := r.Header.Get("X-Real-Ip")
-	xForwarded := r.Header.Get("X-Forwarded-For")
-	if xReal != "" {
-		addr = xReal
-	} else if xForwarded != "" {
-		addr = xForwarded
+// Set the headers describing the state of the rate limit
+func setRateLimitHeaders(w http.ResponseWriter, res RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.FormatFloat(res.Limit, 'f', -1, 64))
+	w.Header().Set("RateLimit-Remaining", fmt.Sprint(res.Remaining))
+	w.Header().Set("RateLimit-Reset", fmt.Sprint(int(math.Ceil(res.Reset.Seconds()))))
+	if !res.Allowed {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(res.RetryAfter.Seconds()))))
+	}
+}
+
+// Proxies allowed to set the forwarding headers, when none are configured
+// only the local ones are trusted
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"::1/128",
+}
+
+var trustedProxies []*net.IPNet
+
+// Parse a list of CIDRs, single addresses are accepted too
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range list {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not a valid IP address", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
 	}
+	return nets, nil
+}
 
-	ip, _, err := net.SplitHostPort(addr)
+func loadTrustedProxies() error {
+	list := Config.TrustedProxies
+	if len(list) == 0 {
+		list = DefaultTrustedProxies
+	}
+	nets, err := parseCIDRs(list)
 	if err != nil {
-		return nil, fmt.Errorf("addr: %q is not IP:port", addr)
+		return err
 	}
+	trustedProxies = nets
+	return nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	userIP := net.ParseIP(ip)
+// Parse an address that may or may not have a port
+func parseHostIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// Return the address of the client, the forwarding headers are only
+// considered when the request comes from a trusted proxy
+func IpAddress(r *http.Request) (net.IP, error) {
+	userIP := parseHostIP(r.RemoteAddr)
 	if userIP == nil {
-		return nil, fmt.Errorf("ip: %q is not a valid IP address", ip)
+		return nil, fmt.Errorf("addr: %q is not a valid IP address", r.RemoteAddr)
+	}
+	if !ipInNets(userIP, trustedProxies) {
+		return userIP, nil
+	}
+
+	// Every proxy appends the address it received the request from, so walk
+	// the chain backwards and stop at the first hop that is not trusted
+	xForwarded := r.Header.Values("X-Forwarded-For")
+	if len(xForwarded) > 0 {
+		hops := strings.Split(strings.Join(xForwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHostIP(hops[i])
+			if ip == nil {
+				return nil, fmt.Errorf("ip: %q is not a valid IP address", hops[i])
+			}
+			userIP = ip
+			if !ipInNets(ip, trustedProxies) {
+				break
+			}
+		}
+		return userIP, nil
+	}
+
+	xReal := r.Header.Get("X-Real-Ip")
+	if xReal != "" {
+		ip := parseHostIP(xReal)
+		if ip == nil {
+			return nil, fmt.Errorf("ip: %q is not a valid IP address", xReal)
+		}
+		userIP = ip
 	}
 
 	return userIP, nil
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func newTestRateLimiter(limit rate.Limit, burst int) *rateLimiter {
+	return &rateLimiter{
+		name:     "test",
+		rate:     limit,
+		burst:    burst,
+		visitors: map[string]*visitor{},
+	}
+}
+
+var LimitForSigTests = []struct {
+	Name     string
+	Limit    string
+	Expected rate.Limit
+}{
+	{
+		Name:     "no signature",
+		Expected: 2,
+	},
+	{
+		Name:     "tier limit",
+		Limit:    "20",
+		Expected: 20,
+	},
+	{
+		Name:     "fractional limit",
+		Limit:    "0.5",
+		Expected: 0.5,
+	},
+	{
+		Name:     "invalid limit",
+		Limit:    "fast",
+		Expected: 2,
+	},
+	{
+		Name:     "negative limit",
+		Limit:    "-1",
+		Expected: 2,
+	},
+}
+
+func TestLimitForSig(t *testing.T) {
+	limiter := newTestRateLimiter(2, 1)
+	for _, test := range LimitForSigTests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+			var sig string
+			if test.Limit != "" {
+				sig = encodeTestSig(url.Values{"RateLimit": {test.Limit}})
+			}
+			limit := limiter.limitForSig(sig)
+			if limit != test.Expected {
+				t.Errorf("FAIL: Expected %v, got %v", test.Expected, limit)
+			}
+		})
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := newTestRateLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		res := limiter.allow("visitor", "")
+		if !res.Allowed {
+			t.Fatalf("FAIL: Expected request %d to be allowed", i)
+		}
+		if res.Remaining != 2-i {
+			t.Errorf("FAIL: Expected %d remaining requests, got %d", 2-i, res.Remaining)
+		}
+	}
+
+	res := limiter.allow("visitor", "")
+	if res.Allowed {
+		t.Fatalf("FAIL: Expected the request over the burst to be denied")
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > time.Second {
+		t.Errorf("FAIL: Unexpected retry time %v", res.RetryAfter)
+	}
+	if res.Reset <= 0 || res.Reset > 3*time.Second {
+		t.Errorf("FAIL: Unexpected reset time %v", res.Reset)
+	}
+
+	w := httptest.NewRecorder()
+	setRateLimitHeaders(w, res)
+	for _, header := range []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"} {
+		if w.Header().Get(header) == "" {
+			t.Errorf("FAIL: Missing %s header", header)
+		}
+	}
+
+	// Buckets are separate for each key
+	res = limiter.allow("other", "")
+	if !res.Allowed {
+		t.Errorf("FAIL: Expected a different visitor to be allowed")
+	}
+}
+
+func TestRateLimiterTierChange(t *testing.T) {
+	limiter := newTestRateLimiter(1, 1)
+
+	limiter.allow("visitor", "")
+	res := limiter.allow("visitor", "")
+	if res.Allowed {
+		t.Fatalf("FAIL: Expected the second request to be denied")
+	}
+
+	sig := encodeTestSig(url.Values{"RateLimit": {"1000"}})
+
+	// The bucket refills at the new rate from now on
+	res = limiter.allow("visitor", sig)
+	if res.Limit != 1000 || res.RetryAfter > 10*time.Millisecond {
+		t.Fatalf("FAIL: Expected the new limit to apply to the existing visitor, got %+v", res)
+	}
+	time.Sleep(10 * time.Millisecond)
+	res = limiter.allow("visitor", sig)
+	if !res.Allowed {
+		t.Errorf("FAIL: Expected the request to be allowed at the new rate, got %+v", res)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limiter := newTestRateLimiter(1, 1)
+
+	limiter.allow("idle", "")
+	limiter.visitors["idle"].lastSeen = time.Now().Add(-2 * RateLimitIdleTimeout)
+	limiter.lastEviction = time.Now().Add(-2 * RateLimitIdleTimeout)
+
+	limiter.allow("active", "")
+	_, found := limiter.visitors["idle"]
+	if found {
+		t.Errorf("FAIL: Expected idle visitors to be evicted")
+	}
+	if len(limiter.visitors) != 1 {
+		t.Errorf("FAIL: Expected one visitor, got %d", len(limiter.visitors))
+	}
+}
+
+// Suggestions are requested at most once per debounce interval of the
+// autocomplete script, which needs to stay under the limit
+func TestSuggestRateLimiter(t *testing.T) {
+	debounce := 150 * time.Millisecond
+	if float64(SuggestRequestsPerSec) < 1/debounce.Seconds() {
+		t.Errorf("FAIL: Expected at least one suggestion every %v, got %v/s", debounce, SuggestRequestsPerSec)
+	}
+
+	limiter := newTestRateLimiter(SuggestRequestsPerSec, SuggestBurst)
+	for i := 0; i < SuggestBurst; i++ {
+		res := limiter.allow("visitor", "")
+		if !res.Allowed {
+			t.Fatalf("FAIL: Expected suggestion %d to be allowed", i)
+		}
+	}
+}
+
+// Rate limits can only be raised by signatures made with our keys
+func TestRateLimitForgedSignature(t *testing.T) {
+	t.Setenv("BAN_SECRET", "bansecret")
+	old := Config.Signature
+	defer func() {
+		Config.Signature = old
+	}()
+	Config.Signature.Keyring = nil
+	Config.Signature.ActiveKey = ""
+
+	exp := fmt.Sprint(time.Now().Add(time.Hour).Unix())
+	v := url.Values{}
+	v.Set("Search", "true")
+	v.Set("RateLimit", "1000")
+	computed := computeSignature(exp, SignatureTestLink, v, "")
+	v.Set("Expires", exp)
+	v.Set("Signature", computed)
+	valid := encodeTestSig(v)
+
+	v.Set("Signature", "forged")
+	forged := encodeTestSig(v)
+
+	v.Set("Signature", computed)
+	v.Set("RateLimit", "5000")
+	tampered := encodeTestSig(v)
+
+	limiter := newTestRateLimiter(1, 1)
+	res := limiter.allow("valid", verifiedSignature(SignatureTestLink, valid, false))
+	if res.Limit != 1000 {
+		t.Errorf("FAIL: Expected the limit of a valid signature, got %v", res.Limit)
+	}
+	res = limiter.allow("forged", verifiedSignature(SignatureTestLink, forged, false))
+	if res.Limit != 1 {
+		t.Errorf("FAIL: Expected the default limit for a forged signature, got %v", res.Limit)
+	}
+	res = limiter.allow("tampered", verifiedSignature(SignatureTestLink, tampered, false))
+	if res.Limit != 1 {
+		t.Errorf("FAIL: Expected the default limit for a tampered signature, got %v", res.Limit)
+	}
+}
+
+var IpAddressTests = []struct {
+	Name       string
+	RemoteAddr string
+	Forwarded  []string
+	RealIp     string
+	Expected   string
+	Error      bool
+}{
+	{
+		Name:       "direct connection",
+		RemoteAddr: "198.51.100.1:1234",
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "spoofed header from an untrusted peer",
+		RemoteAddr: "198.51.100.1:1234",
+		Forwarded:  []string{"203.0.113.9"},
+		RealIp:     "203.0.113.10",
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "single trusted proxy",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"198.51.100.1"},
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "multi-hop chain",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"198.51.100.1, 10.0.0.2, 10.0.0.1"},
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "spoofed hop before the client",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"},
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "repeated headers",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"203.0.113.9", "198.51.100.1, 10.0.0.2"},
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "only trusted hops",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"10.0.0.3, 10.0.0.2"},
+		Expected:   "10.0.0.3",
+	},
+	{
+		Name:       "forwarded header wins over real ip",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"198.51.100.1"},
+		RealIp:     "203.0.113.10",
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "real ip fallback",
+		RemoteAddr: "127.0.0.1:1234",
+		RealIp:     "198.51.100.1",
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "ipv6 proxy",
+		RemoteAddr: "[::1]:1234",
+		Forwarded:  []string{"2001:db8::1"},
+		Expected:   "2001:db8::1",
+	},
+	{
+		Name:       "hop with a port",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"198.51.100.1:5678"},
+		Expected:   "198.51.100.1",
+	},
+	{
+		Name:       "invalid hop",
+		RemoteAddr: "127.0.0.1:1234",
+		Forwarded:  []string{"198.51.100.1, garbage"},
+		Error:      true,
+	},
+	{
+		Name:       "invalid real ip",
+		RemoteAddr: "127.0.0.1:1234",
+		RealIp:     "garbage",
+		Error:      true,
+	},
+	{
+		Name:       "invalid remote address",
+		RemoteAddr: "garbage",
+		Error:      true,
+	},
+}
+
+// The list of trusted proxies is global, so these tests cannot be parallel
+func TestIpAddress(t *testing.T) {
+	old := trustedProxies
+	defer func() {
+		trustedProxies = old
+	}()
+	var err error
+	trustedProxies, err = parseCIDRs(append(DefaultTrustedProxies, "10.0.0.0/8"))
+	if err != nil {
+		t.Fatalf("FAIL: Unable to parse proxies: %s", err)
+	}
+
+	for _, test := range IpAddressTests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.RemoteAddr
+			for _, value := range test.Forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if test.RealIp != "" {
+				req.Header.Set("X-Real-Ip", test.RealIp)
+			}
+
+			ip, err := IpAddress(req)
+			if test.Error {
+				if err == nil {
+					t.Errorf("FAIL: Expected an error, got %s", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FAIL: Unexpected error: %s", err)
+			}
+			if ip.String() != test.Expected {
+				t.Errorf("FAIL: Expected %s, got %s", test.Expected, ip)
+			}
+		})
+	}
+}
+
+var ParseCIDRsTests = []struct {
+	Name    string
+	List    []string
+	Inside  []string
+	Outside []string
+	Error   bool
+}{
+	{
+		Name:    "networks",
+		List:    []string{"10.0.0.0/8", "2001:db8::/32"},
+		Inside:  []string{"10.1.2.3", "2001:db8::1"},
+		Outside: []string{"11.0.0.1", "2001:db9::1"},
+	},
+	{
+		Name:    "bare addresses",
+		List:    []string{"192.0.2.1", "2001:db8::1"},
+		Inside:  []string{"192.0.2.1", "2001:db8::1"},
+		Outside: []string{"192.0.2.2", "2001:db8::2"},
+	},
+	{
+		Name:    "spaces and empty entries",
+		List:    []string{" 192.0.2.1 ", "", " "},
+		Inside:  []string{"192.0.2.1"},
+		Outside: []string{"192.0.2.2"},
+	},
+	{
+		Name:  "invalid address",
+		List:  []string{"192.0.2.256"},
+		Error: true,
+	},
+	{
+		Name:  "invalid network",
+		List:  []string{"10.0.0.0/33"},
+		Error: true,
+	},
+}
+
+func TestParseCIDRs(t *testing.T) {
+	for _, test := range ParseCIDRsTests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+			nets, err := parseCIDRs(test.List)
+			if test.Error {
+				if err == nil {
+					t.Errorf("FAIL: Expected an error for %q", test.List)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FAIL: Unexpected error: %s", err)
+			}
+			for _, addr := range test.Inside {
+				if !ipInNets(net.ParseIP(addr), nets) {
+					t.Errorf("FAIL: Expected %s to be allowed by %q", addr, test.List)
+				}
+			}
+			for _, addr := range test.Outside {
+				if ipInNets(net.ParseIP(addr), nets) {
+					t.Errorf("FAIL: Expected %s not to be allowed by %q", addr, test.List)
+				}
+			}
+		})
+	}
+}
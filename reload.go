@@ -135,9 +135,20 @@ func updateSellerAtPosition(seller mtgban.Seller, i int, andLock bool) error {
 		return errors.New("empty inventory")
 	}
 
+	// Keep track of what changed since the previous refresh, the diff is
+	// done in the background on a reference to the previous inventory
+	if Sellers[i] != nil {
+		oldInv, err := Sellers[i].Inventory()
+		if err == nil {
+			go recordSellerChanges(Sellers[i].Info(), oldInv, inv)
+		}
+	}
+
 	// Save seller in global array, making sure it's _only_ a Seller
 	// and not anything esle, so that filtering works like expected
+	scrapersMutex.Lock()
 	Sellers[i] = mtgban.NewSellerFromInventory(inv, seller.Info())
+	scrapersMutex.Unlock()
 
 	targetDir := path.Join(InventoryDir, time.Now().Format("2006-01-02/15"))
 	go uploadSeller(Sellers[i], targetDir)
@@ -179,9 +190,20 @@ func updateVendorAtPosition(vendor mtgban.Vendor, i int, andLock bool) error {
 		return errors.New("empty buylist")
 	}
 
+	// Keep track of what changed since the previous refresh, the diff is
+	// done in the background on a reference to the previous buylist
+	if Vendors[i] != nil {
+		oldBl, err := Vendors[i].Buylist()
+		if err == nil {
+			go recordVendorChanges(Vendors[i].Info(), oldBl, bl)
+		}
+	}
+
 	// Save vendor in global array, making sure it's _only_ a Vendor
 	// and not anything esle, so that filtering works like expected
+	scrapersMutex.Lock()
 	Vendors[i] = mtgban.NewVendorFromBuylist(bl, vendor.Info())
+	scrapersMutex.Unlock()
 
 	targetDir := path.Join(BuylistDir, time.Now().Format("2006-01-02/15"))
 	go uploadVendor(Vendors[i], targetDir)
@@ -32,6 +32,11 @@ const (
 	defaultVendorPriorityOpt = "CK"
 )
 
+type NameSuggestion struct {
+	Name  string
+	Query string
+}
+
 type SearchEntry struct {
 	ScraperName string
 	Shorthand   string
@@ -208,6 +213,13 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	if pageVars.IsSealed {
 		config.SearchMode = "sealed"
 	}
+	pageVars.SearchWarnings = config.Warnings
+
+	// Report how many results were removed by each filter
+	pageVars.ExplainMode, _ = strconv.ParseBool(r.FormValue("explain"))
+	if pageVars.ExplainMode {
+		config.Explain = newSearchExplain()
+	}
 
 	if config.SortMode != "" {
 		pageVars.SearchSort = config.SortMode
@@ -318,11 +330,27 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	allKeys, err := searchAndFilter(config)
 	if err != nil {
 		pageVars.InfoMessage = NoCardsMessage
+
+		// Offer similar names, keeping any option that was searched
+		for _, name := range suggestNames(config.CleanQuery, pageVars.IsSealed, MaxNameSuggestions) {
+			suggestion := name
+			if config.CleanQuery != "" && strings.Contains(query, config.CleanQuery) {
+				suggestion = strings.Replace(query, config.CleanQuery, name, 1)
+			}
+			pageVars.Suggestions = append(pageVars.Suggestions, NameSuggestion{
+				Name:  name,
+				Query: suggestion,
+			})
+		}
+
 		render(w, "search.html", pageVars)
 		return
 	}
 
 	foundSellers, foundVendors := searchParallelNG(allKeys, config)
+	if config.Explain != nil {
+		pageVars.SearchExplain = config.Explain.Stages()
+	}
 
 	cleanQuery := config.CleanQuery
 	canShowAll := (len(config.CardFilters) != 0 || len(config.UUIDs) != 0)
@@ -361,6 +389,11 @@ func Search(w http.ResponseWriter, r *http.Request) {
 
 	// Early exit if there no matches are found
 	if len(allKeys) == 0 {
+		// Report which filter, if any, removed all the cards
+		if config.Explain != nil {
+			pageVars.SearchWarnings = append(pageVars.SearchWarnings, config.Explain.Warnings()...)
+		}
+
 		pageVars.InfoMessage = NoResultsMessage
 		render(w, "search.html", pageVars)
 		return
@@ -671,11 +704,13 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	}
 	user := GetParamFromSig(sig, "UserEmail")
 	msg := fmt.Sprintf("[%s] from %s by %s (took %v)", query, source, user, time.Since(start))
-	UserNotify(notifyTitle, msg)
 	LogPages["Search"].Println(msg)
-	if DevMode {
-		log.Println(msg)
-	}
+
+	event := newAuditEvent(sig, notifyTitle, "Search", start)
+	event.Query = query
+	event.Rows = pageVars.TotalUnique
+	event.Message = msg
+	recordAudit(event)
 
 	if DevMode {
 		start = time.Now()
@@ -696,6 +731,9 @@ func searchSellersNG(cardIds []string, config SearchConfig) (foundSellers map[st
 
 	// Search sellers
 	for _, seller := range Sellers {
+		if config.Explain != nil {
+			config.Explain.explainStore(seller, storeFilters)
+		}
 		if shouldSkipStoreNG(seller, storeFilters) {
 			continue
 		}
@@ -714,11 +752,17 @@ func searchSellersNG(cardIds []string, config SearchConfig) (foundSellers map[st
 
 			// Loop thorugh available conditions
 			for _, entry := range entries {
+				if config.Explain != nil && !seller.Info().MetadataOnly {
+					config.Explain.explainEntry(entry, entryFilters)
+				}
 				// Skip cards that have not the desired condition
 				if !seller.Info().MetadataOnly && shouldSkipEntryNG(entry, entryFilters) {
 					continue
 				}
 
+				if config.Explain != nil {
+					config.Explain.explainPrice(cardId, entry, priceFilters)
+				}
 				// Skip cards that don't match desired pricing
 				if shouldSkipPriceNG(cardId, entry, priceFilters) {
 					continue
@@ -793,6 +837,9 @@ func searchVendorsNG(cardIds []string, config SearchConfig) (foundVendors map[st
 	entryFilters := config.EntryFilters
 
 	for _, vendor := range Vendors {
+		if config.Explain != nil {
+			config.Explain.explainStore(vendor, storeFilters)
+		}
 		if shouldSkipStoreNG(vendor, storeFilters) {
 			continue
 		}
@@ -809,10 +856,16 @@ func searchVendorsNG(cardIds []string, config SearchConfig) (foundVendors map[st
 			}
 
 			for _, entry := range entries {
+				if config.Explain != nil {
+					config.Explain.explainEntry(entry, entryFilters)
+				}
 				if shouldSkipEntryNG(entry, entryFilters) {
 					continue
 				}
 
+				if config.Explain != nil {
+					config.Explain.explainPrice(cardId, entry, priceFilters)
+				}
 				if shouldSkipPriceNG(cardId, entry, priceFilters) {
 					continue
 				}
@@ -904,6 +957,10 @@ func searchAndFilter(config SearchConfig) ([]string, error) {
 		}
 	}
 
+	if config.Explain != nil {
+		config.Explain.explainCards(uuids, filters)
+	}
+
 	var selectedUUIDs []string
 	for _, uuid := range uuids {
 		if shouldSkipCardNG(uuid, filters) {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mtgban/go-mtgban/mtgban"
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+)
+
+// Stages in which filters are applied, in order
+var ExplainStages = []string{"card", "store", "entry", "price"}
+
+type ExplainFilter struct {
+	Filter    string
+	Removed   int
+	Remaining int
+}
+
+type ExplainStage struct {
+	Name string
+
+	// Number of elements checked by the stage, cards for the card stage,
+	// scrapers for the store stage, and entries for the others
+	Candidates int
+
+	Filters []ExplainFilter
+}
+
+// Keep track of how many candidates are removed by each filter, which is
+// the first filter of the chain rejecting them
+type SearchExplain struct {
+	sync.Mutex
+	stages map[string]*ExplainStage
+}
+
+func newSearchExplain() *SearchExplain {
+	return &SearchExplain{
+		stages: map[string]*ExplainStage{},
+	}
+}
+
+func (se *SearchExplain) record(name string, filters []fmt.Stringer, index int) {
+	se.Lock()
+	defer se.Unlock()
+
+	stage, found := se.stages[name]
+	if !found {
+		stage = &ExplainStage{
+			Name: name,
+		}
+		for _, filter := range filters {
+			stage.Filters = append(stage.Filters, ExplainFilter{
+				Filter: filter.String(),
+			})
+		}
+		se.stages[name] = stage
+	}
+	stage.Candidates++
+	if index >= 0 {
+		stage.Filters[index].Removed++
+	}
+}
+
+func (se *SearchExplain) explainCards(cardIds []string, filters []FilterElem) {
+	var descs []fmt.Stringer
+	for i := range filters {
+		descs = append(descs, filters[i])
+	}
+	for _, cardId := range cardIds {
+		_, err := mtgmatcher.GetUUID(cardId)
+		if err != nil {
+			continue
+		}
+		index := -1
+		for i := range filters {
+			if shouldSkipCardNG(cardId, filters[i:i+1]) {
+				index = i
+				break
+			}
+		}
+		se.record("card", descs, index)
+	}
+}
+
+func (se *SearchExplain) explainStore(scraper mtgban.Scraper, filters []FilterStoreElem) {
+	if scraper == nil {
+		return
+	}
+	var descs []fmt.Stringer
+	for i := range filters {
+		descs = append(descs, filters[i])
+	}
+	index := -1
+	for i := range filters {
+		if shouldSkipStoreNG(scraper, filters[i:i+1]) {
+			index = i
+			break
+		}
+	}
+	se.record("store", descs, index)
+}
+
+func (se *SearchExplain) explainEntry(entry mtgban.GenericEntry, filters []FilterEntryElem) {
+	var descs []fmt.Stringer
+	for i := range filters {
+		descs = append(descs, filters[i])
+	}
+	index := -1
+	for i := range filters {
+		if shouldSkipEntryNG(entry, filters[i:i+1]) {
+			index = i
+			break
+		}
+	}
+	se.record("entry", descs, index)
+}
+
+func (se *SearchExplain) explainPrice(cardId string, entry mtgban.GenericEntry, filters []FilterPriceElem) {
+	// Entries without a price are always skipped, regardless of filters
+	if entry.Pricing() == 0 {
+		return
+	}
+	var descs []fmt.Stringer
+	for i := range filters {
+		descs = append(descs, filters[i])
+	}
+	index := -1
+	for i := range filters {
+		if shouldSkipPriceNG(cardId, entry, filters[i:i+1]) {
+			index = i
+			break
+		}
+	}
+	se.record("price", descs, index)
+}
+
+// Return the stages that had any filter, with the number of candidates
+// left after each filter
+func (se *SearchExplain) Stages() []ExplainStage {
+	se.Lock()
+	defer se.Unlock()
+
+	var out []ExplainStage
+	for _, name := range ExplainStages {
+		stage, found := se.stages[name]
+		if !found || len(stage.Filters) == 0 {
+			continue
+		}
+		result := *stage
+		result.Filters = make([]ExplainFilter, len(stage.Filters))
+		remaining := stage.Candidates
+		for i, filter := range stage.Filters {
+			remaining -= filter.Removed
+			filter.Remaining = remaining
+			result.Filters[i] = filter
+		}
+		out = append(out, result)
+	}
+	return out
+}
+
+// Report the filters that removed all the remaining candidates of a stage
+func (se *SearchExplain) Warnings() []string {
+	var warnings []string
+	for _, stage := range se.Stages() {
+		for _, filter := range stage.Filters {
+			if filter.Removed > 0 && filter.Remaining == 0 {
+				warnings = append(warnings, fmt.Sprintf("No %s results left after '%s'", stage.Name, filter.Filter))
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+func describeFilter(name string, negate bool, value string) string {
+	if negate {
+		name = "-" + name
+	}
+	return name + ":" + value
+}
+
+func describeGroup(negate bool, branches []string) string {
+	out := "(" + strings.Join(branches, " or ") + ")"
+	if negate {
+		out = "-" + out
+	}
+	return out
+}
+
+func (f FilterElem) String() string {
+	if f.Name == FilterGroupName {
+		var branches []string
+		for _, group := range f.Groups {
+			branches = append(branches, (&filterSet{cards: group}).String())
+		}
+		return describeGroup(f.Negate, branches)
+	}
+	return describeFilter(f.Name, f.Negate, strings.Join(f.Values, ","))
+}
+
+func (f FilterStoreElem) String() string {
+	if f.Name == FilterGroupName {
+		var branches []string
+		for _, group := range f.Groups {
+			branches = append(branches, (&filterSet{stores: group}).String())
+		}
+		return describeGroup(f.Negate, branches)
+	}
+	return describeFilter(f.Name, f.Negate, strings.Join(f.Values, ","))
+}
+
+func (f FilterPriceElem) String() string {
+	if f.Name == FilterGroupName {
+		var branches []string
+		for _, group := range f.Groups {
+			branches = append(branches, (&filterSet{prices: group}).String())
+		}
+		return describeGroup(f.Negate, branches)
+	}
+	value := strings.Join(f.Stores, ",")
+	if len(f.Stores) == 0 {
+		value = strconv.FormatFloat(f.Value, 'f', -1, 64)
+	}
+	return describeFilter(f.Name, f.Negate, value)
+}
+
+func (f FilterEntryElem) String() string {
+	if f.Name == FilterGroupName {
+		var branches []string
+		for _, group := range f.Groups {
+			branches = append(branches, (&filterSet{entries: group}).String())
+		}
+		return describeGroup(f.Negate, branches)
+	}
+	return describeFilter(f.Name, f.Negate, strings.Join(f.Values, ","))
+}
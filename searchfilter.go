@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -53,12 +52,28 @@ type SearchConfig struct {
 
 	// Skip card entry if no buylist price was found
 	SkipEmptyBuylist bool
+
+	// Problems found while parsing the query, to be reported to the user
+	Warnings []string
+
+	// If set, keep track of how many results each filter removes
+	Explain *SearchExplain
+}
+
+func (config *SearchConfig) addWarning(format string, args ...interface{}) {
+	config.Warnings = append(config.Warnings, fmt.Sprintf(format, args...))
 }
 
+// Name of the filters made of a group of other filters
+const FilterGroupName = "group"
+
 type FilterElem struct {
 	Name   string
 	Negate bool
 	Values []string
+
+	// Only for groups, the filter matches if any of these chains does
+	Groups [][]FilterElem
 }
 
 type FilterStoreElem struct {
@@ -68,6 +83,9 @@ type FilterStoreElem struct {
 
 	OnlyForSeller bool
 	OnlyForVendor bool
+
+	// Only for groups, the filter matches if any of these chains does
+	Groups [][]FilterStoreElem
 }
 
 type FilterPriceElem struct {
@@ -86,6 +104,9 @@ type FilterPriceElem struct {
 
 	OnlyForSeller bool
 	OnlyForVendor bool
+
+	// Only for groups, the filter matches if any of these chains does
+	Groups [][]FilterPriceElem
 }
 
 type FilterEntryElem struct {
@@ -95,6 +116,9 @@ type FilterEntryElem struct {
 
 	OnlyForSeller bool
 	OnlyForVendor bool
+
+	// Only for groups, the filter matches if any of these chains does
+	Groups [][]FilterEntryElem
 }
 
 // Return a comma-separated string of set codes, from a comma-separated
@@ -202,6 +226,80 @@ func fixupTypeNG(code string) []string {
 	return filters
 }
 
+func fixupArtistNG(code string) []string {
+	filters := strings.Split(strings.ToLower(code), ",")
+	for i := range filters {
+		filters[i] = strings.Trim(filters[i], "\"")
+	}
+	return filters
+}
+
+// Border colors as defined by MTGJSON
+var BorderColors = []string{"black", "white", "borderless", "silver", "gold"}
+
+func fixupBorderNG(code string) []string {
+	filters := strings.Split(strings.ToLower(code), ",")
+	for i := range filters {
+		filters[i] = strings.Trim(filters[i], "\"")
+	}
+	return filters
+}
+
+// Aliases for frame effects, same as the ones used by the is option
+var frameAliases = map[string]string{
+	"ea": "extendedart",
+	"sc": "showcase",
+}
+
+func fixupFrameNG(code string) []string {
+	filters := strings.Split(strings.ToLower(code), ",")
+	for i := range filters {
+		filters[i] = strings.Trim(filters[i], "\"")
+		alias, found := frameAliases[filters[i]]
+		if found {
+			filters[i] = alias
+		}
+	}
+	return filters
+}
+
+func fixupWatermarkNG(code string) []string {
+	filters := strings.Split(strings.ToLower(code), ",")
+	for i := range filters {
+		filters[i] = strings.Trim(filters[i], "\"")
+	}
+	return filters
+}
+
+// Oracle text may contain commas, so it is never split
+func fixupOracleNG(code string) []string {
+	return []string{strings.ToLower(strings.Trim(code, "\""))}
+}
+
+// Return the comparison and the value to compare against, a leading '='
+// after '>' or '<' makes the comparison inclusive, as in mv>=3
+func fixupComparisonNG(operation, code string) []string {
+	if operation == ":" {
+		operation = "="
+	} else if strings.HasPrefix(code, "=") {
+		operation += "="
+		code = strings.TrimPrefix(code, "=")
+	}
+	return []string{operation, strings.Trim(code, "\"")}
+}
+
+func fixupKeywordNG(code string) []string {
+	filters := strings.Split(strings.ToLower(code), ",")
+	for i := range filters {
+		filters[i] = strings.Trim(filters[i], "\"")
+	}
+	return filters
+}
+
+func fixupFormatNG(code string) []string {
+	return strings.Split(strings.ToLower(code), ",")
+}
+
 func fixupDateNG(code string) string {
 	set, err := mtgmatcher.GetSet(strings.ToUpper(code))
 	if err == nil {
@@ -369,6 +467,26 @@ func fixupContainer(code string) []string {
 	return cardobject2sources(co)
 }
 
+// Check whether the code matches the shorthand or the name of any scraper
+func isKnownStore(code string) bool {
+	var scrapers []mtgban.Scraper
+	for _, seller := range Sellers {
+		scrapers = append(scrapers, seller)
+	}
+	for _, vendor := range Vendors {
+		scrapers = append(scrapers, vendor)
+	}
+	for _, scraper := range scrapers {
+		if scraper == nil {
+			continue
+		}
+		if strings.EqualFold(scraper.Info().Shorthand, code) || strings.EqualFold(scraper.Info().Name, code) {
+			return true
+		}
+	}
+	return false
+}
+
 func price4seller(cardId, shorthand string) float64 {
 	for _, seller := range Sellers {
 		if seller != nil && strings.EqualFold(seller.Info().Shorthand, shorthand) {
@@ -403,7 +521,11 @@ func price4vendor(cardId, shorthand string) float64 {
 	return 0
 }
 
-var re *regexp.Regexp
+// Text that looks like an option, but that is not one
+var reUnknownOption = regexp.MustCompile(`^-?([a-z_]+)[:<>]\S`)
+
+// Search modes accepted by the sm option
+var SearchModes = []string{"exact", "any", "prefix", "regexp", "sealed", "mixed", "hashing"}
 
 var FilterOperations = map[string][]string{
 	"sm":        []string{":"},
@@ -443,30 +565,30 @@ var FilterOperations = map[string][]string{
 	"aseller":   []string{":"},
 	"vendor":    []string{":"},
 	"region":    []string{":"},
-}
-
-func init() {
-	var regexpOptions string
-	var opts []string
-
-	for key := range FilterOperations {
-		opts = append(opts, key)
-	}
-	// Sort keys by shorter and alphabetical (since they may be the more common)
-	sort.Slice(opts, func(i, j int) bool {
-		if len(opts[i]) == len(opts[j]) {
-			return opts[i] < opts[j]
-		}
-		return len(opts[i]) < len(opts[j])
-	})
-
-	regexpOptions = fmt.Sprintf(`-?(%s)[:<>](("([^"]+)"|\S+))+`, strings.Join(opts, "|"))
-
-	re = regexp.MustCompile(regexpOptions)
+	"a":         []string{":"},
+	"artist":    []string{":"},
+	"border":    []string{":"},
+	"frame":     []string{":"},
+	"wm":        []string{":"},
+	"watermark": []string{":"},
+	"o":         []string{":"},
+	"oracle":    []string{":"},
+	"oe":        []string{":"},
+	"mv":        []string{":", ">", "<"},
+	"cmc":       []string{":", ">", "<"},
+	"pow":       []string{":", ">", "<"},
+	"power":     []string{":", ">", "<"},
+	"tou":       []string{":", ">", "<"},
+	"toughness": []string{":", ">", "<"},
+	"kw":        []string{":"},
+	"keyword":   []string{":"},
+	"legal":     []string{":"},
+	"chg7d":     []string{":"},
+	"chg30d":    []string{":"},
+	"ath":       []string{":"},
 }
 
 func parseSearchOptionsNG(query string, blocklistRetail, blocklistBuylist []string) (config SearchConfig) {
-	var filters []FilterElem
 	var filterStores []FilterStoreElem
 	var filterPrices []FilterPriceElem
 	var filterEntries []FilterEntryElem
@@ -540,296 +662,33 @@ func parseSearchOptionsNG(query string, blocklistRetail, blocklistBuylist []stri
 		query = strings.TrimRight(query, "&*~")
 	}
 
-	// Iterate over the various possible filters
-	fields := re.FindAllString(query, -1)
-	for _, field := range fields {
-		query = strings.Replace(query, field, "", 1)
-
-		index := strings.Index(field, ":")
-		if index == -1 {
-			index = strings.Index(field, "<")
-		}
-		if index == -1 {
-			index = strings.Index(field, ">")
-		}
-		// Safety check
-		if index == -1 {
-			continue
-		}
-
-		option := field[:index]
-		operation := string(field[index])
-		code := field[index+1:]
-
-		negate := false
-		if strings.HasPrefix(option, "-") {
-			option = strings.TrimPrefix(option, "-")
-			negate = true
-		}
-
-		// Check the operation is allowed on the given option
-		if !slices.Contains(FilterOperations[option], operation) {
-			continue
-		}
-
-		switch option {
-		// Options that modify the search engine
-		case "sm":
-			config.SearchMode = strings.ToLower(code)
-		case "skip":
-			switch strings.ToLower(code) {
-			case "retail":
-				config.SkipRetail = true
-			case "buylist":
-				config.SkipBuylist = true
-			case "nosales":
-				config.SkipEmptyRetail = true
-			case "nobuys":
-				config.SkipEmptyBuylist = true
-			case "empty":
-				config.SkipEmptyRetail = true
-				config.SkipEmptyBuylist = true
-			}
-		case "sort":
-			code = strings.ToLower(code)
-			switch code {
-			case "chrono", "alpha", "retail", "buylist":
-				config.SortMode = code
-			}
-		// This option loads a specific set of uuids from a deck list, which is similar
-		// to "unpack", but with the difference that identical ids are not skipped
-		case "decklist":
-			uuids := fixupContents(code)
-			if len(uuids) < 1 {
-				continue
-			}
-			co, _ := mtgmatcher.GetUUID(uuids[0])
-			if mtgmatcher.SealedIsRandom(co.SetCode, co.UUID) {
-				continue
-			}
-			config.SearchMode = "hashing"
-			config.UUIDs, _ = mtgmatcher.GetPicksForSealed(co.SetCode, co.UUID)
-
-		// Options that modify the card searches
-		case "s", "edition":
-			filters = append(filters, FilterElem{
-				Name:   "edition",
-				Negate: negate,
-				Values: fixupEditionNG(code),
-			})
-		case "se":
-			filters = append(filters, FilterElem{
-				Name:   "edition_regexp",
-				Negate: negate,
-				Values: []string{code},
-			})
-		case "cn", "number":
-			opt := "number"
-			if operation == ">" {
-				opt = "number_greater_than"
-			} else if operation == "<" {
-				opt = "number_less_than"
-			}
-			filters = append(filters, FilterElem{
-				Name:   opt,
-				Negate: negate,
-				Values: fixupNumberNG(code),
-			})
-		case "cne":
-			filters = append(filters, FilterElem{
-				Name:   "number_regexp",
-				Negate: negate,
-				// No fixup because we need to trust input
-				Values: []string{code},
-			})
-		case "r":
-			opt := "rarity"
-			if operation == ">" {
-				opt = "rarity_greater_than"
-			} else if operation == "<" {
-				opt = "rarity_less_than"
-			}
-			filters = append(filters, FilterElem{
-				Name:   opt,
-				Negate: negate,
-				Values: fixupRarityNG(code),
-			})
-		case "f":
-			filters = append(filters, FilterElem{
-				Name:   "finish",
-				Negate: negate,
-				Values: fixupFinishNG(code),
-			})
-		case "t":
-			filters = append(filters, FilterElem{
-				Name:   "type",
-				Negate: negate,
-				Values: fixupTypeNG(code),
-			})
-		case "is", "not":
-			if option == "not" {
-				negate = !negate
-			}
-			filters = append(filters, FilterElem{
-				Name:   "is",
-				Negate: negate,
-				Values: strings.Split(strings.ToLower(code), ","),
-			})
-		case "on":
-			filters = append(filters, FilterElem{
-				Name:   "on",
-				Negate: negate,
-				Values: strings.Split(strings.ToLower(code), ","),
-			})
-		case "date":
-			opt := "date"
-			switch operation {
-			case ">":
-				opt = "date_greater_than"
-			case "<":
-				opt = "date_less_than"
-			}
-			filters = append(filters, FilterElem{
-				Name:   opt,
-				Negate: negate,
-				Values: []string{fixupDateNG(code)},
-			})
-		case "c", "color", "ci", "identity":
-			opt := "color"
-			if option == "ci" || option == "color_identity" {
-				opt = "color_identity"
-			}
-			filters = append(filters, FilterElem{
-				Name:   opt,
-				Negate: negate,
-				Values: fixupColorNG(code),
-			})
-		case "id":
-			filters = append(filters, FilterElem{
-				Name:   "idlookup",
-				Negate: negate,
-				Values: fixupIDs(code),
-			})
-		case "unpack":
-			filters = append(filters, FilterElem{
-				Name:   "idlookup",
-				Negate: negate,
-				Values: fixupPicks(code),
-			})
-		case "contents":
-			config.SearchMode = "mixed"
-			filters = append(filters, FilterElem{
-				Name:   "contents",
-				Negate: negate,
-				Values: fixupContents(code),
-			})
-		case "container":
-			filters = append(filters, FilterElem{
-				Name:   "idlookup",
-				Negate: negate,
-				Values: fixupContainer(code),
-			})
-
-		// Options that modify the searched scrapers
-		case "store", "seller", "aseller", "vendor":
-			var isSeller, isVendor bool
-			// Skip empty result entries when filtering by either option
-			switch option {
-			case "aseller":
-				config.SkipEmptyRetail = true
-				isSeller = true
-				option = "seller"
-			case "seller":
-				config.SkipEmptyRetail = true
-				isSeller = true
-				option = "seller_keep_index"
-				// When filtering out, use the more generic function
-				if negate {
-					option = "seller"
-				}
-			case "buylist":
-				config.SkipEmptyBuylist = true
-				isVendor = true
-			}
-			filterStores = append(filterStores, FilterStoreElem{
-				Name:          option,
-				Negate:        negate,
-				Values:        fixupStoreCodeNG(code),
-				OnlyForSeller: isSeller,
-				OnlyForVendor: isVendor,
-			})
-		case "region":
-			filterStores = append(filterStores, FilterStoreElem{
-				Name:   option,
-				Negate: negate,
-				Values: strings.Split(strings.ToLower(code), ","),
-			})
-
-		// Pricing Options
-		case "cond", "condr", "condb":
-			opt := "condition"
-			if operation == ">" {
-				opt = "condition_greater_than"
-			} else if operation == "<" {
-				opt = "condition_less_than"
-			}
-			filterEntries = append(filterEntries, FilterEntryElem{
-				Name:          opt,
-				Negate:        negate,
-				Values:        strings.Split(strings.ToUpper(code), ","),
-				OnlyForSeller: option == "condr",
-				OnlyForVendor: option == "condb",
-			})
-		case "price", "buy_price", "arb_price", "rev_price":
-			var isSeller, isVendor bool
-			var price4store func(string, string) float64
-			// Each of these entries applies to either retail or buylist
-			// and needs different price sources for comparisons
-			switch option {
-			case "price":
-				isSeller = true
-				price4store = price4seller
-				config.SkipEmptyRetail = true
-			case "buy_price":
-				isVendor = true
-				price4store = price4vendor
-				config.SkipEmptyBuylist = true
-			case "arb_price":
-				isSeller = true
-				price4store = price4vendor
-				config.SkipEmptyRetail = true
-			case "rev_price":
-				isVendor = true
-				price4store = price4seller
-				config.SkipEmptyBuylist = true
-			}
-			var optName string
-			switch operation {
-			case ">":
-				optName = option + "_greater_than"
-			case "<":
-				optName = option + "_less_than"
-			}
-			filter := FilterPriceElem{
-				Name:          optName,
-				Negate:        negate,
-				OnlyForSeller: isSeller,
-				OnlyForVendor: isVendor,
-				Price4Store:   price4store,
-			}
-
-			// If code is a price, just keep it, otherwise parse stores later
-			// (because this needs to know which card to compare against)
-			price, err := strconv.ParseFloat(code, 64)
-			if err == nil {
-				filter.Value = price
-			} else {
-				filter.Stores = fixupStoreCodeNG(code)
+	// Parse the query and walk its tree, every option is added to the
+	// chain of filters it belongs to, and groups are evaluated as one
+	root, tokens := parseSearchQuery(query)
+	set := &filterSet{
+		stores: filterStores,
+	}
+	compileSearchNode(&config, root, set)
+	filters := set.cards
+	filterStores = set.stores
+	filterPrices = set.prices
+	filterEntries = set.entries
+
+	// Anything that is not an option is part of the card name
+	var name string
+	var last int
+	for _, token := range tokens {
+		if token.Kind == tokenWord {
+			option := reUnknownOption.FindStringSubmatch(query[token.Start:token.End])
+			if option != nil {
+				config.addWarning("Unknown option '%s', searching it as part of the name", option[1])
 			}
-			filter.PriceCache = map[string][]float64{}
-			filterPrices = append(filterPrices, filter)
+			continue
 		}
+		name += query[last:token.Start]
+		last = token.End
 	}
+	query = name + query[last:]
 
 	// Check if we can apply a finish filter through the custom syntax
 	// or restore the original regexp if it's the last element
@@ -878,6 +737,461 @@ func parseSearchOptionsNG(query string, blocklistRetail, blocklistBuylist []stri
 	return
 }
 
+// Add the filter described by a single option to the chain it belongs to,
+// or adjust the search configuration directly
+func parseSearchOption(config *SearchConfig, set *filterSet, option, operation, code string, negate bool) {
+	// Check the operation is allowed on the given option
+	if !slices.Contains(FilterOperations[option], operation) {
+		config.addWarning("Option '%s' does not support '%s', ignoring it", option, operation)
+		return
+	}
+
+	switch option {
+	// Options that modify the search engine
+	case "sm":
+		config.SearchMode = strings.ToLower(code)
+		if !slices.Contains(SearchModes, config.SearchMode) {
+			config.addWarning("Unknown search mode '%s', using the default one", code)
+		}
+	case "skip":
+		switch strings.ToLower(code) {
+		case "retail":
+			config.SkipRetail = true
+		case "buylist":
+			config.SkipBuylist = true
+		case "nosales":
+			config.SkipEmptyRetail = true
+		case "nobuys":
+			config.SkipEmptyBuylist = true
+		case "empty":
+			config.SkipEmptyRetail = true
+			config.SkipEmptyBuylist = true
+		default:
+			config.addWarning("Unknown skip value '%s', ignoring it", code)
+		}
+	case "sort":
+		code = strings.ToLower(code)
+		switch code {
+		case "chrono", "alpha", "retail", "buylist":
+			config.SortMode = code
+		default:
+			config.addWarning("Unknown sort value '%s', ignoring it", code)
+		}
+	// This option loads a specific set of uuids from a deck list, which is similar
+	// to "unpack", but with the difference that identical ids are not skipped
+	case "decklist":
+		uuids := fixupContents(code)
+		if len(uuids) < 1 {
+			config.addWarning("Unknown product '%s'", code)
+			return
+		}
+		co, _ := mtgmatcher.GetUUID(uuids[0])
+		if mtgmatcher.SealedIsRandom(co.SetCode, co.UUID) {
+			config.addWarning("Product '%s' does not have a fixed decklist", code)
+			return
+		}
+		config.SearchMode = "hashing"
+		config.UUIDs, _ = mtgmatcher.GetPicksForSealed(co.SetCode, co.UUID)
+
+	// Options that modify the card searches
+	case "s", "edition":
+		values := fixupEditionNG(code)
+		for _, value := range values {
+			_, err := mtgmatcher.GetSet(value)
+			if err != nil {
+				config.addWarning("Unknown edition '%s'", value)
+			}
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "edition",
+			Negate: negate,
+			Values: values,
+		})
+	case "se":
+		_, err := regexp.Compile(code)
+		if err != nil {
+			config.addWarning("Invalid regular expression '%s', it will not match anything", code)
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "edition_regexp",
+			Negate: negate,
+			Values: []string{code},
+		})
+	case "cn", "number":
+		opt := "number"
+		if operation == ">" {
+			opt = "number_greater_than"
+		} else if operation == "<" {
+			opt = "number_less_than"
+		}
+		if operation != ":" {
+			_, err := strconv.Atoi(code)
+			if err != nil {
+				config.addWarning("Invalid collector number '%s', only plain numbers can be compared", code)
+			}
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   opt,
+			Negate: negate,
+			Values: fixupNumberNG(code),
+		})
+	case "cne":
+		_, err := regexp.Compile(code)
+		if err != nil {
+			config.addWarning("Invalid regular expression '%s', it will not match anything", code)
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "number_regexp",
+			Negate: negate,
+			// No fixup because we need to trust input
+			Values: []string{code},
+		})
+	case "r":
+		opt := "rarity"
+		if operation == ">" {
+			opt = "rarity_greater_than"
+		} else if operation == "<" {
+			opt = "rarity_less_than"
+		}
+		values := fixupRarityNG(code)
+		if operation != ":" {
+			_, found := rarityMap[values[0]]
+			if !found {
+				config.addWarning("Invalid rarity '%s', only standard rarities can be compared", code)
+			}
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   opt,
+			Negate: negate,
+			Values: values,
+		})
+	case "f":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "finish",
+			Negate: negate,
+			Values: fixupFinishNG(code),
+		})
+	case "t":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "type",
+			Negate: negate,
+			Values: fixupTypeNG(code),
+		})
+	case "is", "not":
+		if option == "not" {
+			negate = !negate
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "is",
+			Negate: negate,
+			Values: strings.Split(strings.ToLower(code), ","),
+		})
+	case "on":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "on",
+			Negate: negate,
+			Values: strings.Split(strings.ToLower(code), ","),
+		})
+	case "date":
+		opt := "date"
+		switch operation {
+		case ">":
+			opt = "date_greater_than"
+		case "<":
+			opt = "date_less_than"
+		}
+		date := fixupDateNG(code)
+		if date == "" {
+			config.addWarning("Invalid date '%s', use YYYY-MM-DD or a set code", code)
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   opt,
+			Negate: negate,
+			Values: []string{date},
+		})
+	case "c", "color", "ci", "identity":
+		opt := "color"
+		if option == "ci" || option == "color_identity" {
+			opt = "color_identity"
+		}
+		values := fixupColorNG(code)
+		for _, value := range values {
+			if !slices.Contains(colorMap["multi"], value) {
+				config.addWarning("Unknown color '%s'", code)
+				break
+			}
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   opt,
+			Negate: negate,
+			Values: values,
+		})
+	case "id":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "idlookup",
+			Negate: negate,
+			Values: fixupIDs(code),
+		})
+	case "unpack":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "idlookup",
+			Negate: negate,
+			Values: fixupPicks(code),
+		})
+	case "contents":
+		config.SearchMode = "mixed"
+		set.cards = append(set.cards, FilterElem{
+			Name:   "contents",
+			Negate: negate,
+			Values: fixupContents(code),
+		})
+	case "container":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "idlookup",
+			Negate: negate,
+			Values: fixupContainer(code),
+		})
+	case "a", "artist":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "artist",
+			Negate: negate,
+			Values: fixupArtistNG(code),
+		})
+	case "border":
+		values := fixupBorderNG(code)
+		for _, value := range values {
+			if !slices.Contains(BorderColors, value) {
+				config.addWarning("Unknown border '%s', use one of %s", value, strings.Join(BorderColors, ", "))
+			}
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "border",
+			Negate: negate,
+			Values: values,
+		})
+	case "frame":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "frame",
+			Negate: negate,
+			Values: fixupFrameNG(code),
+		})
+	case "wm", "watermark":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "watermark",
+			Negate: negate,
+			Values: fixupWatermarkNG(code),
+		})
+	case "o", "oracle":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "oracle",
+			Negate: negate,
+			Values: fixupOracleNG(code),
+		})
+	case "oe":
+		// Oracle text is stored in lowercase
+		_, err := regexp.Compile("(?i)" + code)
+		if err != nil {
+			config.addWarning("Invalid regular expression '%s', it will not match anything", code)
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "oracle_regexp",
+			Negate: negate,
+			Values: []string{"(?i)" + code},
+		})
+	case "mv", "cmc":
+		values := fixupComparisonNG(operation, code)
+		_, err := strconv.ParseFloat(values[1], 64)
+		if err != nil {
+			config.addWarning("Invalid mana value '%s', only numbers can be compared", values[1])
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "mana_value",
+			Negate: negate,
+			Values: values,
+		})
+	case "pow", "power", "tou", "toughness":
+		opt := "power"
+		if option == "tou" || option == "toughness" {
+			opt = "toughness"
+		}
+		values := fixupComparisonNG(operation, code)
+		if values[0] != "=" {
+			_, err := strconv.ParseFloat(values[1], 64)
+			if err != nil {
+				config.addWarning("Invalid %s '%s', only numbers can be compared", opt, values[1])
+			}
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   opt,
+			Negate: negate,
+			Values: values,
+		})
+	case "kw", "keyword":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "keyword",
+			Negate: negate,
+			Values: fixupKeywordNG(code),
+		})
+	case "legal":
+		set.cards = append(set.cards, FilterElem{
+			Name:   "legal",
+			Negate: negate,
+			Values: fixupFormatNG(code),
+		})
+	case "chg7d", "chg30d":
+		days := strings.TrimSuffix(strings.TrimPrefix(option, "chg"), "d")
+		index := strings.IndexAny(code, "<>")
+		if index < 1 {
+			config.addWarning("Invalid price change '%s', use a store followed by > or < and a percentage, ignoring it", code)
+			return
+		}
+		dataset := fixupHistoryDataset(code[:index])
+		if dataset == "" {
+			config.addWarning("Unknown price history '%s', use one of %s, ignoring it", code[:index], historyDatasetNames())
+			return
+		}
+		threshold := code[index+1:]
+		_, err := strconv.ParseFloat(threshold, 64)
+		if err != nil {
+			config.addWarning("Invalid percentage '%s', ignoring it", threshold)
+			return
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "price_change",
+			Negate: negate,
+			Values: []string{dataset, days, string(code[index]), threshold},
+		})
+	case "ath":
+		dataset := fixupHistoryDataset(code)
+		if dataset == "" {
+			config.addWarning("Unknown price history '%s', use one of %s, ignoring it", code, historyDatasetNames())
+			return
+		}
+		set.cards = append(set.cards, FilterElem{
+			Name:   "all_time_high",
+			Negate: negate,
+			Values: []string{dataset},
+		})
+
+	// Options that modify the searched scrapers
+	case "store", "seller", "aseller", "vendor":
+		var isSeller, isVendor bool
+		// Skip empty result entries when filtering by either option
+		switch option {
+		case "aseller":
+			config.SkipEmptyRetail = true
+			isSeller = true
+			option = "seller"
+		case "seller":
+			config.SkipEmptyRetail = true
+			isSeller = true
+			option = "seller_keep_index"
+			// When filtering out, use the more generic function
+			if negate {
+				option = "seller"
+			}
+		case "buylist":
+			config.SkipEmptyBuylist = true
+			isVendor = true
+		}
+		values := fixupStoreCodeNG(code)
+		for _, value := range values {
+			if !isKnownStore(value) {
+				config.addWarning("Unknown store '%s'", value)
+			}
+		}
+		set.stores = append(set.stores, FilterStoreElem{
+			Name:          option,
+			Negate:        negate,
+			Values:        values,
+			OnlyForSeller: isSeller,
+			OnlyForVendor: isVendor,
+		})
+	case "region":
+		set.stores = append(set.stores, FilterStoreElem{
+			Name:   option,
+			Negate: negate,
+			Values: strings.Split(strings.ToLower(code), ","),
+		})
+
+	// Pricing Options
+	case "cond", "condr", "condb":
+		opt := "condition"
+		if operation == ">" {
+			opt = "condition_greater_than"
+		} else if operation == "<" {
+			opt = "condition_less_than"
+		}
+		values := strings.Split(strings.ToUpper(code), ",")
+		for _, value := range values {
+			_, found := conditionMap[value]
+			if !found {
+				config.addWarning("Unknown condition '%s'", value)
+			}
+		}
+		set.entries = append(set.entries, FilterEntryElem{
+			Name:          opt,
+			Negate:        negate,
+			Values:        values,
+			OnlyForSeller: option == "condr",
+			OnlyForVendor: option == "condb",
+		})
+	case "price", "buy_price", "arb_price", "rev_price":
+		var isSeller, isVendor bool
+		var price4store func(string, string) float64
+		// Each of these entries applies to either retail or buylist
+		// and needs different price sources for comparisons
+		switch option {
+		case "price":
+			isSeller = true
+			price4store = price4seller
+			config.SkipEmptyRetail = true
+		case "buy_price":
+			isVendor = true
+			price4store = price4vendor
+			config.SkipEmptyBuylist = true
+		case "arb_price":
+			isSeller = true
+			price4store = price4vendor
+			config.SkipEmptyRetail = true
+		case "rev_price":
+			isVendor = true
+			price4store = price4seller
+			config.SkipEmptyBuylist = true
+		}
+		var optName string
+		switch operation {
+		case ">":
+			optName = option + "_greater_than"
+		case "<":
+			optName = option + "_less_than"
+		}
+		filter := FilterPriceElem{
+			Name:          optName,
+			Negate:        negate,
+			OnlyForSeller: isSeller,
+			OnlyForVendor: isVendor,
+			Price4Store:   price4store,
+		}
+
+		// If code is a price, just keep it, otherwise parse stores later
+		// (because this needs to know which card to compare against)
+		price, err := strconv.ParseFloat(code, 64)
+		if err == nil {
+			filter.Value = price
+		} else {
+			filter.Stores = fixupStoreCodeNG(code)
+			for _, store := range filter.Stores {
+				if !isKnownStore(store) {
+					config.addWarning("Unknown store '%s', prices from it will be considered zero", store)
+				}
+			}
+		}
+		filter.PriceCache = map[string][]float64{}
+		set.prices = append(set.prices, filter)
+	}
+}
+
 func compareCollectorNumber(filters []string, co *mtgmatcher.CardObject, cmpFunc func(a, b int) bool) bool {
 	if filters == nil {
 		return false
@@ -1088,6 +1402,39 @@ var rarityMap = map[string]int{
 	"special":  4,
 }
 
+// Compare a card stat with the target of a filter, values that are not
+// numbers (like '*') can only be checked for equality
+func compareStats(stat, operation, target string) bool {
+	if operation == "=" {
+		value, err1 := strconv.ParseFloat(stat, 64)
+		ref, err2 := strconv.ParseFloat(target, 64)
+		if err1 == nil && err2 == nil {
+			return value == ref
+		}
+		return strings.EqualFold(stat, target)
+	}
+
+	value, err := strconv.ParseFloat(stat, 64)
+	if err != nil {
+		return false
+	}
+	ref, err := strconv.ParseFloat(target, 64)
+	if err != nil {
+		return false
+	}
+	switch operation {
+	case ">":
+		return value > ref
+	case ">=":
+		return value >= ref
+	case "<":
+		return value < ref
+	case "<=":
+		return value <= ref
+	}
+	return false
+}
+
 var FilterCardFuncs = map[string]func(filters []string, co *mtgmatcher.CardObject) bool{
 	"edition": func(filters []string, co *mtgmatcher.CardObject) bool {
 		return !slices.Contains(filters, co.SetCode)
@@ -1163,6 +1510,92 @@ var FilterCardFuncs = map[string]func(filters []string, co *mtgmatcher.CardObjec
 		}
 		return false
 	},
+	"artist": func(filters []string, co *mtgmatcher.CardObject) bool {
+		artist := strings.ToLower(co.Artist)
+		for _, value := range filters {
+			if strings.Contains(artist, value) {
+				return false
+			}
+		}
+		return true
+	},
+	"border": func(filters []string, co *mtgmatcher.CardObject) bool {
+		return !slices.Contains(filters, co.BorderColor)
+	},
+	// Frames can be either a version (ie 1997) or an effect (ie showcase)
+	"frame": func(filters []string, co *mtgmatcher.CardObject) bool {
+		for _, value := range filters {
+			if co.FrameVersion == value || slices.Contains(co.FrameEffects, value) {
+				return false
+			}
+		}
+		return true
+	},
+	"watermark": func(filters []string, co *mtgmatcher.CardObject) bool {
+		return !slices.Contains(filters, strings.ToLower(co.Watermark))
+	},
+	"oracle": func(filters []string, co *mtgmatcher.CardObject) bool {
+		extra := getCardExtra(co)
+		if extra == nil {
+			return true
+		}
+		return !strings.Contains(extra.Text, filters[0])
+	},
+	"oracle_regexp": func(filters []string, co *mtgmatcher.CardObject) bool {
+		extra := getCardExtra(co)
+		if extra == nil {
+			return true
+		}
+		matched, _ := regexp.MatchString(filters[0], extra.Text)
+		return !matched
+	},
+	"mana_value": func(filters []string, co *mtgmatcher.CardObject) bool {
+		extra := getCardExtra(co)
+		if extra == nil {
+			return true
+		}
+		return !compareStats(strconv.FormatFloat(extra.ManaValue, 'f', -1, 64), filters[0], filters[1])
+	},
+	"power": func(filters []string, co *mtgmatcher.CardObject) bool {
+		extra := getCardExtra(co)
+		if extra == nil || extra.Power == "" {
+			return true
+		}
+		return !compareStats(extra.Power, filters[0], filters[1])
+	},
+	"toughness": func(filters []string, co *mtgmatcher.CardObject) bool {
+		extra := getCardExtra(co)
+		if extra == nil || extra.Toughness == "" {
+			return true
+		}
+		return !compareStats(extra.Toughness, filters[0], filters[1])
+	},
+	"keyword": func(filters []string, co *mtgmatcher.CardObject) bool {
+		extra := getCardExtra(co)
+		if extra == nil {
+			return true
+		}
+		for _, value := range filters {
+			if slices.Contains(extra.Keywords, value) {
+				return false
+			}
+		}
+		return true
+	},
+	"legal": func(filters []string, co *mtgmatcher.CardObject) bool {
+		extra := getCardExtra(co)
+		if extra == nil {
+			return true
+		}
+		for _, value := range filters {
+			if slices.Contains(extra.Legal, value) {
+				return false
+			}
+		}
+		return true
+	},
+	"price_change":  filterPriceChange,
+	"all_time_high": filterAllTimeHigh,
 	"number": func(filters []string, co *mtgmatcher.CardObject) bool {
 		return !slices.Contains(filters, strings.ToLower(co.Number))
 	},
@@ -1354,7 +1787,18 @@ func shouldSkipCardNG(cardId string, filters []FilterElem) bool {
 	}
 
 	for i := range filters {
-		res := FilterCardFuncs[filters[i].Name](filters[i].Values, co)
+		var res bool
+		if filters[i].Name == FilterGroupName {
+			res = true
+			for _, group := range filters[i].Groups {
+				if !shouldSkipCardNG(cardId, group) {
+					res = false
+					break
+				}
+			}
+		} else {
+			res = FilterCardFuncs[filters[i].Name](filters[i].Values, co)
+		}
 		if filters[i].Negate {
 			res = !res
 		}
@@ -1433,7 +1877,18 @@ func shouldSkipStoreNG(scraper mtgban.Scraper, filters []FilterStoreElem) bool {
 			continue
 		}
 
-		res := FilterStoreFuncs[filters[i].Name](filters[i].Values, scraper)
+		var res bool
+		if filters[i].Name == FilterGroupName {
+			res = true
+			for _, group := range filters[i].Groups {
+				if !shouldSkipStoreNG(scraper, group) {
+					res = false
+					break
+				}
+			}
+		} else {
+			res = FilterStoreFuncs[filters[i].Name](filters[i].Values, scraper)
+		}
 		if filters[i].Negate {
 			res = !res
 		}
@@ -1491,6 +1946,23 @@ func shouldSkipPriceNG(cardId string, entry mtgban.GenericEntry, filters []Filte
 			continue
 		}
 
+		if filters[i].Name == FilterGroupName {
+			res := true
+			for _, group := range filters[i].Groups {
+				if !shouldSkipPriceNG(cardId, entry, group) {
+					res = false
+					break
+				}
+			}
+			if filters[i].Negate {
+				res = !res
+			}
+			if res {
+				return true
+			}
+			continue
+		}
+
 		// Check if we already have prices for this card
 		_, found := filters[i].PriceCache[cardId]
 		if !found {
@@ -1558,7 +2030,18 @@ func shouldSkipEntryNG(entry mtgban.GenericEntry, filters []FilterEntryElem) boo
 			continue
 		}
 
-		res := FilterEntryFuncs[filters[i].Name](filters[i].Values, entry)
+		var res bool
+		if filters[i].Name == FilterGroupName {
+			res = true
+			for _, group := range filters[i].Groups {
+				if !shouldSkipEntryNG(entry, group) {
+					res = false
+					break
+				}
+			}
+		} else {
+			res = FilterEntryFuncs[filters[i].Name](filters[i].Values, entry)
+		}
 		if filters[i].Negate {
 			res = !res
 		}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+)
+
+// Cards of the test datastore that gameplay filters are checked against
+var GameplayTestCards = []string{
+	"Ragavan, Nimble Pilferer",
+	"Counterspell",
+	"Urza's Saga",
+	"Do or Die",
+	"Erase (Not the Urza's Legacy One)",
+}
+
+var GameplayFilterTests = []struct {
+	Query    string
+	Expected []string
+}{
+	{
+		Query:    "o:treasure",
+		Expected: []string{"Ragavan, Nimble Pilferer"},
+	},
+	{
+		Query:    "o:\"counter target\"",
+		Expected: []string{"Counterspell"},
+	},
+	{
+		Query:    "-o:target",
+		Expected: []string{"Ragavan, Nimble Pilferer", "Urza's Saga"},
+	},
+	{
+		Query:    "oe:^exile",
+		Expected: []string{"Erase (Not the Urza's Legacy One)"},
+	},
+	{
+		Query:    "mv:1",
+		Expected: []string{"Ragavan, Nimble Pilferer"},
+	},
+	{
+		Query:    "mv>=2",
+		Expected: []string{"Counterspell", "Do or Die", "Erase (Not the Urza's Legacy One)"},
+	},
+	{
+		Query:    "cmc<1",
+		Expected: []string{"Urza's Saga"},
+	},
+	{
+		Query:    "pow>1",
+		Expected: []string{"Ragavan, Nimble Pilferer"},
+	},
+	{
+		Query:    "tou:1",
+		Expected: []string{"Ragavan, Nimble Pilferer"},
+	},
+	{
+		Query:    "tou>1",
+		Expected: nil,
+	},
+	{
+		Query:    "kw:dash",
+		Expected: []string{"Ragavan, Nimble Pilferer"},
+	},
+	{
+		Query:    "keyword:flying,\"dash\"",
+		Expected: []string{"Ragavan, Nimble Pilferer"},
+	},
+	{
+		Query:    "legal:vintage",
+		Expected: []string{"Do or Die"},
+	},
+	{
+		Query:    "legal:modern -mv:0",
+		Expected: []string{"Counterspell", "Ragavan, Nimble Pilferer"},
+	},
+}
+
+func TestGameplayFilters(t *testing.T) {
+	for _, test := range GameplayFilterTests {
+		test := test
+		t.Run(test.Query, func(t *testing.T) {
+			t.Parallel()
+			config := parseSearchOptionsNG(test.Query, nil, nil)
+
+			var matched []string
+			for _, name := range GameplayTestCards {
+				uuids, err := mtgmatcher.SearchEquals(name)
+				if err != nil {
+					t.Fatalf("FAIL: Card %s not found in the datastore: %s", name, err)
+				}
+				for _, uuid := range uuids {
+					if !shouldSkipCardNG(uuid, config.CardFilters) {
+						matched = append(matched, name)
+						break
+					}
+				}
+			}
+			sort.Strings(matched)
+
+			if len(matched) != len(test.Expected) {
+				t.Fatalf("FAIL: Expected %q, got %q", test.Expected, matched)
+			}
+			for i := range matched {
+				if matched[i] != test.Expected[i] {
+					t.Fatalf("FAIL: Expected %q, got %q", test.Expected, matched)
+				}
+			}
+		})
+	}
+}
+
+var CompareStatsTests = []struct {
+	Stat      string
+	Operation string
+	Target    string
+	Expected  bool
+}{
+	{"2", "=", "2", true},
+	{"2", "=", "2.0", true},
+	{"*", "=", "*", true},
+	{"1+*", "=", "*", false},
+	{"3", ">", "2", true},
+	{"2", ">", "2", false},
+	{"2", ">=", "2", true},
+	{"2", "<=", "1", false},
+	{"0.5", "<", "1", true},
+	{"*", ">", "0", false},
+	{"2", ">", "x", false},
+}
+
+func TestCompareStats(t *testing.T) {
+	for _, test := range CompareStatsTests {
+		res := compareStats(test.Stat, test.Operation, test.Target)
+		if res != test.Expected {
+			t.Errorf("FAIL: Expected %s %s %s to be %v, got %v", test.Stat, test.Operation, test.Target, test.Expected, res)
+		}
+	}
+}
+
+var QuotedValueTests = []struct {
+	Query    string
+	Expected string
+}{
+	{
+		Query:    "border:\"borderless\"",
+		Expected: "card border neg=false [\"borderless\"]",
+	},
+	{
+		Query:    "frame:\"showcase\"",
+		Expected: "card frame neg=false [\"showcase\"]",
+	},
+	{
+		Query:    "wm:\"orzhov\"",
+		Expected: "card watermark neg=false [\"orzhov\"]",
+	},
+	{
+		Query:    "mv>=\"3\"",
+		Expected: "card mana_value neg=false [\">=\" \"3\"]",
+	},
+}
+
+func TestQuotedValues(t *testing.T) {
+	for _, test := range QuotedValueTests {
+		test := test
+		t.Run(test.Query, func(t *testing.T) {
+			t.Parallel()
+			config := parseSearchOptionsNG(test.Query, nil, nil)
+			if len(config.CardFilters) != 1 {
+				t.Fatalf("FAIL: Expected one card filter, got %+v", config.CardFilters)
+			}
+			filter := config.CardFilters[0]
+			out := fmt.Sprintf("card %s neg=%v %q", filter.Name, filter.Negate, filter.Values)
+			if out != test.Expected {
+				t.Errorf("FAIL: Expected '%s', got '%s'", test.Expected, out)
+			}
+		})
+	}
+}
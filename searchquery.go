@@ -0,0 +1,472 @@
+package main
+
+import (
+	"strings"
+)
+
+type searchTokenKind int
+
+const (
+	// Any text that is not part of the query syntax, used for the card name
+	tokenWord searchTokenKind = iota
+
+	// An option in the form of [-]option[:<>]value
+	tokenOption
+
+	// The 'or' keyword between two filters or groups
+	tokenOr
+
+	// Parentheses opening a group, optionally negated with '-('
+	tokenOpen
+	tokenNegOpen
+
+	// Parenthesis closing a group
+	tokenClose
+)
+
+type searchToken struct {
+	Kind searchTokenKind
+
+	// Position of the token in the original query
+	Start int
+	End   int
+
+	// Only for tokenOption
+	Option    string
+	Operation string
+	Code      string
+	Negate    bool
+}
+
+// A node of the query expression tree, either a single option or a group
+// of nodes, matching when all children match, or any of them if Or is set
+type searchNode struct {
+	Negate bool
+
+	// Set for leaf nodes
+	Token *searchToken
+
+	Or       bool
+	Children []*searchNode
+}
+
+// Split a query in tokens, leaving the disambiguation of parentheses and
+// 'or' keywords to the parser
+func tokenizeSearchQuery(query string) []searchToken {
+	var tokens []searchToken
+
+	i := 0
+	for i < len(query) {
+		switch query[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+			continue
+		case '(':
+			tokens = append(tokens, searchToken{Kind: tokenOpen, Start: i, End: i + 1})
+			i++
+			continue
+		case ')':
+			tokens = append(tokens, searchToken{Kind: tokenClose, Start: i, End: i + 1})
+			i++
+			continue
+		case '-':
+			if i+1 < len(query) && query[i+1] == '(' {
+				tokens = append(tokens, searchToken{Kind: tokenNegOpen, Start: i, End: i + 2})
+				i += 2
+				continue
+			}
+		}
+
+		// Read until the next space, keeping quoted text together
+		start := i
+		var opens, closes int
+		for i < len(query) && !strings.ContainsRune(" \t\n\r", rune(query[i])) {
+			switch query[i] {
+			case '"':
+				end := strings.IndexByte(query[i+1:], '"')
+				if end == -1 {
+					i = len(query)
+					continue
+				}
+				i += end + 1
+			case '(':
+				opens++
+			case ')':
+				closes++
+			}
+			i++
+		}
+
+		// Unbalanced trailing parentheses close a group, anything else
+		// belongs to the value (like in a regular expression)
+		end := i
+		var trailing []searchToken
+		for closes > opens && query[end-1] == ')' {
+			end--
+			closes--
+			trailing = append([]searchToken{{Kind: tokenClose, Start: end, End: end + 1}}, trailing...)
+		}
+
+		tokens = append(tokens, newSearchToken(query, start, end))
+		tokens = append(tokens, trailing...)
+	}
+
+	return tokens
+}
+
+func newSearchToken(query string, start, end int) searchToken {
+	token := searchToken{
+		Kind:  tokenWord,
+		Start: start,
+		End:   end,
+	}
+	text := query[start:end]
+
+	if strings.EqualFold(text, "or") {
+		token.Kind = tokenOr
+		return token
+	}
+
+	index := strings.IndexAny(text, ":<>")
+	if index < 1 {
+		return token
+	}
+	option := text[:index]
+	if strings.HasPrefix(option, "-") {
+		option = strings.TrimPrefix(option, "-")
+		token.Negate = true
+	}
+	_, found := FilterOperations[option]
+	if !found || index == len(text)-1 {
+		token.Negate = false
+		return token
+	}
+
+	token.Kind = tokenOption
+	token.Option = option
+	token.Operation = string(text[index])
+	token.Code = text[index+1:]
+	return token
+}
+
+// Parse a query in an expression tree, the returned tokens carry the
+// position of the text that is not part of the query syntax
+func parseSearchQuery(query string) (*searchNode, []searchToken) {
+	tokens := tokenizeSearchQuery(query)
+
+	// Card names may contain parentheses and 'or', so these are considered
+	// syntax only when they surround or separate options
+	for {
+		changed := demoteGroups(tokens)
+		changed = demoteOrs(tokens) || changed
+		if !changed {
+			break
+		}
+	}
+
+	var filters []searchToken
+	for _, token := range tokens {
+		if token.Kind != tokenWord {
+			filters = append(filters, token)
+		}
+	}
+
+	parser := &searchParser{tokens: filters}
+	return parser.parseOr(), tokens
+}
+
+// Turn into words any parentheses that are unbalanced, empty or that contain words
+func demoteGroups(tokens []searchToken) bool {
+	var changed bool
+	var stack []int
+	for i := range tokens {
+		switch tokens[i].Kind {
+		case tokenOpen, tokenNegOpen:
+			stack = append(stack, i)
+		case tokenClose:
+			if len(stack) == 0 {
+				tokens[i].Kind = tokenWord
+				changed = true
+				continue
+			}
+			open := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			isLiteral := open+1 == i
+			for j := open + 1; j < i; j++ {
+				if tokens[j].Kind == tokenWord {
+					isLiteral = true
+					break
+				}
+			}
+			if isLiteral {
+				tokens[open].Kind = tokenWord
+				tokens[i].Kind = tokenWord
+				changed = true
+			}
+		}
+	}
+	for _, open := range stack {
+		tokens[open].Kind = tokenWord
+		changed = true
+	}
+	return changed
+}
+
+// Turn into words any 'or' that does not sit between two options or groups
+func demoteOrs(tokens []searchToken) bool {
+	var changed bool
+	for i := range tokens {
+		if tokens[i].Kind != tokenOr {
+			continue
+		}
+		if i == 0 || i == len(tokens)-1 {
+			tokens[i].Kind = tokenWord
+			changed = true
+			continue
+		}
+		switch tokens[i-1].Kind {
+		case tokenWord, tokenOr, tokenOpen, tokenNegOpen:
+			tokens[i].Kind = tokenWord
+			changed = true
+			continue
+		}
+		switch tokens[i+1].Kind {
+		case tokenWord, tokenOr, tokenClose:
+			tokens[i].Kind = tokenWord
+			changed = true
+		}
+	}
+	return changed
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func (p *searchParser) peek() *searchToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *searchParser) parseOr() *searchNode {
+	children := []*searchNode{p.parseAnd()}
+	for p.peek() != nil && p.peek().Kind == tokenOr {
+		p.pos++
+		children = append(children, p.parseAnd())
+	}
+	if len(children) == 1 {
+		return children[0]
+	}
+	return &searchNode{
+		Or:       true,
+		Children: children,
+	}
+}
+
+func (p *searchParser) parseAnd() *searchNode {
+	node := &searchNode{}
+	for {
+		token := p.peek()
+		if token == nil || token.Kind == tokenOr || token.Kind == tokenClose {
+			break
+		}
+		node.Children = append(node.Children, p.parseUnary())
+	}
+	if len(node.Children) == 1 {
+		return node.Children[0]
+	}
+	return node
+}
+
+func (p *searchParser) parseUnary() *searchNode {
+	token := p.peek()
+	p.pos++
+
+	if token.Kind == tokenOption {
+		return &searchNode{
+			Negate: token.Negate,
+			Token:  token,
+		}
+	}
+
+	// Parentheses are balanced at this point
+	node := p.parseOr()
+	p.pos++
+
+	if token.Kind == tokenNegOpen {
+		// Negate groups directly, so that they are evaluated only once
+		if node.Token == nil && !node.Negate {
+			node.Negate = true
+			return node
+		}
+		return &searchNode{
+			Negate:   true,
+			Children: []*searchNode{node},
+		}
+	}
+	return node
+}
+
+// Filters collected from a node of the tree, split by the stage they apply to
+type filterSet struct {
+	cards   []FilterElem
+	stores  []FilterStoreElem
+	prices  []FilterPriceElem
+	entries []FilterEntryElem
+}
+
+func (set *filterSet) String() string {
+	var descs []string
+	for _, filter := range set.cards {
+		descs = append(descs, filter.String())
+	}
+	for _, filter := range set.stores {
+		descs = append(descs, filter.String())
+	}
+	for _, filter := range set.prices {
+		descs = append(descs, filter.String())
+	}
+	for _, filter := range set.entries {
+		descs = append(descs, filter.String())
+	}
+	return strings.Join(descs, " ")
+}
+
+func (set *filterSet) stages() int {
+	var stages int
+	for _, size := range []int{len(set.cards), len(set.stores), len(set.prices), len(set.entries)} {
+		if size > 0 {
+			stages++
+		}
+	}
+	return stages
+}
+
+// Add the filters of a node to the set, plain conjunctions are flattened
+// in the existing chains so that they behave exactly as before
+func compileSearchNode(config *SearchConfig, node *searchNode, set *filterSet) {
+	if node.Token != nil {
+		parseSearchOption(config, set, node.Token.Option, node.Token.Operation, node.Token.Code, node.Negate)
+		return
+	}
+
+	if !node.Or && !node.Negate {
+		for _, child := range node.Children {
+			compileSearchNode(config, child, set)
+		}
+		return
+	}
+
+	var branches []*filterSet
+	if node.Or {
+		for _, child := range node.Children {
+			branch := &filterSet{}
+			compileSearchNode(config, child, branch)
+			branches = append(branches, branch)
+		}
+	} else {
+		branch := &filterSet{}
+		for _, child := range node.Children {
+			compileSearchNode(config, child, branch)
+		}
+		branches = append(branches, branch)
+	}
+
+	appendFilterGroup(config, set, branches, node.Negate)
+}
+
+// Add a group to the chain of the stage all branches belong to
+// Groups with branches spanning multiple stages cannot be evaluated, and
+// neither can groups with an empty branch or with filters applying to
+// different kinds of stores, so they are dropped
+func appendFilterGroup(config *SearchConfig, set *filterSet, branches []*filterSet, negate bool) {
+	var descs []string
+	for _, branch := range branches {
+		descs = append(descs, branch.String())
+	}
+	desc := describeGroup(negate, descs)
+
+	all := &filterSet{}
+	for _, branch := range branches {
+		if branch.stages() == 0 {
+			config.addWarning("Group %s has a branch without any filter, ignoring it", desc)
+			return
+		}
+		all.cards = append(all.cards, branch.cards...)
+		all.stores = append(all.stores, branch.stores...)
+		all.prices = append(all.prices, branch.prices...)
+		all.entries = append(all.entries, branch.entries...)
+	}
+	if all.stages() != 1 {
+		config.addWarning("Group %s mixes options filtering cards, stores, conditions and prices, ignoring it", desc)
+		return
+	}
+
+	// Filters are skipped on the entries they do not apply to, so a branch
+	// would match any of those entries, and the whole group with it
+	var roles [][2]bool
+	for _, filter := range all.stores {
+		roles = append(roles, [2]bool{filter.OnlyForSeller, filter.OnlyForVendor})
+	}
+	for _, filter := range all.prices {
+		roles = append(roles, [2]bool{filter.OnlyForSeller, filter.OnlyForVendor})
+	}
+	for _, filter := range all.entries {
+		roles = append(roles, [2]bool{filter.OnlyForSeller, filter.OnlyForVendor})
+	}
+	for _, role := range roles {
+		if role != roles[0] {
+			config.addWarning("Group %s mixes options applying to sellers and vendors differently, ignoring it", desc)
+			return
+		}
+	}
+
+	switch {
+	case len(all.cards) > 0:
+		group := FilterElem{
+			Name:   FilterGroupName,
+			Negate: negate,
+		}
+		for _, branch := range branches {
+			group.Groups = append(group.Groups, branch.cards)
+		}
+		set.cards = append(set.cards, group)
+	case len(all.stores) > 0:
+		group := FilterStoreElem{
+			Name:          FilterGroupName,
+			Negate:        negate,
+			OnlyForSeller: roles[0][0],
+			OnlyForVendor: roles[0][1],
+		}
+		for _, branch := range branches {
+			group.Groups = append(group.Groups, branch.stores)
+		}
+		set.stores = append(set.stores, group)
+	case len(all.prices) > 0:
+		group := FilterPriceElem{
+			Name:          FilterGroupName,
+			Negate:        negate,
+			OnlyForSeller: roles[0][0],
+			OnlyForVendor: roles[0][1],
+		}
+		for _, branch := range branches {
+			group.Groups = append(group.Groups, branch.prices)
+		}
+		set.prices = append(set.prices, group)
+	case len(all.entries) > 0:
+		group := FilterEntryElem{
+			Name:          FilterGroupName,
+			Negate:        negate,
+			OnlyForSeller: roles[0][0],
+			OnlyForVendor: roles[0][1],
+		}
+		for _, branch := range branches {
+			group.Groups = append(group.Groups, branch.entries)
+		}
+		set.entries = append(set.entries, group)
+	}
+}
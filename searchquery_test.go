@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Summarize the parts of a config that the query language can set
+func describeSearchConfig(config SearchConfig) string {
+	out := []string{
+		"mode=" + config.SearchMode,
+		"sort=" + config.SortMode,
+		fmt.Sprintf("name=%q", config.CleanQuery),
+		fmt.Sprintf("uuids=%q", config.UUIDs),
+		fmt.Sprintf("skip=%v,%v,%v,%v", config.SkipRetail, config.SkipBuylist, config.SkipEmptyRetail, config.SkipEmptyBuylist),
+	}
+	for _, filter := range config.CardFilters {
+		out = append(out, fmt.Sprintf("card %s neg=%v %q", filter.Name, filter.Negate, filter.Values))
+	}
+	for _, filter := range config.StoreFilters {
+		out = append(out, fmt.Sprintf("store %s neg=%v %q seller=%v vendor=%v", filter.Name, filter.Negate, filter.Values, filter.OnlyForSeller, filter.OnlyForVendor))
+	}
+	for _, filter := range config.PriceFilters {
+		out = append(out, fmt.Sprintf("price %s neg=%v %v seller=%v vendor=%v", filter.Name, filter.Negate, filter.Value, filter.OnlyForSeller, filter.OnlyForVendor))
+	}
+	for _, filter := range config.EntryFilters {
+		out = append(out, fmt.Sprintf("entry %s neg=%v %q seller=%v vendor=%v", filter.Name, filter.Negate, filter.Values, filter.OnlyForSeller, filter.OnlyForVendor))
+	}
+	return strings.Join(out, "; ")
+}
+
+// Summarize a token as its kind and text
+func describeToken(query string, token searchToken) string {
+	text := query[token.Start:token.End]
+	switch token.Kind {
+	case tokenOption:
+		return "option " + text
+	case tokenOr:
+		return "or"
+	case tokenOpen:
+		return "open"
+	case tokenNegOpen:
+		return "negopen"
+	case tokenClose:
+		return "close"
+	}
+	return "word " + text
+}
+
+var TokenizeTests = []struct {
+	Query    string
+	Expected []string
+}{
+	{
+		Query:    "Ragavan s:MH2",
+		Expected: []string{"word Ragavan", "option s:MH2"},
+	},
+	{
+		Query:    "Erase (Not the Urza's Legacy One)",
+		Expected: []string{"word Erase", "open", "word Not", "word the", "word Urza's", "word Legacy", "word One", "close"},
+	},
+	{
+		Query:    "Do or Die",
+		Expected: []string{"word Do", "or", "word Die"},
+	},
+	{
+		Query:    "(s:MH2 or s:MH3) price>5",
+		Expected: []string{"open", "option s:MH2", "or", "option s:MH3", "close", "option price>5"},
+	},
+	{
+		Query:    "-(r:common or r:uncommon)",
+		Expected: []string{"negopen", "option r:common", "or", "option r:uncommon", "close"},
+	},
+	{
+		Query:    `s:"Modern Horizons 2" Ragavan`,
+		Expected: []string{`option s:"Modern Horizons 2"`, "word Ragavan"},
+	},
+	{
+		Query:    `(a:"Simon Dominic")`,
+		Expected: []string{"open", `option a:"Simon Dominic"`, "close"},
+	},
+	{
+		Query:    "se:(MH2|MH3)",
+		Expected: []string{"option se:(MH2|MH3)"},
+	},
+	{
+		Query:    "(se:(MH2|MH3) or s:PLS)",
+		Expected: []string{"open", "option se:(MH2|MH3)", "or", "option s:PLS", "close"},
+	},
+	{
+		Query:    "-s:MH2 -seller:CK",
+		Expected: []string{"option -s:MH2", "option -seller:CK"},
+	},
+	{
+		Query:    "Ragavan nope:value",
+		Expected: []string{"word Ragavan", "word nope:value"},
+	},
+}
+
+func TestTokenizeSearchQuery(t *testing.T) {
+	for _, test := range TokenizeTests {
+		test := test
+		t.Run(test.Query, func(t *testing.T) {
+			t.Parallel()
+			var out []string
+			for _, token := range tokenizeSearchQuery(test.Query) {
+				out = append(out, describeToken(test.Query, token))
+			}
+			if strings.Join(out, "|") != strings.Join(test.Expected, "|") {
+				t.Errorf("FAIL: Expected '%q' got '%q'", test.Expected, out)
+			}
+		})
+	}
+}
+
+var ParseTests = []struct {
+	Query   string
+	Name    string
+	Filters string
+	Warning string
+}{
+	{
+		Query:   "Erase (Not the Urza's Legacy One) s:UNH",
+		Name:    "Erase (Not the Urza's Legacy One)",
+		Filters: "edition:UNH",
+	},
+	{
+		Query:   "Do or Die s:PLS",
+		Name:    "Do or Die",
+		Filters: "edition:PLS",
+	},
+	{
+		Query:   "Do or Die or s:PLS",
+		Name:    "Do or Die or",
+		Filters: "edition:PLS",
+	},
+	{
+		Query:   "(s:MH2 or s:PLS) Counterspell",
+		Name:    "Counterspell",
+		Filters: "(edition:MH2 or edition:PLS)",
+	},
+	{
+		Query:   "-(r:common or r:uncommon) s:MH2",
+		Filters: "-(rarity:common or rarity:uncommon) edition:MH2",
+	},
+	{
+		Query:   "-(s:MH2 r:mythic)",
+		Filters: "-(edition:MH2 rarity:mythic)",
+	},
+	{
+		Query:   "-(-s:MH2)",
+		Filters: "-(-edition:MH2)",
+	},
+	{
+		Query:   `s:"Modern Horizons 2" Ragavan`,
+		Name:    "Ragavan",
+		Filters: "edition:MH2",
+	},
+	{
+		Query:   `-(a:"Simon Dominic" or a:"Zack Stella")`,
+		Filters: "-(artist:simon dominic or artist:zack stella)",
+	},
+	{
+		Query:   "(seller:CK or seller:SCG) Ragavan",
+		Name:    "Ragavan",
+		Filters: "(seller_keep_index:ck or seller_keep_index:scg)",
+	},
+	{
+		Query:   "(s:MH2 or seller:CK) Ragavan",
+		Name:    "Ragavan",
+		Warning: "mixes options filtering cards, stores, conditions and prices",
+	},
+	{
+		Query:   "-(seller:CK or vendor:SCG) Ragavan",
+		Name:    "Ragavan",
+		Warning: "mixes options applying to sellers and vendors differently",
+	},
+	{
+		Query:   "(seller:CK or store:SCG) Ragavan",
+		Name:    "Ragavan",
+		Warning: "mixes options applying to sellers and vendors differently",
+	},
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	for _, test := range ParseTests {
+		test := test
+		t.Run(test.Query, func(t *testing.T) {
+			t.Parallel()
+			config := parseSearchOptionsNG(test.Query, nil, nil)
+			if config.CleanQuery != test.Name {
+				t.Errorf("FAIL: Expected name '%s' got '%s'", test.Name, config.CleanQuery)
+			}
+			set := &filterSet{
+				cards:   config.CardFilters,
+				stores:  config.StoreFilters,
+				prices:  config.PriceFilters,
+				entries: config.EntryFilters,
+			}
+			if set.String() != test.Filters {
+				t.Errorf("FAIL: Expected filters '%s' got '%s'", test.Filters, set.String())
+			}
+			if test.Warning != "" && !strings.Contains(strings.Join(config.Warnings, "\n"), test.Warning) {
+				t.Errorf("FAIL: Expected warning '%s' got %q", test.Warning, config.Warnings)
+			}
+		})
+	}
+}
+
+// Queries without the new syntax need to be parsed like the regexp parser
+// used to, the expected values were generated with that parser
+var CompatibilityTests = []struct {
+	Query    string
+	Expected string
+}{
+	{
+		Query:    "Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false",
+	},
+	{
+		Query:    "Ragavan, Nimble Pilferer s:MH2",
+		Expected: "mode=; sort=; name=\"Ragavan, Nimble Pilferer\"; uuids=[]; skip=false,false,false,false; card edition neg=false [\"MH2\"]",
+	},
+	{
+		Query:    "Counterspell s:MH2 cn:5 f:foil",
+		Expected: "mode=; sort=; name=\"Counterspell\"; uuids=[]; skip=false,false,false,false; card edition neg=false [\"MH2\"]; card number neg=false [\"5\"]; card finish neg=false [\"foil\"]",
+	},
+	{
+		Query:    "Counterspell -s:MH2 f:nonfoil",
+		Expected: "mode=; sort=; name=\"Counterspell\"; uuids=[]; skip=false,false,false,false; card edition neg=true [\"MH2\"]; card finish neg=false [\"nonfoil\"]",
+	},
+	{
+		Query:    "Erase (Not the Urza's Legacy One)",
+		Expected: "mode=; sort=; name=\"Erase (Not the Urza's Legacy One)\"; uuids=[]; skip=false,false,false,false",
+	},
+	{
+		Query:    "Erase (Not the Urza's Legacy One) s:UNH",
+		Expected: "mode=; sort=; name=\"Erase (Not the Urza's Legacy One)\"; uuids=[]; skip=false,false,false,false; card edition neg=false [\"UNH\"]",
+	},
+	{
+		Query:    "Do or Die",
+		Expected: "mode=; sort=; name=\"Do or Die\"; uuids=[]; skip=false,false,false,false",
+	},
+	{
+		Query:    "Do or Die s:PLS",
+		Expected: "mode=; sort=; name=\"Do or Die\"; uuids=[]; skip=false,false,false,false; card edition neg=false [\"PLS\"]",
+	},
+	{
+		Query:    "Urza's Saga sm:prefix",
+		Expected: "mode=prefix; sort=; name=\"Urza's Saga\"; uuids=[]; skip=false,false,false,false",
+	},
+	{
+		Query:    "Urza's Saga sm:exact sort:chrono",
+		Expected: "mode=exact; sort=chrono; name=\"Urza's Saga\"; uuids=[]; skip=false,false,false,false",
+	},
+	{
+		Query:    "Rag sm:prefix sort:retail",
+		Expected: "mode=prefix; sort=retail; name=\"Rag\"; uuids=[]; skip=false,false,false,false",
+	},
+	{
+		Query:    "Ragavan seller:CK,SCG vendor:ABU",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,true,false; store seller_keep_index neg=false [\"ck\" \"scg\"] seller=true vendor=false; store vendor neg=false [\"abu\"] seller=false vendor=false",
+	},
+	{
+		Query:    "Ragavan -seller:CK",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,true,false; store seller neg=true [\"ck\"] seller=true vendor=false",
+	},
+	{
+		Query:    "Ragavan store:TCG_LOW -vendor:CK",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; store store neg=false [\"tcg low\"] seller=false vendor=false; store vendor neg=true [\"ck\"] seller=false vendor=false",
+	},
+	{
+		Query:    "Ragavan price>5 price<100",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,true,false; price price_greater_than neg=false 5 seller=true vendor=false; price price_less_than neg=false 100 seller=true vendor=false",
+	},
+	{
+		Query:    "Ragavan buy_price>1",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,true; price buy_price_greater_than neg=false 1 seller=false vendor=true",
+	},
+	{
+		Query:    "Ragavan cond:NM",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; entry condition neg=false [\"NM\"] seller=false vendor=false",
+	},
+	{
+		Query:    "Ragavan -cond:HP,PO",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; entry condition neg=true [\"HP\" \"PO\"] seller=false vendor=false",
+	},
+	{
+		Query:    "Ragavan condr:SP condb:NM",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; entry condition neg=false [\"SP\"] seller=true vendor=false; entry condition neg=false [\"NM\"] seller=false vendor=true",
+	},
+	{
+		Query:    "Ragavan r:mythic",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card rarity neg=false [\"mythic\"]",
+	},
+	{
+		Query:    "Ragavan r>uncommon",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card rarity_greater_than neg=false [\"uncommon\"]",
+	},
+	{
+		Query:    "s:MH2 r:rare",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card edition neg=false [\"MH2\"]; card rarity neg=false [\"rare\"]",
+	},
+	{
+		Query:    "c:R Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card color neg=false [\"R\"]",
+	},
+	{
+		Query:    "ci:UR",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card color_identity neg=false [\"U\" \"R\"]",
+	},
+	{
+		Query:    "cn>3 s:MH2",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card number_greater_than neg=false [\"3\"]; card edition neg=false [\"MH2\"]",
+	},
+	{
+		Query:    "cn<10",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card number_less_than neg=false [\"10\"]",
+	},
+	{
+		Query:    "t:creature Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card type neg=false [\"Creature\"]",
+	},
+	{
+		Query:    "is:reserved",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card is neg=false [\"reserved\"]",
+	},
+	{
+		Query:    "not:reprint Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card is neg=true [\"reprint\"]",
+	},
+	{
+		Query:    "skip:retail Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=true,false,false,false",
+	},
+	{
+		Query:    "skip:empty Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,true,true",
+	},
+	{
+		Query:    "region:us Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; store region neg=false [\"us\"] seller=false vendor=false",
+	},
+	{
+		Query:    "se:MH",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card edition_regexp neg=false [\"MH\"]",
+	},
+	{
+		Query:    "-s:MH2,PLS Counterspell",
+		Expected: "mode=; sort=; name=\"Counterspell\"; uuids=[]; skip=false,false,false,false; card edition neg=true [\"MH2\" \"PLS\"]",
+	},
+	{
+		Query:    "id:MH2",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card idlookup neg=false [\"MH2\"]",
+	},
+	{
+		Query:    "date>2021-01-01",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card date_greater_than neg=false [\"2021-01-01\"]",
+	},
+	{
+		Query:    "date<2022-06-01 Counterspell",
+		Expected: "mode=; sort=; name=\"Counterspell\"; uuids=[]; skip=false,false,false,false; card date_less_than neg=false [\"2022-06-01\"]",
+	},
+	{
+		Query:    "f:etched",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card finish neg=false [\"etched\"]",
+	},
+	// Invalid values are reported, but filtered as before
+	{
+		Query:    "Ragavan se:[",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card edition_regexp neg=false [\"[\"]",
+	},
+	{
+		Query:    "cne:( s:MH2",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card number_regexp neg=false [\"(\"]; card edition neg=false [\"MH2\"]",
+	},
+	{
+		Query:    "cn>abc",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card number_greater_than neg=false [\"abc\"]",
+	},
+	{
+		Query:    "r>foo Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card rarity_greater_than neg=false [\"foo\"]",
+	},
+	{
+		Query:    "date>notadate",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; card date_greater_than neg=false [\"\"]",
+	},
+	{
+		Query:    "c:Z Ragavan",
+		Expected: "mode=; sort=; name=\"Ragavan\"; uuids=[]; skip=false,false,false,false; card color neg=false [\"Z\"]",
+	},
+	{
+		Query:    "cond:XX",
+		Expected: "mode=; sort=; name=\"\"; uuids=[]; skip=false,false,false,false; entry condition neg=false [\"XX\"] seller=false vendor=false",
+	},
+}
+
+func TestSearchQueryCompatibility(t *testing.T) {
+	for _, test := range CompatibilityTests {
+		test := test
+		t.Run(test.Query, func(t *testing.T) {
+			t.Parallel()
+			out := describeSearchConfig(parseSearchOptionsNG(test.Query, nil, nil))
+			if out != test.Expected {
+				t.Errorf("FAIL:\nExpected %s\nGot      %s", test.Expected, out)
+			}
+		})
+	}
+}
+
+var WarningTests = []struct {
+	Query   string
+	Warning string
+}{
+	{
+		Query:   "Ragavan se:[",
+		Warning: "Invalid regular expression '['",
+	},
+	{
+		Query:   "cn>abc",
+		Warning: "Invalid collector number 'abc'",
+	},
+	{
+		Query:   "r>foo Ragavan",
+		Warning: "Invalid rarity 'foo'",
+	},
+	{
+		Query:   "date>notadate",
+		Warning: "Invalid date 'notadate'",
+	},
+	{
+		Query:   "c:Z Ragavan",
+		Warning: "Unknown color 'Z'",
+	},
+	{
+		Query:   "cond:XX",
+		Warning: "Unknown condition 'XX'",
+	},
+	{
+		Query:   "Ragavan sm:fast",
+		Warning: "Unknown search mode 'fast'",
+	},
+	{
+		Query:   "Ragavan frobnicate:yes",
+		Warning: "Unknown option 'frobnicate'",
+	},
+}
+
+func TestSearchQueryWarnings(t *testing.T) {
+	for _, test := range WarningTests {
+		test := test
+		t.Run(test.Query, func(t *testing.T) {
+			t.Parallel()
+			config := parseSearchOptionsNG(test.Query, nil, nil)
+			if !strings.Contains(strings.Join(config.Warnings, "\n"), test.Warning) {
+				t.Errorf("FAIL: Expected warning '%s' got %q", test.Warning, config.Warnings)
+			}
+		})
+	}
+}
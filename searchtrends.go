@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mtgban/go-mtgban/mtgmatcher"
+)
+
+const (
+	// How close to the highest price a card needs to be for ath
+	AllTimeHighTolerance = 0.05
+)
+
+// Price histories that can be used in search filters, mapping the code used
+// in queries to the chart dataset holding the data
+var historyDatasets = map[string]scraperConfig{
+	"ck": {
+		ScraperName: "cardkingdom",
+		KindName:    "retail",
+	},
+	"ckbl": {
+		ScraperName: "cardkingdom",
+		KindName:    "buylist",
+	},
+	"tcglow": {
+		ScraperName: "tcg_index",
+		KindName:    TCG_LOW,
+	},
+	"tcgmarket": {
+		ScraperName: "tcg_index",
+		KindName:    TCG_MARKET,
+	},
+	"mkmlow": {
+		ScraperName: "cardmarket",
+		KindName:    MKM_LOW,
+	},
+	"mkmtrend": {
+		ScraperName: "cardmarket",
+		KindName:    MKM_TREND,
+	},
+	"scgbl": {
+		ScraperName: "starcitygames",
+		KindName:    "buylist",
+	},
+	"abubl": {
+		ScraperName: "abugames",
+		KindName:    "buylist",
+	},
+}
+
+func fixupHistoryDataset(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "_", "", -1)
+	_, found := historyDatasets[code]
+	if !found {
+		return ""
+	}
+	return code
+}
+
+func historyDatasetNames() string {
+	var names []string
+	for name := range historyDatasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Days over which price changes can be searched
+var TrendDays = [...]int{7, 30}
+
+// How many histories are requested to redis at once
+const PriceTrendsBatchSize = 1000
+
+// Summary of the price history of a card
+type priceTrend struct {
+	// Most recent price
+	Price float64
+
+	// Highest price ever recorded
+	Max float64
+
+	// Prices recorded at least TrendDays before the most recent one, or zero
+	// if the history does not go back that far
+	Past [len(TrendDays)]float64
+}
+
+// Return the percentage change of the price over the given days
+func (pt *priceTrend) change(days int) (float64, bool) {
+	for i := range TrendDays {
+		if TrendDays[i] != days {
+			continue
+		}
+		old := pt.Past[i]
+		if old == 0 {
+			return 0, false
+		}
+		return (pt.Price - old) / old * 100, true
+	}
+	return 0, false
+}
+
+// Summarize a history, as a map of dates to prices
+func newPriceTrend(history map[string]string) *priceTrend {
+	var dates []string
+	for date := range history {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	var times []time.Time
+	var prices []float64
+	trend := &priceTrend{}
+	for _, date := range dates {
+		tt, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			continue
+		}
+		price, err := strconv.ParseFloat(history[date], 64)
+		if err != nil || price == 0 {
+			continue
+		}
+		times = append(times, tt)
+		prices = append(prices, price)
+		if price > trend.Max {
+			trend.Max = price
+		}
+	}
+	if len(prices) == 0 {
+		return nil
+	}
+
+	last := times[len(times)-1]
+	trend.Price = prices[len(prices)-1]
+	for i, days := range TrendDays {
+		target := last.AddDate(0, 0, -days)
+		for j := len(times) - 1; j >= 0; j-- {
+			if !times[j].After(target) {
+				trend.Past[i] = prices[j]
+				break
+			}
+		}
+	}
+
+	return trend
+}
+
+// Trends are computed once per refresh of the scrapers, by dataset and card
+var priceTrendsMutex sync.RWMutex
+var priceTrends = map[string]map[string]*priceTrend{}
+
+// Avoid computing the same datasets twice at the same time
+var priceTrendsRefreshMutex sync.Mutex
+
+// Recompute the trends of the given datasets, or of all of them if none
+// are specified, reading the whole history once
+func refreshPriceTrends(datasets ...string) {
+	priceTrendsRefreshMutex.Lock()
+	defer priceTrendsRefreshMutex.Unlock()
+
+	if len(datasets) == 0 {
+		for dataset := range historyDatasets {
+			datasets = append(datasets, dataset)
+		}
+		sort.Strings(datasets)
+	}
+
+	for _, dataset := range datasets {
+		start := time.Now()
+		trends, err := loadPriceTrends(dataset)
+		if err != nil {
+			log.Println("unable to load price trends for", dataset, err)
+			continue
+		}
+
+		priceTrendsMutex.Lock()
+		priceTrends[dataset] = trends
+		priceTrendsMutex.Unlock()
+
+		log.Println("Loaded", len(trends), "price trends for", dataset, "in", time.Since(start))
+	}
+}
+
+// Recompute the trends of the datasets stored in the history of a scraper,
+// after new prices were stashed
+func refreshHistoryTrends(scraperName, kindName string) {
+	var datasets []string
+	for dataset, config := range historyDatasets {
+		if config.ScraperName == scraperName && config.KindName == kindName {
+			datasets = append(datasets, dataset)
+		}
+	}
+	if len(datasets) == 0 {
+		return
+	}
+	sort.Strings(datasets)
+	refreshPriceTrends(datasets...)
+}
+
+func loadPriceTrends(dataset string) (map[string]*priceTrend, error) {
+	config, found := historyDatasets[dataset]
+	if !found {
+		return nil, errors.New("unknown dataset")
+	}
+	option, found := ScraperOptions[config.ScraperName]
+	if !found {
+		return nil, errors.New("scraper not available")
+	}
+	db, found := option.RDBs[config.KindName]
+	if !found || db == nil {
+		return nil, errors.New("history not available")
+	}
+
+	ctx := context.Background()
+	trends := map[string]*priceTrend{}
+
+	// Keys are card ids, query their histories in batches
+	var keys []string
+	flush := func() error {
+		pipe := db.Pipeline()
+		results := make([]*redis.StringStringMapCmd, len(keys))
+		for i, key := range keys {
+			results[i] = pipe.HGetAll(ctx, key)
+		}
+		_, err := pipe.Exec(ctx)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			trend := newPriceTrend(results[i].Val())
+			if trend != nil {
+				trends[key] = trend
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+
+	iter := db.Scan(ctx, 0, "", PriceTrendsBatchSize).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == PriceTrendsBatchSize {
+			err := flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err := iter.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		err := flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trends, nil
+}
+
+func getPriceTrend(cardId, dataset string) *priceTrend {
+	priceTrendsMutex.RLock()
+	defer priceTrendsMutex.RUnlock()
+	return priceTrends[dataset][cardId]
+}
+
+// Skip cards whose price did not change as requested, filters contain the
+// dataset, the number of days, the comparison operator, and the percentage
+func filterPriceChange(filters []string, co *mtgmatcher.CardObject) bool {
+	if len(filters) != 4 {
+		return true
+	}
+	days, err := strconv.Atoi(filters[1])
+	if err != nil {
+		return true
+	}
+	threshold, err := strconv.ParseFloat(filters[3], 64)
+	if err != nil {
+		return true
+	}
+
+	trend := getPriceTrend(co.UUID, filters[0])
+	if trend == nil {
+		return true
+	}
+	change, ok := trend.change(days)
+	if !ok {
+		return true
+	}
+
+	switch filters[2] {
+	case ">":
+		return change <= threshold
+	case "<":
+		return change >= threshold
+	}
+	return true
+}
+
+// Skip cards whose current price is not close to the highest recorded one
+func filterAllTimeHigh(filters []string, co *mtgmatcher.CardObject) bool {
+	if len(filters) != 1 {
+		return true
+	}
+	trend := getPriceTrend(co.UUID, filters[0])
+	if trend == nil {
+		return true
+	}
+	return trend.Price < trend.Max*(1-AllTimeHighTolerance)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+var PriceTrendTests = []struct {
+	Name     string
+	History  map[string]string
+	Price    float64
+	Max      float64
+	Change7  float64
+	Change30 float64
+	Has30    bool
+}{
+	{
+		Name: "rising",
+		History: map[string]string{
+			"2024-01-01": "10",
+			"2024-01-25": "20",
+			"2024-02-01": "25",
+		},
+		Price:    25,
+		Max:      25,
+		Change7:  25,
+		Change30: 150,
+		Has30:    true,
+	},
+	{
+		Name: "falling from the top",
+		History: map[string]string{
+			"2024-01-20": "40",
+			"2024-01-24": "50",
+			"2024-02-01": "25",
+		},
+		Price:   25,
+		Max:     50,
+		Change7: -50,
+	},
+	{
+		Name: "invalid entries are skipped",
+		History: map[string]string{
+			"2024-01-24": "10",
+			"2024-01-30": "0",
+			"notadate":   "100",
+			"2024-02-01": "5",
+		},
+		Price:   5,
+		Max:     10,
+		Change7: -50,
+	},
+}
+
+func TestPriceTrend(t *testing.T) {
+	for _, test := range PriceTrendTests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+			trend := newPriceTrend(test.History)
+			if trend == nil {
+				t.Fatalf("FAIL: Expected a trend, got nil")
+			}
+			if trend.Price != test.Price || trend.Max != test.Max {
+				t.Errorf("FAIL: Expected price %f and max %f, got %f and %f", test.Price, test.Max, trend.Price, trend.Max)
+			}
+			change, ok := trend.change(7)
+			if !ok || change != test.Change7 {
+				t.Errorf("FAIL: Expected 7 days change %f, got %f (%v)", test.Change7, change, ok)
+			}
+			change, ok = trend.change(30)
+			if ok != test.Has30 || change != test.Change30 {
+				t.Errorf("FAIL: Expected 30 days change %f (%v), got %f (%v)", test.Change30, test.Has30, change, ok)
+			}
+		})
+	}
+}
+
+func TestPriceTrendEmpty(t *testing.T) {
+	trend := newPriceTrend(map[string]string{"2024-01-01": "0"})
+	if trend != nil {
+		t.Errorf("FAIL: Expected no trend, got %v", trend)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	SessionCookieName = "MTGBAN_SESSION"
+
+	// Where forced logouts are saved when sessions are kept in memory
+	DefaultSessionsFile = "sessions.json"
+
+	// How often the last seen information is updated
+	SessionTouchInterval = time.Minute
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+type Session struct {
+	Id       string    `json:"id"`
+	User     string    `json:"user"`
+	Sig      string    `json:"sig"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastSeen time.Time `json:"last_seen"`
+	IP       string    `json:"ip"`
+}
+
+// Interface for the storage of the sessions
+type SessionStore interface {
+	Get(id string) (*Session, error)
+	Put(session *Session) error
+	Delete(id string) error
+	List() ([]*Session, error)
+
+	// Signatures of the user issued before this time are not valid anymore
+	SetInvalidBefore(user string, t time.Time) error
+	InvalidBefore(user string) (time.Time, error)
+}
+
+// Sessions are lost on restart, but forced logouts are saved to path, if set,
+// so that old signatures of those users cannot be used to log in again
+type memorySessionStore struct {
+	sync.RWMutex
+	sessions      map[string]*Session
+	invalidBefore map[string]time.Time
+	path          string
+}
+
+func newMemorySessionStore(path string) (*memorySessionStore, error) {
+	ms := &memorySessionStore{
+		sessions:      map[string]*Session{},
+		invalidBefore: map[string]time.Time{},
+		path:          path,
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ms, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &ms.invalidBefore)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *memorySessionStore) Get(id string) (*Session, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	session, found := ms.sessions[id]
+	if !found || session.Expires.Before(time.Now()) {
+		return nil, ErrSessionNotFound
+	}
+	out := *session
+	return &out, nil
+}
+
+func (ms *memorySessionStore) Put(session *Session) error {
+	ms.Lock()
+	defer ms.Unlock()
+	out := *session
+	ms.sessions[session.Id] = &out
+
+	// Drop any expired session while here
+	for id, session := range ms.sessions {
+		if session.Expires.Before(time.Now()) {
+			delete(ms.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (ms *memorySessionStore) Delete(id string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.sessions, id)
+	return nil
+}
+
+func (ms *memorySessionStore) List() ([]*Session, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	var sessions []*Session
+	for _, session := range ms.sessions {
+		if session.Expires.Before(time.Now()) {
+			continue
+		}
+		out := *session
+		sessions = append(sessions, &out)
+	}
+	return sessions, nil
+}
+
+func (ms *memorySessionStore) SetInvalidBefore(user string, t time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.invalidBefore[user] = t
+	if ms.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ms.invalidBefore, "", "    ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that the list is never corrupted
+	tmpName := ms.path + ".tmp"
+	err = os.WriteFile(tmpName, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, ms.path)
+}
+
+func (ms *memorySessionStore) InvalidBefore(user string) (time.Time, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return ms.invalidBefore[user], nil
+}
+
+// Store each session in its own key, expiring together with the signature
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+const (
+	redisSessionPrefix       = "session:"
+	redisSessionInvalidators = "session_invalid_before"
+)
+
+func (rs *redisSessionStore) Get(id string) (*Session, error) {
+	data, err := rs.client.Get(context.Background(), redisSessionPrefix+id).Result()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var session Session
+	err = json.Unmarshal([]byte(data), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (rs *redisSessionStore) Put(session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return rs.client.Set(context.Background(), redisSessionPrefix+session.Id, data, time.Until(session.Expires)).Err()
+}
+
+func (rs *redisSessionStore) Delete(id string) error {
+	return rs.client.Del(context.Background(), redisSessionPrefix+id).Err()
+}
+
+func (rs *redisSessionStore) List() ([]*Session, error) {
+	var sessions []*Session
+	iter := rs.client.Scan(context.Background(), 0, redisSessionPrefix+"*", 0).Iterator()
+	for iter.Next(context.Background()) {
+		session, err := rs.Get(strings.TrimPrefix(iter.Val(), redisSessionPrefix))
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, iter.Err()
+}
+
+func (rs *redisSessionStore) SetInvalidBefore(user string, t time.Time) error {
+	return rs.client.HSet(context.Background(), redisSessionInvalidators, user, t.Unix()).Err()
+}
+
+func (rs *redisSessionStore) InvalidBefore(user string) (time.Time, error) {
+	ts, err := rs.client.HGet(context.Background(), redisSessionInvalidators, user).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts, 0), nil
+}
+
+var sessionStore SessionStore
+
+func loadSessions() {
+	if !Config.Sessions.Enabled {
+		return
+	}
+	if Config.Sessions.Backend == "redis" {
+		sessionStore = &redisSessionStore{
+			client: redis.NewClient(&redis.Options{
+				Addr: Config.RedisAddr,
+				DB:   DBs["sessions"],
+			}),
+		}
+	} else {
+		fname := Config.Sessions.FilePath
+		if fname == "" {
+			fname = DefaultSessionsFile
+		}
+		store, err := newMemorySessionStore(fname)
+		if err != nil {
+			log.Println("unable to load forced logouts, sessions disabled:", err)
+			return
+		}
+		sessionStore = store
+	}
+	log.Println("Server-side sessions enabled")
+}
+
+func getSessionId(r *http.Request) string {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func getClientIP(r *http.Request) string {
+	ip, err := IpAddress(r)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip.String()
+}
+
+// Return the signature held by the session of the request, keeping track of
+// when and where it was last used
+func getSignatureFromSession(r *http.Request) string {
+	id := getSessionId(r)
+	if id == "" {
+		return ""
+	}
+	session, err := sessionStore.Get(id)
+	if err != nil {
+		return ""
+	}
+
+	ip := getClientIP(r)
+	if time.Since(session.LastSeen) > SessionTouchInterval || session.IP != ip {
+		session.LastSeen = time.Now()
+		session.IP = ip
+		err = sessionStore.Put(session)
+		if err != nil {
+			log.Println("unable to update session", err)
+		}
+	}
+
+	return session.Sig
+}
+
+// Store the signature in a new session and return the id to be set in the
+// cookie, the session id sent by the client is never reused so that it cannot
+// be planted before logging in
+func putSignatureInSession(r *http.Request, sig string) (string, error) {
+	exp := GetParamFromSig(sig, "Expires")
+	expires, _ := strconv.ParseInt(exp, 10, 64)
+
+	deleteSession(r)
+
+	session := &Session{
+		Id:       newAPIKeyId() + newAPIKeyId(),
+		User:     GetParamFromSig(sig, "UserEmail"),
+		Sig:      sig,
+		Created:  time.Now(),
+		Expires:  time.Unix(expires, 0),
+		LastSeen: time.Now(),
+		IP:       getClientIP(r),
+	}
+
+	return session.Id, sessionStore.Put(session)
+}
+
+func deleteSession(r *http.Request) {
+	if sessionStore == nil {
+		return
+	}
+	id := getSessionId(r)
+	if id != "" {
+		sessionStore.Delete(id)
+	}
+}
+
+// Invalidate all the sessions of a user, forcing them to log in again
+// Any page signature issued until now is rejected too, so that it cannot be
+// used to open a new session, API keys are revoked through their registry
+func invalidateUserSessions(user string) (int, error) {
+	err := sessionStore.SetInvalidBefore(user, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	sessions, err := sessionStore.List()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, session := range sessions {
+		if session.User != user {
+			continue
+		}
+		err := sessionStore.Delete(session.Id)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Whether the page signature values were issued before their user was forced
+// to log out, signatures without an issue time predate the check
+func signatureRevoked(v url.Values) bool {
+	user := v.Get("UserEmail")
+	if sessionStore == nil || user == "" {
+		return false
+	}
+	before, err := sessionStore.InvalidBefore(user)
+	if err != nil {
+		log.Println("unable to check session invalidation", err)
+		return false
+	}
+	if before.IsZero() {
+		return false
+	}
+	issued, _ := strconv.ParseInt(v.Get("Issued"), 10, 64)
+	return issued < before.Unix()
+}
+
+// Return all sessions, most recently seen first
+func listSessions() []Session {
+	if sessionStore == nil {
+		return nil
+	}
+	sessions, err := sessionStore.List()
+	if err != nil {
+		log.Println("unable to list sessions", err)
+		return nil
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+
+	var out []Session
+	for _, session := range sessions {
+		out = append(out, *session)
+	}
+	return out
+}
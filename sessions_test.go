@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions:      map[string]*Session{},
+		invalidBefore: map[string]time.Time{},
+	}
+}
+
+func newSessionRequest(id string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if id != "" {
+		req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: id})
+	}
+	return req
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := newTestSessionStore()
+
+	live := &Session{Id: "live", User: "user@example.com", Expires: time.Now().Add(time.Hour)}
+	expired := &Session{Id: "expired", User: "user@example.com", Expires: time.Now().Add(-time.Hour)}
+	for _, session := range []*Session{expired, live} {
+		err := store.Put(session)
+		if err != nil {
+			t.Fatalf("FAIL: Unable to store session: %s", err)
+		}
+	}
+
+	// Stored sessions are copies
+	live.User = "changed"
+	session, err := store.Get("live")
+	if err != nil || session.User != "user@example.com" {
+		t.Errorf("FAIL: Expected the stored session, got %v (%v)", session, err)
+	}
+
+	_, err = store.Get("expired")
+	if err != ErrSessionNotFound {
+		t.Errorf("FAIL: Expected expired sessions to be hidden, got %v", err)
+	}
+	sessions, _ := store.List()
+	if len(sessions) != 1 || sessions[0].Id != "live" {
+		t.Errorf("FAIL: Expected only the live session to be listed, got %v", sessions)
+	}
+
+	store.Delete("live")
+	_, err = store.Get("live")
+	if err != ErrSessionNotFound {
+		t.Errorf("FAIL: Expected deleted session to be gone, got %v", err)
+	}
+}
+
+// Forced logouts survive a restart of the memory backend
+func TestMemorySessionStoreInvalidations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := newMemorySessionStore(path)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to create store: %s", err)
+	}
+
+	before := time.Unix(time.Now().Unix(), 0)
+	err = store.SetInvalidBefore("user@example.com", before)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to invalidate: %s", err)
+	}
+
+	restarted, err := newMemorySessionStore(path)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to reload store: %s", err)
+	}
+	loaded, _ := restarted.InvalidBefore("user@example.com")
+	if !loaded.Equal(before) {
+		t.Errorf("FAIL: Expected invalidation at %v, got %v", before, loaded)
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	old := sessionStore
+	defer func() {
+		sessionStore = old
+	}()
+	store := newTestSessionStore()
+	sessionStore = store
+
+	// A session id planted by somebody else before logging in
+	planted := &Session{Id: "planted", User: "attacker@example.com", Expires: time.Now().Add(time.Hour)}
+	store.Put(planted)
+
+	sig := encodeTestSig(url.Values{
+		"UserEmail": {"user@example.com"},
+		"Expires":   {fmt.Sprint(time.Now().Add(time.Hour).Unix())},
+		"Issued":    {fmt.Sprint(time.Now().Unix())},
+	})
+	id, err := putSignatureInSession(newSessionRequest("planted"), sig)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to create session: %s", err)
+	}
+	if id == "" || id == "planted" {
+		t.Fatalf("FAIL: Expected a new session id, got '%s'", id)
+	}
+	_, err = store.Get("planted")
+	if err != ErrSessionNotFound {
+		t.Errorf("FAIL: Expected the previous session to be deleted")
+	}
+
+	if getSignatureFromSession(newSessionRequest(id)) != sig {
+		t.Errorf("FAIL: Expected the session to hold the signature")
+	}
+	if getSignatureFromSession(newSessionRequest("planted")) != "" {
+		t.Errorf("FAIL: Expected no signature from the previous session")
+	}
+
+	session, _ := store.Get(id)
+	if session.User != "user@example.com" || session.IP != "192.0.2.1" {
+		t.Errorf("FAIL: Unexpected session %+v", session)
+	}
+
+	// Logging in again does not reuse the id either
+	nid, _ := putSignatureInSession(newSessionRequest(id), sig)
+	if nid == id {
+		t.Errorf("FAIL: Expected the session id to change at every login")
+	}
+}
+
+func TestForcedLogout(t *testing.T) {
+	old := sessionStore
+	defer func() {
+		sessionStore = old
+	}()
+	store := newTestSessionStore()
+	sessionStore = store
+
+	exp := fmt.Sprint(time.Now().Add(time.Hour).Unix())
+	before := time.Now().Add(-time.Minute)
+	issued := fmt.Sprint(before.Unix())
+	userSig := encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "Expires": {exp}, "Issued": {issued}})
+	otherSig := encodeTestSig(url.Values{"UserEmail": {"other@example.com"}, "Expires": {exp}, "Issued": {issued}})
+
+	userId, _ := putSignatureInSession(newSessionRequest(""), userSig)
+	otherId, _ := putSignatureInSession(newSessionRequest(""), otherSig)
+
+	count, err := invalidateUserSessions("user@example.com")
+	if err != nil {
+		t.Fatalf("FAIL: Unable to invalidate sessions: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("FAIL: Expected one session to be removed, got %d", count)
+	}
+	if getSignatureFromSession(newSessionRequest(userId)) != "" {
+		t.Errorf("FAIL: Expected the session of the user to be removed")
+	}
+	if getSignatureFromSession(newSessionRequest(otherId)) != otherSig {
+		t.Errorf("FAIL: Expected the sessions of other users to be kept")
+	}
+
+	var tests = []struct {
+		Name    string
+		User    string
+		Issued  time.Time
+		Revoked bool
+	}{
+		{
+			Name:    "issued before the logout",
+			User:    "user@example.com",
+			Issued:  before,
+			Revoked: true,
+		},
+		{
+			Name:    "without issue time",
+			User:    "user@example.com",
+			Revoked: true,
+		},
+		{
+			Name:   "issued after the logout",
+			User:   "user@example.com",
+			Issued: time.Now().Add(time.Minute),
+		},
+		{
+			Name:   "different user",
+			User:   "other@example.com",
+			Issued: before,
+		},
+		{
+			Name:   "anonymous",
+			Issued: before,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			v := url.Values{}
+			v.Set("UserEmail", test.User)
+			if !test.Issued.IsZero() {
+				v.Set("Issued", fmt.Sprint(test.Issued.Unix()))
+			}
+			if signatureRevoked(v) != test.Revoked {
+				t.Errorf("FAIL: Expected revoked %v, got %v", test.Revoked, !test.Revoked)
+			}
+		})
+	}
+}
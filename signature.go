@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Signatures without a version field are the legacy HMAC-SHA1 ones
+const (
+	SignatureVersionLegacy  = ""
+	SignatureVersionCurrent = "2"
+)
+
+var (
+	ErrLegacySignature = errors.New("legacy signature no longer accepted")
+	ErrUnknownKeyId    = errors.New("unknown signing key")
+	ErrUnknownVersion  = errors.New("unknown signature version")
+)
+
+func signHMACSHA256Base64(key []byte, data []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Return the secret associated to a key id, an empty id refers to BAN_SECRET
+func lookupSigningKey(keyId string) (string, bool) {
+	if keyId == "" {
+		return os.Getenv("BAN_SECRET"), true
+	}
+	secret, found := Config.Signature.Keyring[keyId]
+	return secret, found && secret != ""
+}
+
+// Return the key id and secret used for new signatures, a per-user secret
+// always takes precedence over the keyring
+func activeSigningKey(userSecret string) (string, string) {
+	if userSecret != "" {
+		return "", userSecret
+	}
+	keyId := Config.Signature.ActiveKey
+	secret, found := lookupSigningKey(keyId)
+	if !found {
+		return "", os.Getenv("BAN_SECRET")
+	}
+	return keyId, secret
+}
+
+// Whether legacy signatures are past their cutoff date
+func legacySignaturesExpired() bool {
+	if Config.Signature.LegacyCutoff == "" {
+		return false
+	}
+	cutoff, err := time.Parse("2006-01-02", Config.Signature.LegacyCutoff)
+	if err != nil {
+		return false
+	}
+	return time.Now().After(cutoff)
+}
+
+// Add the version fields to v and return its signature over the given payload
+func computeSignature(exp, link string, v url.Values, userSecret string) string {
+	keyId, secret := activeSigningKey(userSecret)
+
+	v.Set("SigVersion", SignatureVersionCurrent)
+	if keyId != "" {
+		v.Set("KeyId", keyId)
+	}
+
+	data := fmt.Sprintf("GET%s%s%s", exp, link, v.Encode())
+	return signHMACSHA256Base64([]byte(secret), []byte(data))
+}
+
+// Verify that sig matches the q values, following the version and the key id
+// found in the v values that were originally signed
+func verifySignature(sig, exp, link string, v, q url.Values, userSecret string) error {
+	version := v.Get("SigVersion")
+	switch version {
+	case SignatureVersionLegacy:
+		if legacySignaturesExpired() {
+			return ErrLegacySignature
+		}
+		secret := userSecret
+		if secret == "" {
+			secret = os.Getenv("BAN_SECRET")
+		}
+		data := fmt.Sprintf("GET%s%s%s", exp, link, q.Encode())
+		valid := signHMACSHA1Base64([]byte(secret), []byte(data))
+		if !hmac.Equal([]byte(valid), []byte(sig)) {
+			return ErrMismatchedSignature
+		}
+	case SignatureVersionCurrent:
+		keyId := v.Get("KeyId")
+		secret := userSecret
+		if secret == "" {
+			var found bool
+			secret, found = lookupSigningKey(keyId)
+			if !found {
+				return ErrUnknownKeyId
+			}
+		}
+
+		q.Set("SigVersion", version)
+		if keyId != "" {
+			q.Set("KeyId", keyId)
+		}
+		data := fmt.Sprintf("GET%s%s%s", exp, link, q.Encode())
+		valid := signHMACSHA256Base64([]byte(secret), []byte(data))
+		if !hmac.Equal([]byte(valid), []byte(sig)) {
+			return ErrMismatchedSignature
+		}
+	default:
+		return ErrUnknownVersion
+	}
+	return nil
+}
+
+// Return the values of v that are covered by the signature, API signatures
+// sign their access level and expiration too
+func signedValues(v url.Values, api bool) url.Values {
+	q := url.Values{}
+	if api {
+		q.Set("API", v.Get("API"))
+	}
+
+	// Pages are included so that they can be used to gate page-specific APIs
+	for _, key := range append(OrderNav, OptionalFields...) {
+		val := v.Get(key)
+		if val != "" {
+			q.Set(key, val)
+		}
+	}
+
+	if api && v.Get("Expires") != "" {
+		q.Set("Expires", v.Get("Expires"))
+	}
+	return q
+}
+
+// Return sig if it was made with one of our keys, or with the secret of its
+// user for API signatures, and an empty string otherwise
+// Expiration and revocation are not checked here
+func verifiedSignature(link, sig string, api bool) string {
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return ""
+	}
+	v, err := url.ParseQuery(string(raw))
+	if err != nil {
+		return ""
+	}
+
+	var userSecret string
+	if api {
+		apiUsersMutex.RLock()
+		userSecret = Config.ApiUserSecrets[v.Get("UserEmail")]
+		apiUsersMutex.RUnlock()
+	}
+
+	err = verifySignature(v.Get("Signature"), v.Get("Expires"), link, v, signedValues(v, api), userSecret)
+	if err != nil {
+		return ""
+	}
+	return sig
+}
+
+// Whether a signature was generated with an older version or a key that is
+// not the active one anymore
+func needsResigning(v url.Values) bool {
+	keyId, _ := activeSigningKey("")
+	return v.Get("SigVersion") != SignatureVersionCurrent || v.Get("KeyId") != keyId
+}
+
+// Sign again the same values, keeping the original expiration date
+func resign(link string, v url.Values) string {
+	exp := v.Get("Expires")
+
+	nv := url.Values{}
+	for _, key := range append(OrderNav, OptionalFields...) {
+		val := v.Get(key)
+		if val != "" {
+			nv.Set(key, val)
+		}
+	}
+
+	sig := computeSignature(exp, link, nv, "")
+
+	nv.Set("Expires", exp)
+	nv.Set("Signature", sig)
+	return base64.StdEncoding.EncodeToString([]byte(nv.Encode()))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const SignatureTestLink = "https://www.mtgban.com"
+
+// Encode values the way signatures are carried in links and cookies, shared
+// by all the tests that need a signature, signed or not
+func encodeTestSig(v url.Values) string {
+	return base64.StdEncoding.EncodeToString([]byte(v.Encode()))
+}
+
+// Sign a fixed set of values with the current keyring
+func signForTest(legacy bool) string {
+	exp := fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())
+	v := url.Values{}
+	v.Set("Search", "true")
+	v.Set("UserEmail", "user@example.com")
+
+	var sig string
+	if legacy {
+		data := fmt.Sprintf("GET%s%s%s", exp, SignatureTestLink, v.Encode())
+		sig = signHMACSHA1Base64([]byte("bansecret"), []byte(data))
+	} else {
+		sig = computeSignature(exp, SignatureTestLink, v, "")
+	}
+
+	v.Set("Expires", exp)
+	v.Set("Signature", sig)
+	return encodeTestSig(v)
+}
+
+func decodeForTest(t *testing.T, sig string) url.Values {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		t.Fatalf("FAIL: Unable to decode signature: %s", err)
+	}
+	v, err := url.ParseQuery(string(raw))
+	if err != nil {
+		t.Fatalf("FAIL: Unable to parse signature: %s", err)
+	}
+	return v
+}
+
+var SignatureTests = []struct {
+	Name string
+
+	// Keyring state when signing
+	SignKeyring map[string]string
+	SignActive  string
+	Legacy      bool
+
+	// Keyring state when verifying
+	Keyring map[string]string
+	Active  string
+	Cutoff  string
+
+	// Change the signed values after signing
+	Tamper func(v url.Values)
+
+	Expected error
+	Resign   bool
+}{
+	{
+		Name:        "active key",
+		SignKeyring: map[string]string{"k1": "secret1"},
+		SignActive:  "k1",
+		Keyring:     map[string]string{"k1": "secret1"},
+		Active:      "k1",
+	},
+	{
+		Name:     "ban secret without keyring",
+		Expected: nil,
+	},
+	{
+		Name:        "rotated key is still accepted",
+		SignKeyring: map[string]string{"k1": "secret1"},
+		SignActive:  "k1",
+		Keyring:     map[string]string{"k1": "secret1", "k2": "secret2"},
+		Active:      "k2",
+		Resign:      true,
+	},
+	{
+		Name:        "retired key",
+		SignKeyring: map[string]string{"k1": "secret1"},
+		SignActive:  "k1",
+		Keyring:     map[string]string{"k2": "secret2"},
+		Active:      "k2",
+		Expected:    ErrUnknownKeyId,
+	},
+	{
+		Name:        "key with a different secret",
+		SignKeyring: map[string]string{"k1": "secret1"},
+		SignActive:  "k1",
+		Keyring:     map[string]string{"k1": "changed"},
+		Active:      "k1",
+		Expected:    ErrMismatchedSignature,
+	},
+	{
+		Name:        "tampered values",
+		SignKeyring: map[string]string{"k1": "secret1"},
+		SignActive:  "k1",
+		Keyring:     map[string]string{"k1": "secret1"},
+		Active:      "k1",
+		Tamper: func(v url.Values) {
+			v.Set("Arbit", "true")
+		},
+		Expected: ErrMismatchedSignature,
+	},
+	{
+		Name:        "tampered key id",
+		SignKeyring: map[string]string{"k1": "secret1"},
+		SignActive:  "k1",
+		Keyring:     map[string]string{"k1": "secret1", "k2": "secret2"},
+		Active:      "k1",
+		Tamper: func(v url.Values) {
+			v.Set("KeyId", "k2")
+		},
+		Expected: ErrMismatchedSignature,
+	},
+	{
+		Name: "unknown version",
+		Tamper: func(v url.Values) {
+			v.Set("SigVersion", "99")
+		},
+		Expected: ErrUnknownVersion,
+	},
+	{
+		Name:   "legacy before cutoff",
+		Legacy: true,
+		Cutoff: time.Now().AddDate(0, 0, 1).Format("2006-01-02"),
+		Resign: true,
+	},
+	{
+		Name:     "legacy after cutoff",
+		Legacy:   true,
+		Cutoff:   "2020-01-01",
+		Expected: ErrLegacySignature,
+	},
+}
+
+// Keyring tests change the global configuration, so they cannot be parallel
+func TestSignatures(t *testing.T) {
+	t.Setenv("BAN_SECRET", "bansecret")
+	old := Config.Signature
+	defer func() {
+		Config.Signature = old
+	}()
+
+	for _, test := range SignatureTests {
+		t.Run(test.Name, func(t *testing.T) {
+			Config.Signature.Keyring = test.SignKeyring
+			Config.Signature.ActiveKey = test.SignActive
+			Config.Signature.LegacyCutoff = ""
+			sig := signForTest(test.Legacy)
+
+			Config.Signature.Keyring = test.Keyring
+			Config.Signature.ActiveKey = test.Active
+			Config.Signature.LegacyCutoff = test.Cutoff
+
+			v := decodeForTest(t, sig)
+			if test.Tamper != nil {
+				test.Tamper(v)
+			}
+
+			err := verifySignature(v.Get("Signature"), v.Get("Expires"), SignatureTestLink, v, signedValues(v, false), "")
+			if err != test.Expected {
+				t.Fatalf("FAIL: Expected '%v', got '%v'", test.Expected, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if needsResigning(v) != test.Resign {
+				t.Errorf("FAIL: Expected resigning %v, got %v", test.Resign, !test.Resign)
+			}
+
+			// A signature made again with the current key must still be valid
+			// and keep the same expiration
+			nsig := resign(SignatureTestLink, v)
+			if verifiedSignature(SignatureTestLink, nsig, false) != nsig {
+				t.Errorf("FAIL: Resigned signature is not valid")
+			}
+			nv := decodeForTest(t, nsig)
+			if nv.Get("Expires") != v.Get("Expires") {
+				t.Errorf("FAIL: Expected expiration %s, got %s", v.Get("Expires"), nv.Get("Expires"))
+			}
+			if nv.Get("KeyId") != test.Active {
+				t.Errorf("FAIL: Expected key id '%s', got '%s'", test.Active, nv.Get("KeyId"))
+			}
+			if needsResigning(nv) {
+				t.Errorf("FAIL: Resigned signature should not need resigning")
+			}
+		})
+	}
+}
+
+func TestVerifiedSignatureGarbage(t *testing.T) {
+	for _, sig := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("%%%"))} {
+		if verifiedSignature(SignatureTestLink, sig, false) != "" {
+			t.Errorf("FAIL: Expected '%s' to be rejected", sig)
+		}
+	}
+}
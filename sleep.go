@@ -151,11 +151,13 @@ func Sleepers(w http.ResponseWriter, r *http.Request) {
 	// Log performance
 	user := GetParamFromSig(sig, "UserEmail")
 	msg := fmt.Sprintf("Sleepers call by %s with took %v", user, time.Since(start))
-	UserNotify("sleepers", msg)
 	LogPages["Sleepers"].Println(msg)
-	if DevMode {
-		log.Println(msg)
-	}
+
+	event := newAuditEvent(sig, "sleepers", "Sleepers", start)
+	event.Query = page
+	event.Rows = len(pageVars.Metadata)
+	event.Message = msg
+	recordAudit(event)
 
 	if DevMode {
 		start = time.Now()
@@ -726,11 +726,14 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 		msgMode = "buylist"
 	}
 	msg := fmt.Sprintf("%s uploaded %d %s entries from %s, took %v", user, len(cardIds), msgMode, pageVars.SearchQuery, time.Since(start))
-	UserNotify("upload", msg)
 	LogPages["Upload"].Println(msg)
-	if DevMode {
-		log.Println(msg)
-	}
+
+	event := newAuditEvent(sig, "upload", "Upload", start)
+	event.Query = pageVars.SearchQuery
+	event.Stores = enabledStores
+	event.Rows = len(cardIds)
+	event.Message = msg
+	recordAudit(event)
 
 	// Touchdown!
 	render(w, "upload.html", pageVars)
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultUsageFile = "usage.json"
+
+	// How often usage counters are persisted
+	UsageFlushInterval = 5 * time.Minute
+
+	// How many days of usage are kept around
+	UsageRetentionDays = 90
+)
+
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+type UsageRecord struct {
+	User     string `json:"user"`
+	Date     string `json:"date"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Cards    int64  `json:"cards"`
+}
+
+// Usage indexed by date and by user
+type usageMap map[string]map[string]*UsageRecord
+
+// Interface for the persistent storage of usage counters
+type UsageStore interface {
+	Load() (usageMap, error)
+
+	// Add the records to the stored counters
+	Save(records []UsageRecord) error
+
+	// Return the stored counters of a user for the given date, or nil if
+	// they are only known locally
+	Get(date, user string) (*UsageRecord, error)
+}
+
+// Store all the counters in a single json file
+type fileUsageStore struct {
+	sync.Mutex
+	path string
+}
+
+func (fs *fileUsageStore) Load() (usageMap, error) {
+	usage := usageMap{}
+	file, err := os.Open(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&usage)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func (fs *fileUsageStore) Save(records []UsageRecord) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	stored, err := fs.Load()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		addUsage(stored, record)
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -UsageRetentionDays).Format("2006-01-02")
+	for date := range stored {
+		if date < cutoff {
+			delete(stored, date)
+		}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	tmpName := fs.path + ".tmp"
+	err = os.WriteFile(tmpName, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fs.path)
+}
+
+// The file is only used by a single node, so memory is always up to date
+func (fs *fileUsageStore) Get(date, user string) (*UsageRecord, error) {
+	return nil, nil
+}
+
+// Store each day in a redis hash, with one field per user and counter, so
+// that every node can increment them
+type redisUsageStore struct {
+	client *redis.Client
+}
+
+const redisUsagePrefix = "usage:"
+
+// Set the counter named by field in the record
+func setUsageField(record *UsageRecord, field string, value int64) {
+	switch field {
+	case "requests":
+		record.Requests = value
+	case "bytes":
+		record.Bytes = value
+	case "cards":
+		record.Cards = value
+	}
+}
+
+func (rs *redisUsageStore) Load() (usageMap, error) {
+	usage := usageMap{}
+	for i := 0; i < UsageRetentionDays; i++ {
+		date := time.Now().AddDate(0, 0, -i).Format("2006-01-02")
+		results, err := rs.client.HGetAll(context.Background(), redisUsagePrefix+date).Result()
+		if err != nil {
+			return nil, err
+		}
+		for key, data := range results {
+			// The user is an email, so split at the last separator
+			idx := strings.LastIndex(key, "|")
+			if idx < 0 {
+				continue
+			}
+			user, field := key[:idx], key[idx+1:]
+			value, err := strconv.ParseInt(data, 10, 64)
+			if err != nil {
+				log.Println("invalid usage record", date, key, err)
+				continue
+			}
+			if usage[date] == nil {
+				usage[date] = map[string]*UsageRecord{}
+			}
+			record, found := usage[date][user]
+			if !found {
+				record = &UsageRecord{
+					User: user,
+					Date: date,
+				}
+				usage[date][user] = record
+			}
+			setUsageField(record, field, value)
+		}
+	}
+	return usage, nil
+}
+
+func (rs *redisUsageStore) Save(records []UsageRecord) error {
+	pipe := rs.client.Pipeline()
+	for _, record := range records {
+		key := redisUsagePrefix + record.Date
+		pipe.HIncrBy(context.Background(), key, record.User+"|requests", record.Requests)
+		pipe.HIncrBy(context.Background(), key, record.User+"|bytes", record.Bytes)
+		pipe.HIncrBy(context.Background(), key, record.User+"|cards", record.Cards)
+		pipe.Expire(context.Background(), key, UsageRetentionDays*24*time.Hour)
+	}
+	_, err := pipe.Exec(context.Background())
+	return err
+}
+
+func (rs *redisUsageStore) Get(date, user string) (*UsageRecord, error) {
+	fields := []string{"requests", "bytes", "cards"}
+	var keys []string
+	for _, field := range fields {
+		keys = append(keys, user+"|"+field)
+	}
+	results, err := rs.client.HMGet(context.Background(), redisUsagePrefix+date, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	record := &UsageRecord{
+		User: user,
+		Date: date,
+	}
+	for i, result := range results {
+		str, ok := result.(string)
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		setUsageField(record, fields[i], value)
+	}
+	return record, nil
+}
+
+var usageMutex sync.RWMutex
+var usage = usageMap{}
+var usageStore UsageStore
+
+// Increments not yet saved to the store
+var usagePending = usageMap{}
+
+func loadUsage() error {
+	if Config.Usage.Backend == "redis" {
+		usageStore = &redisUsageStore{
+			client: redis.NewClient(&redis.Options{
+				Addr: Config.RedisAddr,
+				DB:   DBs["usage"],
+			}),
+		}
+	} else {
+		fname := Config.Usage.FilePath
+		if fname == "" {
+			fname = DefaultUsageFile
+		}
+		usageStore = &fileUsageStore{path: fname}
+	}
+
+	loaded, err := usageStore.Load()
+	if err != nil {
+		return err
+	}
+
+	usageMutex.Lock()
+	usage = loaded
+	usageMutex.Unlock()
+
+	go func() {
+		for range time.NewTicker(UsageFlushInterval).C {
+			err := flushUsage()
+			if err != nil {
+				log.Println("unable to save api usage:", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func flushUsage() error {
+	cutoff := time.Now().AddDate(0, 0, -UsageRetentionDays).Format("2006-01-02")
+
+	usageMutex.Lock()
+	var records []UsageRecord
+	for _, users := range usagePending {
+		for _, record := range users {
+			records = append(records, *record)
+		}
+	}
+	usagePending = usageMap{}
+	for date := range usage {
+		if date < cutoff {
+			delete(usage, date)
+		}
+	}
+	usageMutex.Unlock()
+
+	if usageStore == nil {
+		return nil
+	}
+	if len(records) != 0 {
+		err := usageStore.Save(records)
+		if err != nil {
+			// Put the increments back so that they are not lost
+			usageMutex.Lock()
+			for _, record := range records {
+				addUsage(usagePending, record)
+			}
+			usageMutex.Unlock()
+			return err
+		}
+	}
+
+	// Pick up the usage recorded by the other nodes
+	loaded, err := usageStore.Load()
+	if err != nil {
+		return err
+	}
+	usageMutex.Lock()
+	for _, users := range usagePending {
+		for _, record := range users {
+			addUsage(loaded, *record)
+		}
+	}
+	usage = loaded
+	usageMutex.Unlock()
+
+	return nil
+}
+
+// Add the counters of record to the ones found in m
+func addUsage(m usageMap, record UsageRecord) {
+	if m[record.Date] == nil {
+		m[record.Date] = map[string]*UsageRecord{}
+	}
+	total, found := m[record.Date][record.User]
+	if !found {
+		total = &UsageRecord{
+			User: record.User,
+			Date: record.Date,
+		}
+		m[record.Date][record.User] = total
+	}
+	total.Requests += record.Requests
+	total.Bytes += record.Bytes
+	total.Cards += record.Cards
+}
+
+func recordUsage(user string, bytes, cards int64) {
+	if user == "" {
+		return
+	}
+	date := time.Now().Format("2006-01-02")
+
+	record := UsageRecord{
+		User:     user,
+		Date:     date,
+		Requests: 1,
+		Bytes:    bytes,
+		Cards:    cards,
+	}
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	addUsage(usage, record)
+	addUsage(usagePending, record)
+}
+
+// Check the usage of today against the quotas carried by the signature
+func checkQuota(sig string) error {
+	user := GetParamFromSig(sig, "UserEmail")
+	if user == "" {
+		return nil
+	}
+	maxRequests, _ := strconv.ParseInt(GetParamFromSig(sig, "APIDailyRequests"), 10, 64)
+	maxCards, _ := strconv.ParseInt(GetParamFromSig(sig, "APIDailyCards"), 10, 64)
+	if maxRequests <= 0 && maxCards <= 0 {
+		return nil
+	}
+
+	date := time.Now().Format("2006-01-02")
+
+	// Use the total of all nodes when available, together with what was not
+	// saved yet, or the local counters otherwise
+	var record UsageRecord
+	var shared *UsageRecord
+	var err error
+	if usageStore != nil {
+		shared, err = usageStore.Get(date, user)
+		if err != nil {
+			log.Println("unable to read shared usage:", err)
+		}
+	}
+
+	usageMutex.RLock()
+	if shared != nil {
+		record = *shared
+		pending, found := usagePending[date][user]
+		if found {
+			record.Requests += pending.Requests
+			record.Cards += pending.Cards
+		}
+	} else {
+		local, found := usage[date][user]
+		if found {
+			record = *local
+		}
+	}
+	usageMutex.RUnlock()
+
+	if (maxRequests > 0 && record.Requests >= maxRequests) ||
+		(maxCards > 0 && record.Cards >= maxCards) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Return the usage of a user, most recent first
+func getUserUsage(user string) []UsageRecord {
+	usageMutex.RLock()
+	defer usageMutex.RUnlock()
+
+	var records []UsageRecord
+	for _, users := range usage {
+		record, found := users[user]
+		if found {
+			records = append(records, *record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Date > records[j].Date
+	})
+	return records
+}
+
+// Return the usage of every user summed over the last days, heaviest first
+func getUsageTotals(days int) []UsageRecord {
+	cutoff := time.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	usageMutex.RLock()
+	totals := map[string]*UsageRecord{}
+	for date, users := range usage {
+		if date <= cutoff {
+			continue
+		}
+		for user, record := range users {
+			total, found := totals[user]
+			if !found {
+				total = &UsageRecord{
+					User: user,
+				}
+				totals[user] = total
+			}
+			total.Requests += record.Requests
+			total.Bytes += record.Bytes
+			total.Cards += record.Cards
+		}
+	}
+	usageMutex.RUnlock()
+
+	var records []UsageRecord
+	for _, total := range totals {
+		records = append(records, *total)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Bytes > records[j].Bytes
+	})
+	return records
+}
+
+// Keep track of the size of the response and of the cards it contains
+type usageKey struct{}
+
+type usageWriter struct {
+	http.ResponseWriter
+	bytes int64
+	cards int64
+}
+
+func (uw *usageWriter) Write(data []byte) (int, error) {
+	n, err := uw.ResponseWriter.Write(data)
+	uw.bytes += int64(n)
+	return n, err
+}
+
+func (uw *usageWriter) Flush() {
+	flusher, ok := uw.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func withUsage(w http.ResponseWriter, r *http.Request) (*usageWriter, *http.Request) {
+	uw := &usageWriter{ResponseWriter: w}
+	return uw, r.WithContext(context.WithValue(r.Context(), usageKey{}, uw))
+}
+
+// Account for the cards returned by an API handler
+func addUsageCards(r *http.Request, cards int) {
+	uw, ok := r.Context().Value(usageKey{}).(*usageWriter)
+	if ok {
+		uw.cards += int64(cards)
+	}
+}
+
+// Handler for /usage, showing the API usage of the current user
+func Usage(w http.ResponseWriter, r *http.Request) {
+	sig := getSignatureFromCookies(r)
+
+	pageVars := genPageNav("Usage", sig)
+	pageVars.Usage = getUserUsage(GetParamFromSig(sig, "UserEmail"))
+
+	quota := GetParamFromSig(sig, "APIDailyRequests")
+	if quota != "" {
+		pageVars.InfoMessage = "Daily limit of " + quota + " requests"
+	}
+	quota = GetParamFromSig(sig, "APIDailyCards")
+	if quota != "" {
+		if pageVars.InfoMessage != "" {
+			pageVars.InfoMessage += " and "
+		} else {
+			pageVars.InfoMessage = "Daily limit of "
+		}
+		pageVars.InfoMessage += quota + " cards"
+	}
+
+	render(w, "usage.html", pageVars)
+}
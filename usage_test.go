@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Counters shared by several nodes, as redisUsageStore would be
+type memoryUsageStore struct {
+	sync.Mutex
+	usage usageMap
+	fail  bool
+}
+
+func (ms *memoryUsageStore) Load() (usageMap, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	out := usageMap{}
+	for _, users := range ms.usage {
+		for _, record := range users {
+			addUsage(out, *record)
+		}
+	}
+	return out, nil
+}
+
+func (ms *memoryUsageStore) Save(records []UsageRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.fail {
+		return errors.New("store unavailable")
+	}
+	for _, record := range records {
+		addUsage(ms.usage, record)
+	}
+	return nil
+}
+
+func (ms *memoryUsageStore) Get(date, user string) (*UsageRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	record := &UsageRecord{
+		User: user,
+		Date: date,
+	}
+	stored, found := ms.usage[date][user]
+	if found {
+		*record = *stored
+	}
+	return record, nil
+}
+
+// Replace the usage state for the duration of a test
+func setupUsage(t *testing.T, store UsageStore) {
+	oldUsage, oldPending, oldStore := usage, usagePending, usageStore
+	t.Cleanup(func() {
+		usage, usagePending, usageStore = oldUsage, oldPending, oldStore
+	})
+	usage = usageMap{}
+	usagePending = usageMap{}
+	usageStore = store
+}
+
+func TestFileUsageStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	today := time.Now().Format("2006-01-02")
+	old := time.Now().AddDate(0, 0, -UsageRetentionDays-1).Format("2006-01-02")
+
+	// Two nodes adding to the same file must not overwrite each other
+	first := &fileUsageStore{path: path}
+	second := &fileUsageStore{path: path}
+
+	err := first.Save([]UsageRecord{
+		{User: "user@example.com", Date: today, Requests: 2, Bytes: 100, Cards: 10},
+		{User: "user@example.com", Date: old, Requests: 1},
+	})
+	if err != nil {
+		t.Fatalf("FAIL: Unable to save: %s", err)
+	}
+	err = second.Save([]UsageRecord{
+		{User: "user@example.com", Date: today, Requests: 3, Bytes: 50, Cards: 5},
+	})
+	if err != nil {
+		t.Fatalf("FAIL: Unable to save: %s", err)
+	}
+
+	loaded, err := first.Load()
+	if err != nil {
+		t.Fatalf("FAIL: Unable to load: %s", err)
+	}
+	record := loaded[today]["user@example.com"]
+	if record == nil || record.Requests != 5 || record.Bytes != 150 || record.Cards != 15 {
+		t.Errorf("FAIL: Expected the counters to be summed, got %+v", record)
+	}
+	if loaded[old] != nil {
+		t.Errorf("FAIL: Expected old usage to be pruned")
+	}
+}
+
+var QuotaTests = []struct {
+	Name     string
+	Requests int
+	Cards    int64
+	Sig      string
+	Expected error
+}{
+	{
+		Name:     "anonymous",
+		Requests: 100,
+		Sig:      encodeTestSig(url.Values{"APIDailyRequests": {"10"}}),
+	},
+	{
+		Name:     "no quota",
+		Requests: 100,
+		Sig:      encodeTestSig(url.Values{"UserEmail": {"user@example.com"}}),
+	},
+	{
+		Name:     "under the request quota",
+		Requests: 9,
+		Sig:      encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "APIDailyRequests": {"10"}}),
+	},
+	{
+		Name:     "at the request quota",
+		Requests: 10,
+		Sig:      encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "APIDailyRequests": {"10"}}),
+		Expected: ErrQuotaExceeded,
+	},
+	{
+		Name:     "under the card quota",
+		Requests: 1,
+		Cards:    99,
+		Sig:      encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "APIDailyCards": {"100"}}),
+	},
+	{
+		Name:     "over the card quota",
+		Requests: 1,
+		Cards:    150,
+		Sig:      encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "APIDailyRequests": {"10"}, "APIDailyCards": {"100"}}),
+		Expected: ErrQuotaExceeded,
+	},
+}
+
+func TestCheckQuota(t *testing.T) {
+	for _, test := range QuotaTests {
+		t.Run(test.Name, func(t *testing.T) {
+			setupUsage(t, nil)
+			for i := 0; i < test.Requests; i++ {
+				cards := int64(0)
+				if i == 0 {
+					cards = test.Cards
+				}
+				recordUsage("user@example.com", 10, cards)
+			}
+			err := checkQuota(test.Sig)
+			if err != test.Expected {
+				t.Errorf("FAIL: Expected '%v', got '%v'", test.Expected, err)
+			}
+		})
+	}
+}
+
+// Quotas are checked against the total of all the nodes
+func TestCheckQuotaShared(t *testing.T) {
+	store := &memoryUsageStore{usage: usageMap{}}
+	setupUsage(t, store)
+	sig := encodeTestSig(url.Values{"UserEmail": {"user@example.com"}, "APIDailyRequests": {"10"}})
+
+	// Usage recorded and saved by another node
+	today := time.Now().Format("2006-01-02")
+	store.Save([]UsageRecord{{User: "user@example.com", Date: today, Requests: 8}})
+
+	recordUsage("user@example.com", 10, 0)
+	err := checkQuota(sig)
+	if err != nil {
+		t.Fatalf("FAIL: Expected to be under quota, got '%v'", err)
+	}
+
+	// Usage not yet saved counts too
+	recordUsage("user@example.com", 10, 0)
+	err = checkQuota(sig)
+	if err != ErrQuotaExceeded {
+		t.Fatalf("FAIL: Expected the quota to be exceeded, got '%v'", err)
+	}
+
+	// Once saved, increments are not counted twice
+	err = flushUsage()
+	if err != nil {
+		t.Fatalf("FAIL: Unable to flush: %s", err)
+	}
+	stored, _ := store.Get(today, "user@example.com")
+	if stored.Requests != 10 {
+		t.Errorf("FAIL: Expected 10 stored requests, got %d", stored.Requests)
+	}
+	if len(usagePending) != 0 {
+		t.Errorf("FAIL: Expected no pending usage after flushing")
+	}
+	records := getUserUsage("user@example.com")
+	if len(records) != 1 || records[0].Requests != 10 {
+		t.Errorf("FAIL: Expected local usage to match the store, got %+v", records)
+	}
+}
+
+func TestFlushUsageFailure(t *testing.T) {
+	store := &memoryUsageStore{usage: usageMap{}, fail: true}
+	setupUsage(t, store)
+
+	recordUsage("user@example.com", 10, 1)
+	recordUsage("user@example.com", 10, 1)
+	err := flushUsage()
+	if err == nil {
+		t.Fatalf("FAIL: Expected the flush to fail")
+	}
+
+	// Nothing is lost and the next flush saves everything
+	store.fail = false
+	recordUsage("user@example.com", 10, 1)
+	err = flushUsage()
+	if err != nil {
+		t.Fatalf("FAIL: Unable to flush: %s", err)
+	}
+	stored, _ := store.Get(time.Now().Format("2006-01-02"), "user@example.com")
+	if stored.Requests != 3 || stored.Bytes != 30 || stored.Cards != 3 {
+		t.Errorf("FAIL: Expected all the usage to be saved, got %+v", stored)
+	}
+}
+
+func TestUsageWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/search", nil)
+
+	uw, req := withUsage(rec, req)
+	uw.Write([]byte("hello"))
+	uw.Write([]byte(" world"))
+	addUsageCards(req, 3)
+	addUsageCards(req, 2)
+
+	if uw.bytes != 11 {
+		t.Errorf("FAIL: Expected 11 bytes, got %d", uw.bytes)
+	}
+	if uw.cards != 5 {
+		t.Errorf("FAIL: Expected 5 cards, got %d", uw.cards)
+	}
+
+	// Requests without accounting are ignored
+	addUsageCards(httptest.NewRequest(http.MethodGet, "/", nil), 1)
+}